@@ -0,0 +1,223 @@
+// Package aof implements the append-only file: every write command is
+// appended to it in RESP format, and replayed to rebuild the keyspace on
+// startup. It is split into a base file and incremental files so that it can
+// be compacted by rewriting the base (see Log).
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// rdbPreamble starts the files in RDB format: base files written with
+// aof-use-rdb-preamble, and AOFs from before multi-part AOFs that were
+// rewritten with it.
+const rdbPreamble = "REDIS"
+
+// File is an append-only file open for writing.
+type File struct {
+	mu   sync.Mutex
+	file *os.File
+	// fsync is the appendfsync policy: "always" syncs after every write,
+	// "everysec" once per second and "no" leaves it to the OS.
+	fsync    string
+	unsynced bool
+	lastErr  error
+	done     chan struct{}
+	// size is the length of the file up to the last complete write.
+	size int64
+}
+
+// Open opens the file at path for appending, creating it if needed.
+func Open(path string, fsync string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &File{file: file, fsync: fsync, done: make(chan struct{}), size: info.Size()}
+	go f.cron()
+	return f, nil
+}
+
+// writeFile replaces the file at path with content, through a synced
+// temporary file renamed over it so that a crash leaves either file intact.
+func writeFile(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	temp, err := os.CreateTemp(dir, fmt.Sprintf("temp-rewriteaof-%d-*", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(content)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	// Make the rename itself durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append writes commands encoded in RESP to the file. After a short write,
+// e.g. when the disk is full, the partial command is truncated away so that
+// the file stays loadable.
+func (f *File) Append(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n, err := f.file.Write(data); err != nil {
+		if n > 0 {
+			if truncErr := f.file.Truncate(f.size); truncErr != nil {
+				fmt.Println("Could not remove short write from the append-only file: ", truncErr.Error())
+				f.size += int64(n)
+			}
+		}
+		f.lastErr = err
+		return err
+	}
+	f.size += int64(len(data))
+	f.unsynced = true
+	if f.fsync == "always" {
+		return f.sync()
+	}
+	return nil
+}
+
+// sync must be called with f.mu held.
+func (f *File) sync() error {
+	if err := f.file.Sync(); err != nil {
+		f.lastErr = err
+		return err
+	}
+	f.unsynced = false
+	f.lastErr = nil
+	return nil
+}
+
+func (f *File) SetFsync(policy string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fsync = policy
+}
+
+// LastError returns the error of the last failed write or fsync, or nil once
+// the file was synced again.
+func (f *File) LastError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastErr
+}
+
+// Close syncs and closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	close(f.done)
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// cron syncs the file every second with the everysec policy.
+func (f *File) cron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.fsync == "everysec" && f.unsynced {
+				if err := f.sync(); err != nil {
+					fmt.Println("Error syncing the AOF file: ", err.Error())
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Load replays the file at path: loadBase reads the RDB preamble it starts
+// with, if any, then apply runs each of its commands. Loading stops at the
+// first command apply fails. A command cut short at the end of the file, e.g.
+// by a crash in the middle of a write, is dropped and the file truncated to
+// the last complete command when loadTruncated is set; otherwise loading
+// fails. It returns an error wrapping os.ErrNotExist when there is no file.
+func Load(path string, loadTruncated bool, loadBase func(io.Reader) error, apply func(resp.Value) error) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The RDB decoder and the RESP reader share this buffer, so that the
+	// commands are read from right after the preamble.
+	buffered := bufio.NewReader(file)
+	valid := int64(0)
+	if header, _ := buffered.Peek(len(rdbPreamble)); string(header) == rdbPreamble {
+		if err := loadBase(buffered); err != nil {
+			return fmt.Errorf("error loading the RDB preamble of the append only file %s: %v", path, err)
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		valid = offset - int64(buffered.Buffered())
+	}
+
+	reader := resp.NewReader(buffered)
+	for {
+		command, n, err := reader.ReadValue()
+		if err == io.EOF && n == 0 {
+			return nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if !loadTruncated {
+				return fmt.Errorf("unexpected end of file reading the append only file %s, use aof-load-truncated yes to load it anyway", path)
+			}
+			fmt.Println("!!! Warning: short read while loading the AOF file", path, "!!!")
+			fmt.Println("AOF loaded anyway because aof-load-truncated is enabled, truncating it to", valid, "bytes")
+			return file.Truncate(valid)
+		}
+		if err != nil || command.Type != resp.RESPTypeArray || len(command.Array) == 0 {
+			return fmt.Errorf("bad file format reading the append only file %s at offset %d", path, valid)
+		}
+		if err := apply(command); err != nil {
+			return fmt.Errorf("error replaying the append only file %s at offset %d: %v", path, valid, err)
+		}
+		valid += int64(n)
+	}
+}
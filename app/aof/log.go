@@ -0,0 +1,283 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Log is the multi-part AOF: a base file holding a snapshot of the keyspace,
+// in RDB or RESP format, then the incremental files with the commands applied
+// after it, as listed by the manifest. They all live in one directory.
+type Log struct {
+	mu       sync.Mutex
+	dir      string
+	filename string
+	fsync    string
+	manifest *Manifest
+	// incr is the incremental file commands are appended to, nil until
+	// OpenIncr or StartRewrite.
+	incr *File
+	// rewriteIncrs is the number of incremental files the base written by
+	// the rewrite in progress replaces.
+	rewriteIncrs int
+	// size is the total size of the files, and baseSize what it was after
+	// the last rewrite or load, to measure the growth since.
+	size     int64
+	baseSize int64
+}
+
+// OpenLog opens the AOF kept in dir/dirname, whose files are named after
+// filename. An AOF from before multi-part AOFs, a single file at
+// dir/filename, is moved into the directory as its base file, in RDB format
+// when it starts with an RDB preamble.
+func OpenLog(dir string, dirname string, filename string, fsync string) (*Log, error) {
+	l := &Log{dir: filepath.Join(dir, dirname), filename: filename, fsync: fsync}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return nil, err
+	}
+	m, err := readManifest(l.path(l.manifestName()))
+	if errors.Is(err, os.ErrNotExist) {
+		m = &Manifest{}
+		if legacy, err := os.Open(filepath.Join(dir, filename)); err == nil {
+			// It is an RDB base when it was rewritten with an RDB
+			// preamble, whatever commands follow it.
+			header := make([]byte, len(rdbPreamble))
+			n, _ := io.ReadFull(legacy, header)
+			legacy.Close()
+			ext := "aof"
+			if string(header[:n]) == rdbPreamble {
+				ext = "rdb"
+			}
+			name := fmt.Sprintf("%s.1.base.%s", filename, ext)
+			fmt.Println("Upgrading the append only file", filename, "to a multi-part AOF in", l.dir)
+			if err := os.Rename(filepath.Join(dir, filename), l.path(name)); err != nil {
+				return nil, err
+			}
+			m.Base = &ManifestFile{Name: name, Seq: 1, Type: TypeBase}
+			if err := writeFile(l.path(l.manifestName()), m.encode()); err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	l.manifest = m
+
+	// Files of a rewrite that were not deleted before a crash.
+	for _, f := range m.History {
+		os.Remove(l.path(f.Name))
+	}
+	m.History = nil
+
+	l.measure()
+	return l, nil
+}
+
+func (l *Log) path(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+func (l *Log) manifestName() string {
+	return l.filename + ".manifest"
+}
+
+// files returns the base file then the incremental files.
+func (l *Log) files() []ManifestFile {
+	var files []ManifestFile
+	if l.manifest.Base != nil {
+		files = append(files, *l.manifest.Base)
+	}
+	return append(files, l.manifest.Incrs...)
+}
+
+// measure sets the size of the AOF from its files, as the base for the
+// growth of the next ones.
+func (l *Log) measure() {
+	l.size = 0
+	for _, f := range l.files() {
+		if info, err := os.Stat(l.path(f.Name)); err == nil {
+			l.size += info.Size()
+		}
+	}
+	l.baseSize = l.size
+}
+
+// Load replays the AOF: loadBase reads a base file in RDB format, and apply
+// runs the commands of the other files, or of the base file in RESP format.
+// Only the last file may end with a truncated command, kept when
+// loadTruncated is set (see Load). It returns false when there is no AOF yet.
+func (l *Log) Load(loadTruncated bool, loadBase func(io.Reader) error, apply func(resp.Value) error) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := l.files()
+	if len(files) == 0 {
+		return false, nil
+	}
+	for i, f := range files {
+		last := i == len(files)-1
+		if err := Load(l.path(f.Name), loadTruncated && last, loadBase, apply); err != nil {
+			return false, err
+		}
+	}
+	l.measure()
+	return true, nil
+}
+
+// OpenIncr starts appending to the last incremental file, or to a new one
+// when there is none.
+func (l *Log) OpenIncr() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n := len(l.manifest.Incrs); n > 0 {
+		f, err := Open(l.path(l.manifest.Incrs[n-1].Name), l.fsync)
+		if err != nil {
+			return err
+		}
+		l.incr = f
+		return nil
+	}
+	return l.newIncr()
+}
+
+// newIncr starts appending to a new incremental file, once it is listed in
+// the manifest. It must be called with l.mu held.
+func (l *Log) newIncr() error {
+	seq := l.manifest.nextSeq("incr")
+	name := fmt.Sprintf("%s.%d.incr.aof", l.filename, seq)
+	f, err := Open(l.path(name), l.fsync)
+	if err != nil {
+		return err
+	}
+	l.manifest.Incrs = append(l.manifest.Incrs, ManifestFile{Name: name, Seq: seq, Type: TypeIncremental})
+	if err := writeFile(l.path(l.manifestName()), l.manifest.encode()); err != nil {
+		l.manifest.Incrs = l.manifest.Incrs[:len(l.manifest.Incrs)-1]
+		f.Close()
+		os.Remove(l.path(name))
+		return err
+	}
+	if l.incr != nil {
+		l.incr.Close()
+	}
+	l.incr = f
+	return nil
+}
+
+// StartRewrite begins a rewrite: commands are appended to a new incremental
+// file from now on, and the files before it are replaced by the base file
+// given to FinishRewrite. That base must hold the keyspace as it is at this
+// point, before any other command is appended.
+func (l *Log) StartRewrite() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.newIncr(); err != nil {
+		return err
+	}
+	l.rewriteIncrs = len(l.manifest.Incrs) - 1
+	return nil
+}
+
+// FinishRewrite installs base as the new base file, in RDB format when
+// rdbFormat is set and RESP otherwise, then deletes the files it replaces.
+func (l *Log) FinishRewrite(base []byte, rdbFormat bool) error {
+	// Only one rewrite runs at a time, so the name of the new base file is
+	// not taken meanwhile.
+	l.mu.Lock()
+	seq := l.manifest.nextSeq("base")
+	l.mu.Unlock()
+	ext := "aof"
+	if rdbFormat {
+		ext = "rdb"
+	}
+	name := fmt.Sprintf("%s.%d.base.%s", l.filename, seq, ext)
+	if err := writeFile(l.path(name), base); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var replaced []ManifestFile
+	if l.manifest.Base != nil {
+		replaced = append(replaced, *l.manifest.Base)
+	}
+	replaced = append(replaced, l.manifest.Incrs[:l.rewriteIncrs]...)
+	m := &Manifest{
+		Base:  &ManifestFile{Name: name, Seq: seq, Type: TypeBase},
+		Incrs: append([]ManifestFile(nil), l.manifest.Incrs[l.rewriteIncrs:]...),
+	}
+	if err := writeFile(l.path(l.manifestName()), m.encode()); err != nil {
+		os.Remove(l.path(name))
+		return err
+	}
+	l.manifest = m
+	l.rewriteIncrs = 0
+	for _, f := range replaced {
+		os.Remove(l.path(f.Name))
+	}
+	l.measure()
+	return nil
+}
+
+// Append writes commands encoded in RESP to the current incremental file.
+func (l *Log) Append(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.incr == nil {
+		return nil
+	}
+	if err := l.incr.Append(data); err != nil {
+		return err
+	}
+	l.size += int64(len(data))
+	return nil
+}
+
+func (l *Log) SetFsync(policy string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fsync = policy
+	if l.incr != nil {
+		l.incr.SetFsync(policy)
+	}
+}
+
+// LastError returns the error of the last failed write or fsync, see
+// File.LastError.
+func (l *Log) LastError() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.incr == nil {
+		return nil
+	}
+	return l.incr.LastError()
+}
+
+// Sizes returns the current size of the AOF and its size after the last
+// rewrite or load.
+func (l *Log) Sizes() (size int64, baseSize int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size, l.baseSize
+}
+
+// Close stops appending to the AOF.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.incr == nil {
+		return nil
+	}
+	err := l.incr.Close()
+	l.incr = nil
+	return err
+}
@@ -0,0 +1,201 @@
+package aof
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+func command(args ...any) []byte {
+	return resp.ToArray(args)
+}
+
+// replay loads the AOF in dir and returns the keys of its RDB files, sorted,
+// then the first argument of each command.
+func replay(t *testing.T, dir string) []string {
+	t.Helper()
+	l, err := OpenLog(dir, "appendonlydir", "appendonly.aof", "no")
+	if err != nil {
+		t.Fatalf("OpenLog: %v", err)
+	}
+	var names []string
+	loadBase := func(r io.Reader) error {
+		_, databases, err := rdb.Read(r)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for key := range databases[0].Store {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		names = append(names, keys...)
+		return nil
+	}
+	found, err := l.Load(false, loadBase, func(command resp.Value) error {
+		names = append(names, command.Array[1].String)
+		return nil
+	})
+	if err != nil || !found {
+		t.Fatalf("Load = %v, %v", found, err)
+	}
+	return names
+}
+
+func TestLogRewrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLog(dir, "appendonlydir", "appendonly.aof", "always")
+	if err != nil {
+		t.Fatalf("OpenLog: %v", err)
+	}
+	if err := l.OpenIncr(); err != nil {
+		t.Fatalf("OpenIncr: %v", err)
+	}
+	l.Append(command("SET", "a", "1"))
+
+	if err := l.StartRewrite(); err != nil {
+		t.Fatalf("StartRewrite: %v", err)
+	}
+	// Appended after the rewrite started: kept in the new incremental file.
+	l.Append(command("SET", "b", "2"))
+	if err := l.FinishRewrite(command("SET", "base", "0"), false); err != nil {
+		t.Fatalf("FinishRewrite: %v", err)
+	}
+	l.Append(command("SET", "c", "3"))
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got, want := replay(t, dir), []string{"base", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed keys = %v, want %v", got, want)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "appendonlydir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{"appendonly.aof.1.base.aof", "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files after the rewrite = %v, want %v", names, want)
+	}
+}
+
+func TestOpenLogUpgradesSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), command("SET", "old", "1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(t, dir), []string{"old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed keys = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appendonly.aof")); !os.IsNotExist(err) {
+		t.Errorf("the single file was not moved into the AOF directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.base.aof")); err != nil {
+		t.Errorf("the single file is not the RESP base file: %v", err)
+	}
+}
+
+func TestOpenLogUpgradesPreambleFile(t *testing.T) {
+	dir := t.TempDir()
+	db := resp.NewDatabase(0)
+	db.Store["snapshot"] = resp.StoreValue{String: resp.NewString([]byte("1"))}
+	preamble, err := rdb.Encode(nil, map[uint8]resp.Database{0: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := append(preamble, command("SET", "after", "2")...)
+	if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := replay(t, dir), []string{"snapshot", "after"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed keys = %v, want %v", got, want)
+	}
+	m, err := readManifest(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Base == nil || m.Base.Name != "appendonly.aof.1.base.rdb" || m.Base.Type != TypeBase {
+		t.Errorf("manifest base = %+v, want the RDB base appendonly.aof.1.base.rdb", m.Base)
+	}
+}
+
+func TestLoadStopsOnFailedCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	data := append(command("SET", "a", "1"), command("BOGUS", "b")...)
+	data = append(data, command("SET", "c", "3")...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := 0
+	err := Load(path, false, nil, func(command resp.Value) error {
+		if command.Array[0].String == "BOGUS" {
+			return errors.New("unknown command")
+		}
+		applied++
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Load succeeded with a failed command")
+	}
+	if applied != 1 {
+		t.Errorf("applied %d commands, want only the one before the failure", applied)
+	}
+}
+
+func TestLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := command("SET", "a", "1")
+	if err := os.WriteFile(path, append(complete, "*3\r\n$3\r\nSET"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(path, false, nil, func(resp.Value) error { return nil }); err == nil {
+		t.Errorf("Load of a truncated file succeeded without aof-load-truncated")
+	}
+	applied := 0
+	if err := Load(path, true, nil, func(resp.Value) error { applied++; return nil }); err != nil {
+		t.Fatalf("Load with aof-load-truncated: %v", err)
+	}
+	if applied != 1 {
+		t.Errorf("applied %d commands, want 1", applied)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(complete)) {
+		t.Errorf("file not truncated to the last complete command")
+	}
+}
+
+func TestLoadTruncatedAfterPreamble(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	preamble, err := rdb.Encode(nil, map[uint8]resp.Database{0: resp.NewDatabase(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := append(preamble, command("SET", "a", "1")...)
+	if err := os.WriteFile(path, append(complete, "*3\r\n$3\r\nSET"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loadBase := func(r io.Reader) error {
+		_, _, err := rdb.Read(r)
+		return err
+	}
+	if err := Load(path, true, loadBase, func(resp.Value) error { return nil }); err != nil {
+		t.Fatalf("Load with aof-load-truncated: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(complete)) {
+		t.Errorf("file not truncated to the last complete command after the preamble")
+	}
+}
@@ -0,0 +1,117 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// File types of the manifest: the base file holds a snapshot of the
+// keyspace, the incremental files the commands applied after it, and history
+// files are left over by a rewrite and about to be deleted.
+const (
+	TypeBase        = "b"
+	TypeHistory     = "h"
+	TypeIncremental = "i"
+)
+
+// ManifestFile is an entry of the manifest.
+type ManifestFile struct {
+	Name string
+	Seq  int64
+	Type string
+}
+
+// Manifest lists the files making up the AOF, in the format of Redis 7:
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+type Manifest struct {
+	Base    *ManifestFile
+	Incrs   []ManifestFile
+	History []ManifestFile
+}
+
+// readManifest parses the manifest at path. It returns an error wrapping
+// os.ErrNotExist when there is none.
+func readManifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &Manifest{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest file format at line %d", line)
+		}
+		var f ManifestFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.Name = fields[i+1]
+			case "seq":
+				if f.Seq, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid AOF manifest file format at line %d", line)
+				}
+			case "type":
+				f.Type = fields[i+1]
+			}
+		}
+		if f.Name == "" || f.Seq == 0 {
+			return nil, fmt.Errorf("invalid AOF manifest file format at line %d", line)
+		}
+		switch f.Type {
+		case TypeBase:
+			if m.Base != nil {
+				return nil, fmt.Errorf("found duplicate base file information in the AOF manifest")
+			}
+			m.Base = &f
+		case TypeIncremental:
+			m.Incrs = append(m.Incrs, f)
+		case TypeHistory:
+			m.History = append(m.History, f)
+		default:
+			return nil, fmt.Errorf("unknown AOF file type %q in the AOF manifest", f.Type)
+		}
+	}
+	return m, scanner.Err()
+}
+
+func (m *Manifest) encode() []byte {
+	var b strings.Builder
+	var files []ManifestFile
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	files = append(append(files, m.History...), m.Incrs...)
+	for _, f := range files {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.Name, f.Seq, f.Type)
+	}
+	return []byte(b.String())
+}
+
+// nextSeq returns the sequence number for a new "base" or "incr" file,
+// past the ones of the files still listed, history included, so that its name
+// is not taken.
+func (m *Manifest) nextSeq(kind string) int64 {
+	seq := int64(0)
+	files := append(append([]ManifestFile(nil), m.Incrs...), m.History...)
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name, "."+kind+".") {
+			seq = max(seq, f.Seq)
+		}
+	}
+	return seq + 1
+}
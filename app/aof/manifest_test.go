@@ -0,0 +1,74 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeManifest(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadManifest(t *testing.T) {
+	path := writeManifest(t, "# comment\n"+
+		"file appendonly.aof.2.base.rdb seq 2 type b\n"+
+		"\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type h\n"+
+		"file appendonly.aof.3.incr.aof seq 3 type i\n"+
+		"file appendonly.aof.4.incr.aof seq 4 type i\n")
+	m, err := readManifest(path)
+	if err != nil {
+		t.Fatalf("readManifest: %v", err)
+	}
+	want := &Manifest{
+		Base:    &ManifestFile{Name: "appendonly.aof.2.base.rdb", Seq: 2, Type: TypeBase},
+		History: []ManifestFile{{Name: "appendonly.aof.1.incr.aof", Seq: 1, Type: TypeHistory}},
+		Incrs: []ManifestFile{
+			{Name: "appendonly.aof.3.incr.aof", Seq: 3, Type: TypeIncremental},
+			{Name: "appendonly.aof.4.incr.aof", Seq: 4, Type: TypeIncremental},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("readManifest = %+v, want %+v", m, want)
+	}
+	if seq := m.nextSeq("incr"); seq != 5 {
+		t.Errorf("nextSeq(incr) = %d, want 5", seq)
+	}
+	if seq := m.nextSeq("base"); seq != 3 {
+		t.Errorf("nextSeq(base) = %d, want 3", seq)
+	}
+
+	// encode writes the manifest back in the same format.
+	encoded := writeManifest(t, string(m.encode()))
+	reread, err := readManifest(encoded)
+	if err != nil {
+		t.Fatalf("readManifest of the encoded manifest: %v", err)
+	}
+	if !reflect.DeepEqual(reread, want) {
+		t.Errorf("encoded manifest reads back as %+v, want %+v", reread, want)
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	for _, content := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 1 type x\n",
+		"file a seq 1 type\n",
+		"file a seq one type i\n",
+		"seq 1 type i\n",
+	} {
+		if _, err := readManifest(writeManifest(t, content)); err == nil {
+			t.Errorf("readManifest(%q) succeeded", content)
+		}
+	}
+	if _, err := readManifest(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("readManifest of a missing file: err = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	nextID  atomic.Int64
+	mu      sync.RWMutex
+	clients = make(map[int64]*Client)
+)
+
+const (
+	// FlagMaster marks the replication link to our master: commands are
+	// applied but no replies are sent back.
+	FlagMaster uint32 = 1 << iota
+	// FlagAsking lets the next command use a slot being imported, after an
+	// ASK redirection (ASKING).
+	FlagAsking
+)
+
+// Client is a single connection to the server. Replies may be written from
+// other goroutines (e.g. invalidation messages), so every write goes through
+// Write which serializes access to the connection.
+type Client struct {
+	ID    int64
+	Conn  net.Conn
+	Flags uint32
+	// WriteOffset is the replication offset right after the last write
+	// command of this client, used by WAIT.
+	WriteOffset int64
+
+	mu       sync.Mutex
+	name     string
+	protocol int
+	channels map[string]bool
+	// droppedError is the last error reply not sent to the master link.
+	droppedError string
+}
+
+func New(conn net.Conn) *Client {
+	c := &Client{
+		ID:       nextID.Add(1),
+		Conn:     conn,
+		protocol: 2,
+		channels: make(map[string]bool),
+	}
+	mu.Lock()
+	clients[c.ID] = c
+	mu.Unlock()
+	return c
+}
+
+func Get(id int64) (*Client, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := clients[id]
+	return c, ok
+}
+
+func Remove(id int64) {
+	mu.Lock()
+	delete(clients, id)
+	mu.Unlock()
+}
+
+// Subscribers returns the clients subscribed to channel, in connection order.
+func Subscribers(channel string) []*Client {
+	mu.RLock()
+	defer mu.RUnlock()
+	var subscribers []*Client
+	for _, c := range clients {
+		if c.Subscribed(channel) {
+			subscribers = append(subscribers, c)
+		}
+	}
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i].ID < subscribers[j].ID })
+	return subscribers
+}
+
+func (c *Client) Write(data []byte) (int, error) {
+	if c.Flags&FlagMaster != 0 {
+		if len(data) > 0 && data[0] == '-' {
+			c.mu.Lock()
+			c.droppedError = strings.TrimSpace(string(data[1:]))
+			c.mu.Unlock()
+		}
+		return len(data), nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(data)
+}
+
+// DroppedError returns and clears the last error reply that Write did not
+// send to the master link, e.g. to stop loading the AOF at a failed command.
+func (c *Client) DroppedError() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.droppedError
+	c.droppedError = ""
+	return err
+}
+
+// ForceWrite writes even to the master link, for the few messages a master
+// expects from its replica such as REPLCONF ACK.
+func (c *Client) ForceWrite(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(data)
+}
+
+func (c *Client) Protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+func (c *Client) SetProtocol(protocol int) {
+	c.mu.Lock()
+	c.protocol = protocol
+	c.mu.Unlock()
+}
+
+func (c *Client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+func (c *Client) SetName(name string) {
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+}
+
+// Subscribe adds the channel to the client's subscriptions and returns the
+// number of channels the client is subscribed to.
+func (c *Client) Subscribe(channel string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channels[channel] = true
+	return len(c.channels)
+}
+
+// Unsubscribe removes the channel from the client's subscriptions and returns
+// the number of channels the client is still subscribed to.
+func (c *Client) Unsubscribe(channel string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, channel)
+	return len(c.channels)
+}
+
+func (c *Client) Subscribed(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channels[channel]
+}
+
+func (c *Client) Subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	channels := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
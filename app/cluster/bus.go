@@ -0,0 +1,464 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	pingPeriod = time.Second
+	cronPeriod = 100 * time.Millisecond
+)
+
+// Messages exchanged over the cluster bus are RESP arrays made of a header
+// describing the sender, followed by gossip about the other nodes it knows:
+//
+//	type id port bus-port current-epoch config-epoch slots-bitmap gossip [failing-id]
+//
+// where type is MEET, PING, PONG or FAIL, and each gossip entry is an array of
+// id, host, port, bus port and flags as shown by CLUSTER NODES.
+const (
+	fieldType = iota
+	fieldID
+	fieldPort
+	fieldBusPort
+	fieldCurrentEpoch
+	fieldConfigEpoch
+	fieldSlots
+	fieldGossip
+	fieldFailing
+)
+
+// Start listens on the cluster bus and starts pinging the known nodes.
+func (s *State) Start() error {
+	l, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(s.myself.BusPort))
+	if err != nil {
+		return err
+	}
+	go s.accept(l)
+
+	s.mu.Lock()
+	for _, node := range s.nodes {
+		if node != s.myself {
+			s.startLink(node)
+		}
+	}
+	s.mu.Unlock()
+	go s.cron()
+	return nil
+}
+
+// accept serves the connections of other nodes until l is closed. Failed
+// accepts, e.g. when out of file descriptors, are retried with a backoff.
+func (s *State) accept(l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			fmt.Println("Error accepting cluster bus connection: ", err.Error())
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go s.serve(conn)
+	}
+}
+
+// serve handles the messages other nodes send us over their link to us.
+func (s *State) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := resp.NewReader(conn)
+	for {
+		msg, _, err := r.ReadValue()
+		if err != nil {
+			return
+		}
+		if reply := s.process(msg, conn, nil); reply != nil {
+			conn.SetWriteDeadline(time.Now().Add(pingPeriod))
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// startLink starts our link to node, over which we ping it and send it our
+// broadcasts. It must be called with s.mu held.
+func (s *State) startLink(node *Node) {
+	node.outbox = make(chan []byte, 16)
+	go s.link(node, node.outbox)
+}
+
+// link pings node every pingPeriod, meeting it first if it is in handshake,
+// until it is removed from the cluster.
+func (s *State) link(node *Node, outbox chan []byte) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	var conn net.Conn
+	var r *resp.Reader
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		s.mu.Lock()
+		node.linked = false
+		s.mu.Unlock()
+	}
+	defer disconnect()
+
+	for {
+		s.mu.Lock()
+		addr := net.JoinHostPort(node.Host, strconv.Itoa(node.BusPort))
+		msgType := "PING"
+		if node.handshake {
+			msgType = "MEET"
+		}
+		ping := s.message(msgType)
+		s.mu.Unlock()
+
+		if conn == nil {
+			if c, err := net.DialTimeout("tcp", addr, pingPeriod); err == nil {
+				conn, r = c, resp.NewReader(c)
+				s.mu.Lock()
+				node.linked = true
+				s.mu.Unlock()
+			}
+		}
+		if conn != nil {
+			s.mu.Lock()
+			node.pingSent = time.Now()
+			s.messagesSent++
+			s.mu.Unlock()
+			conn.SetDeadline(time.Now().Add(pingPeriod))
+			if _, err := conn.Write(ping); err != nil {
+				disconnect()
+			} else if pong, _, err := r.ReadValue(); err != nil {
+				disconnect()
+			} else {
+				s.process(pong, conn, node)
+			}
+		}
+
+	wait:
+		for {
+			select {
+			case <-ticker.C:
+				break wait
+			case msg, ok := <-outbox:
+				if !ok {
+					return
+				}
+				if conn != nil {
+					conn.SetWriteDeadline(time.Now().Add(pingPeriod))
+					conn.Write(msg)
+				}
+			}
+		}
+	}
+}
+
+// process handles a message received over the bus and returns the reply to
+// send back, if any. link is the node whose link received the message, or
+// nil when it was received on a connection accepted by our bus.
+func (s *State) process(msg resp.Value, conn net.Conn, link *Node) []byte {
+	if msg.Type != resp.RESPTypeArray || len(msg.Array) <= fieldGossip {
+		return nil
+	}
+	fields := msg.Array
+	msgType, senderID := fields[fieldType].String, fields[fieldID].String
+	port, err1 := strconv.Atoi(fields[fieldPort].String)
+	busPort, err2 := strconv.Atoi(fields[fieldBusPort].String)
+	currentEpoch, err3 := strconv.ParseInt(fields[fieldCurrentEpoch].String, 10, 64)
+	configEpoch, err4 := strconv.ParseInt(fields[fieldConfigEpoch].String, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(fields[fieldSlots].String) != SlotCount/8 {
+		return nil
+	}
+	remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messagesReceived++
+	if s.myself.Host == "" {
+		// We learn our address from the connections other nodes accept.
+		s.myself.Host = localHost
+		s.dirty = true
+	}
+	if expires, forgotten := s.forgotten[senderID]; forgotten && time.Now().Before(expires) {
+		return nil
+	}
+
+	sender := s.nodes[senderID]
+	if sender != nil && sender.handshake {
+		sender = nil
+	}
+	switch msgType {
+	case "MEET":
+		if sender == nil {
+			sender = &Node{ID: senderID, Host: remoteHost, Port: port, BusPort: busPort, created: time.Now()}
+			s.nodes[senderID] = sender
+			s.startLink(sender)
+			s.dirty = true
+			fmt.Println("Node", senderID, "joined the cluster from", remoteHost)
+		}
+	case "PONG":
+		if link == nil {
+			break
+		}
+		if link.handshake {
+			if sender != nil {
+				// We already know the node under its real ID.
+				s.deleteNode(link)
+				break
+			}
+			delete(s.nodes, link.ID)
+			link.ID = senderID
+			link.handshake = false
+			s.nodes[senderID] = link
+			s.dirty = true
+			sender = link
+		}
+		if sender == link {
+			link.pongReceived = time.Now()
+			link.pfail = false
+			if link.fail {
+				link.fail = false
+				s.updateState()
+				s.dirty = true
+				fmt.Println("Clear FAIL state for node", link.ID)
+			}
+		}
+	case "FAIL":
+		if sender != nil && len(fields) > fieldFailing {
+			if failing, exists := s.nodes[fields[fieldFailing].String]; exists && failing != s.myself && !failing.fail {
+				failing.fail = true
+				s.updateState()
+				s.dirty = true
+				fmt.Println("FAIL message received from", sender.ID, "about", failing.ID)
+			}
+		}
+	}
+
+	if sender != nil {
+		s.updateFromSender(sender, currentEpoch, configEpoch, fields[fieldSlots].String)
+		s.processGossip(sender, fields[fieldGossip].Array)
+	}
+	if msgType == "MEET" || msgType == "PING" {
+		return s.message("PONG")
+	}
+	return nil
+}
+
+// updateFromSender applies the epochs and slots announced by a known node.
+// It must be called with s.mu held.
+func (s *State) updateFromSender(sender *Node, currentEpoch int64, configEpoch int64, bitmap string) {
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+		s.dirty = true
+	}
+	if configEpoch > sender.configEpoch {
+		sender.configEpoch = configEpoch
+		s.dirty = true
+	}
+
+	// A slot claimed by the sender is assigned to it unless it is served by a
+	// node with a greater config epoch. The slots we are importing are only
+	// assigned with CLUSTER SETSLOT NODE.
+	changed := false
+	for slot := 0; slot < SlotCount; slot++ {
+		if bitmap[slot/8]&(1<<(slot%8)) == 0 || s.importing[slot] != nil {
+			continue
+		}
+		if owner := s.slots[slot]; owner != sender && (owner == nil || owner.configEpoch < sender.configEpoch) {
+			s.slots[slot] = sender
+			s.migrating[slot] = nil
+			changed = true
+		}
+	}
+	if changed {
+		s.updateState()
+		s.dirty = true
+	}
+
+	// Two masters with the same config epoch could claim the same slots; the
+	// one with the smaller ID moves to a new epoch.
+	if sender.configEpoch == s.myself.configEpoch && s.myself.ID < sender.ID {
+		s.bumpConfigEpoch()
+		s.dirty = true
+	}
+}
+
+// processGossip learns about the nodes the sender knows and records its
+// failure reports. It must be called with s.mu held.
+func (s *State) processGossip(sender *Node, gossip []resp.Value) {
+	now := time.Now()
+	for _, entry := range gossip {
+		if len(entry.Array) != 5 {
+			continue
+		}
+		id, host := entry.Array[0].String, entry.Array[1].String
+		port, err1 := strconv.Atoi(entry.Array[2].String)
+		busPort, err2 := strconv.Atoi(entry.Array[3].String)
+		if err1 != nil || err2 != nil || id == s.myself.ID {
+			continue
+		}
+		if expires, forgotten := s.forgotten[id]; forgotten && now.Before(expires) {
+			continue
+		}
+		node, exists := s.nodes[id]
+		if !exists {
+			if host != "" {
+				s.startHandshake(host, port, busPort)
+			}
+			continue
+		}
+		if flags := entry.Array[4].String; strings.Contains(flags, "fail") {
+			if node.failReports == nil {
+				node.failReports = make(map[string]time.Time)
+			}
+			node.failReports[sender.ID] = now
+		} else {
+			delete(node.failReports, sender.ID)
+		}
+	}
+}
+
+// failureReports returns the number of masters serving slots that consider
+// node failing, us included. It must be called with s.mu held.
+func (s *State) failureReports(node *Node) int {
+	serving := s.serving()
+	count := 0
+	if serving[s.myself] {
+		count++
+	}
+	for id := range node.failReports {
+		if reporter, exists := s.nodes[id]; exists && serving[reporter] {
+			count++
+		}
+	}
+	return count
+}
+
+// startHandshake adds a node we are about to meet, unless it is already
+// known. It must be called with s.mu held.
+func (s *State) startHandshake(host string, port int, busPort int) {
+	for _, node := range s.nodes {
+		if node.Host == host && node.Port == port && node.BusPort == busPort {
+			return
+		}
+	}
+	node := &Node{ID: NewNodeID(), Host: host, Port: port, BusPort: busPort, handshake: true, created: time.Now()}
+	s.nodes[node.ID] = node
+	s.startLink(node)
+}
+
+// message encodes a bus message of the given type. It must be called with
+// s.mu held.
+func (s *State) message(msgType string, extra ...any) []byte {
+	bitmap := make([]byte, SlotCount/8)
+	for slot, owner := range s.slots {
+		if owner == s.myself {
+			bitmap[slot/8] |= 1 << (slot % 8)
+		}
+	}
+	gossip := []any{}
+	for _, node := range s.sortedNodes() {
+		if node == s.myself || node.handshake {
+			continue
+		}
+		gossip = append(gossip, []any{node.ID, node.Host, strconv.Itoa(node.Port), strconv.Itoa(node.BusPort), s.flags(node)})
+	}
+	msg := []any{
+		msgType, s.myself.ID, strconv.Itoa(s.myself.Port), strconv.Itoa(s.myself.BusPort),
+		strconv.FormatInt(s.currentEpoch, 10), strconv.FormatInt(s.myself.configEpoch, 10),
+		string(bitmap), gossip,
+	}
+	return resp.ToArray(append(msg, extra...))
+}
+
+// broadcast sends a message to every node we are linked to. It must be
+// called with s.mu held.
+func (s *State) broadcast(msg []byte) {
+	for _, node := range s.nodes {
+		if node == s.myself || node.handshake || node.outbox == nil {
+			continue
+		}
+		select {
+		case node.outbox <- msg:
+			s.messagesSent++
+		default:
+		}
+	}
+}
+
+// cron runs the periodic tasks: timing out handshakes, detecting failures
+// and saving the configuration when it changed.
+func (s *State) cron() {
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		now := time.Now()
+		for _, node := range s.nodes {
+			if node == s.myself {
+				continue
+			}
+			if node.handshake {
+				if now.Sub(node.created) > max(s.nodeTimeout, time.Second) {
+					s.deleteNode(node)
+				}
+				continue
+			}
+
+			last := node.pongReceived
+			if last.IsZero() {
+				last = node.created
+			}
+			if !node.pfail && !node.fail && now.Sub(last) > s.nodeTimeout {
+				node.pfail = true
+				fmt.Println("Node", node.ID, "possibly failing")
+			}
+			for id, reported := range node.failReports {
+				if now.Sub(reported) > 2*s.nodeTimeout {
+					delete(node.failReports, id)
+				}
+			}
+			// A node is failing once a majority of the masters serving slots,
+			// including us, reported it.
+			if node.pfail && !node.fail && s.failureReports(node) >= s.size()/2+1 {
+				node.fail = true
+				s.updateState()
+				s.dirty = true
+				s.broadcast(s.message("FAIL", node.ID))
+				fmt.Println("Marking node", node.ID, "as failing (quorum reached)")
+			}
+		}
+		for id, expires := range s.forgotten {
+			if now.After(expires) {
+				delete(s.forgotten, id)
+			}
+		}
+		if s.dirty {
+			if err := s.saveConfig(); err != nil {
+				fmt.Println("Error saving cluster configuration: ", err.Error())
+			}
+			s.dirty = false
+		}
+		s.mu.Unlock()
+	}
+}
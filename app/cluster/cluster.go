@@ -0,0 +1,607 @@
+// Package cluster implements Redis Cluster: the keyspace is split into
+// SlotCount hash slots, each served by one node, and the nodes exchange their
+// configuration over the cluster bus.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/crc16"
+)
+
+const (
+	SlotCount = 16384
+	// BusPortOffset is added to the client port to get the cluster bus port.
+	BusPortOffset = 10000
+	// forgetTTL is how long a forgotten node is ignored in gossip.
+	forgetTTL = 60 * time.Second
+)
+
+// KeySlot maps a key to its hash slot. When the key contains a non-empty
+// {hashtag} section, only the hashtag is hashed so that related keys can be
+// forced into the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16.Digest([]byte(key)) & (SlotCount - 1))
+}
+
+// Node is a member of the cluster.
+type Node struct {
+	ID      string
+	Host    string
+	Port    int
+	BusPort int
+
+	configEpoch int64
+	// handshake is set until the node replied to our MEET with its real ID.
+	handshake bool
+	created   time.Time
+	// pfail is set when the node did not reply for the node timeout, and fail
+	// once enough masters agreed on it.
+	pfail        bool
+	fail         bool
+	failReports  map[string]time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	linked       bool
+	outbox       chan []byte
+}
+
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// State is the view this node has of the cluster: its members and which of
+// them serves each slot.
+type State struct {
+	mu     sync.Mutex
+	myself *Node
+	nodes  map[string]*Node
+	slots  [SlotCount]*Node
+	// importing and migrating hold the source and target nodes of the slots
+	// being moved to or away from us (CLUSTER SETSLOT).
+	importing    [SlotCount]*Node
+	migrating    [SlotCount]*Node
+	currentEpoch int64
+	nodeTimeout  time.Duration
+	configPath   string
+	// forgotten holds nodes removed with CLUSTER FORGET until they expire.
+	forgotten map[string]time.Time
+	ok        bool
+	// dirty is set when the configuration changed and must be saved.
+	dirty bool
+
+	messagesSent     int64
+	messagesReceived int64
+}
+
+// New creates the cluster state of a node listening on port, restoring it
+// from the configuration file at configPath when it exists.
+func New(port int, nodeTimeout time.Duration, configPath string) (*State, error) {
+	myself := &Node{ID: NewNodeID(), Port: port, BusPort: port + BusPortOffset, created: time.Now()}
+	s := &State{
+		myself:      myself,
+		nodes:       map[string]*Node{myself.ID: myself},
+		nodeTimeout: nodeTimeout,
+		configPath:  configPath,
+		forgotten:   make(map[string]time.Time),
+	}
+	if err := s.loadConfig(); err != nil {
+		return nil, err
+	}
+	s.myself.Port, s.myself.BusPort = port, port+BusPortOffset
+	s.updateState()
+	s.dirty = true
+	return s, nil
+}
+
+// NewNodeID returns a random 40 characters node ID.
+func NewNodeID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (s *State) Myself() *Node {
+	return s.myself
+}
+
+// Owner returns the node serving slot, or nil if it is not served.
+func (s *State) Owner(slot int) *Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.slots[slot]
+}
+
+// SetSlotMigrating marks a slot we serve as being moved to the node id
+// (CLUSTER SETSLOT MIGRATING): the keys that are already gone are redirected
+// to it with ASK.
+func (s *State) SetSlotMigrating(slot int, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.slots[slot] != s.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	node, exists := s.nodes[id]
+	if !exists || node.handshake {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	if node == s.myself {
+		return fmt.Errorf("Target node is myself")
+	}
+	s.migrating[slot] = node
+	s.dirty = true
+	return nil
+}
+
+// SetSlotImporting marks a slot as being moved to us from the node id
+// (CLUSTER SETSLOT IMPORTING): we serve its keys to clients sending ASKING.
+func (s *State) SetSlotImporting(slot int, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.slots[slot] == s.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	node, exists := s.nodes[id]
+	if !exists || node.handshake {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	if node == s.myself {
+		return fmt.Errorf("Source node is myself")
+	}
+	s.importing[slot] = node
+	s.dirty = true
+	return nil
+}
+
+// SetSlotStable cancels the migration of a slot (CLUSTER SETSLOT STABLE).
+func (s *State) SetSlotStable(slot int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.importing[slot], s.migrating[slot] = nil, nil
+	s.dirty = true
+}
+
+// SetSlotNode assigns a slot to the node id, ending its migration (CLUSTER
+// SETSLOT NODE). keys is the number of keys we hold in the slot, which must
+// be zero to give away a slot we serve. When we take over an imported slot,
+// our config epoch is bumped so that our claim wins over the source's.
+func (s *State) SetSlotNode(slot int, id string, keys int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[id]
+	if !exists || node.handshake {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+	if s.slots[slot] == s.myself && node != s.myself && keys > 0 {
+		return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+	}
+	if node != s.myself {
+		s.migrating[slot] = nil
+	}
+	if node == s.myself && s.importing[slot] != nil {
+		s.importing[slot] = nil
+		s.bumpConfigEpoch()
+	}
+	s.slots[slot] = node
+	s.dirty = true
+	s.updateState()
+	return nil
+}
+
+// bumpConfigEpoch gives us a config epoch greater than any other node's, so
+// that the slots we claim win over previous claims. It must be called with
+// s.mu held.
+func (s *State) bumpConfigEpoch() {
+	s.currentEpoch++
+	s.myself.configEpoch = s.currentEpoch
+}
+
+// Route checks that keys can be served by this node and returns their slot.
+// It returns a redirection when they are served by another node, and an
+// error when they span several slots or their slot is not served. exists
+// reports whether a key is in our keyspace, to redirect the keys of a
+// migrating slot that were already moved; asking is set when the client sent
+// ASKING, allowing it to use an importing slot. A nil exists is for MIGRATE,
+// which always runs locally on a migrating or importing slot.
+func (s *State) Route(keys []string, asking bool, exists func(key string) bool) (int, *Redirect) {
+	if len(keys) == 0 {
+		return -1, nil
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return slot, &Redirect{Code: "CROSSSLOT", Message: "Keys in request don't hash to the same slot"}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if asking && s.importing[slot] != nil {
+		return slot, nil
+	}
+	if !s.ok {
+		return slot, &Redirect{Code: "CLUSTERDOWN", Message: "The cluster is down"}
+	}
+	owner := s.slots[slot]
+	if owner == nil {
+		return slot, &Redirect{Code: "CLUSTERDOWN", Message: "Hash slot not served"}
+	}
+	if exists == nil && (s.migrating[slot] != nil || s.importing[slot] != nil) {
+		return slot, nil
+	}
+	if owner != s.myself {
+		return slot, &Redirect{Code: "MOVED", Message: strconv.Itoa(slot) + " " + owner.Addr()}
+	}
+	if target := s.migrating[slot]; target != nil {
+		missing := 0
+		for _, key := range keys {
+			if !exists(key) {
+				missing++
+			}
+		}
+		if missing == len(keys) {
+			return slot, &Redirect{Code: "ASK", Message: strconv.Itoa(slot) + " " + target.Addr()}
+		}
+		if missing > 0 {
+			return slot, &Redirect{Code: "TRYAGAIN", Message: "Multiple keys request during rehashing of slot"}
+		}
+	}
+	return slot, nil
+}
+
+// Redirect is the error reply sent instead of executing a command whose keys
+// are not served by this node.
+type Redirect struct {
+	Code    string
+	Message string
+}
+
+// AddSlots makes this node serve the slots (CLUSTER ADDSLOTS).
+func (s *State) AddSlots(slots []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkSlots(slots); err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if s.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+	for _, slot := range slots {
+		s.slots[slot] = s.myself
+	}
+	s.dirty = true
+	s.updateState()
+	return nil
+}
+
+// DelSlots leaves the slots unserved (CLUSTER DELSLOTS).
+func (s *State) DelSlots(slots []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkSlots(slots); err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if s.slots[slot] == nil {
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		s.slots[slot] = nil
+	}
+	s.dirty = true
+	s.updateState()
+	return nil
+}
+
+func checkSlots(slots []int) error {
+	seen := make(map[int]bool)
+	for _, slot := range slots {
+		if slot < 0 || slot >= SlotCount {
+			return fmt.Errorf("Invalid or out of range slot")
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	return nil
+}
+
+// Meet starts a handshake with the node whose bus listens on host:busPort
+// (CLUSTER MEET), making it join our cluster.
+func (s *State) Meet(host string, port int, busPort int) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Invalid node address specified: %s:%d", host, port)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startHandshake(ip.String(), port, busPort)
+	return nil
+}
+
+// Forget removes a node from our view of the cluster (CLUSTER FORGET). It is
+// ignored in gossip for a minute so that it can be forgotten by every node.
+func (s *State) Forget(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[id]
+	if !exists {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+	if node == s.myself {
+		return fmt.Errorf("I tried hard but I can't forget myself...")
+	}
+	s.deleteNode(node)
+	s.forgotten[id] = time.Now().Add(forgetTTL)
+	return nil
+}
+
+// deleteNode must be called with s.mu held.
+func (s *State) deleteNode(node *Node) {
+	delete(s.nodes, node.ID)
+	for slot, owner := range s.slots {
+		if owner == node {
+			s.slots[slot] = nil
+		}
+		if s.importing[slot] == node {
+			s.importing[slot] = nil
+		}
+		if s.migrating[slot] == node {
+			s.migrating[slot] = nil
+		}
+	}
+	for _, other := range s.nodes {
+		delete(other.failReports, node.ID)
+	}
+	if node.outbox != nil {
+		close(node.outbox)
+		node.outbox = nil
+	}
+	s.dirty = true
+	s.updateState()
+}
+
+// updateState computes whether the cluster is able to serve requests: every
+// slot must be served by a node that is not failing. It must be called with
+// s.mu held.
+func (s *State) updateState() {
+	s.ok = true
+	for _, owner := range s.slots {
+		if owner == nil || owner.fail {
+			s.ok = false
+			return
+		}
+	}
+}
+
+// Info returns the reply of CLUSTER INFO.
+func (s *State) Info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := "fail"
+	if s.ok {
+		state = "ok"
+	}
+	assigned, ok, pfail, fail := 0, 0, 0, 0
+	for _, owner := range s.slots {
+		switch {
+		case owner == nil:
+			continue
+		case owner.fail:
+			fail++
+		case owner.pfail:
+			pfail++
+		default:
+			ok++
+		}
+		assigned++
+	}
+	return "cluster_enabled:1\r\n" +
+		"cluster_state:" + state + "\r\n" +
+		"cluster_slots_assigned:" + strconv.Itoa(assigned) + "\r\n" +
+		"cluster_slots_ok:" + strconv.Itoa(ok) + "\r\n" +
+		"cluster_slots_pfail:" + strconv.Itoa(pfail) + "\r\n" +
+		"cluster_slots_fail:" + strconv.Itoa(fail) + "\r\n" +
+		"cluster_known_nodes:" + strconv.Itoa(len(s.nodes)) + "\r\n" +
+		"cluster_size:" + strconv.Itoa(s.size()) + "\r\n" +
+		"cluster_current_epoch:" + strconv.FormatInt(s.currentEpoch, 10) + "\r\n" +
+		"cluster_my_epoch:" + strconv.FormatInt(s.myself.configEpoch, 10) + "\r\n" +
+		"cluster_stats_messages_sent:" + strconv.FormatInt(s.messagesSent, 10) + "\r\n" +
+		"cluster_stats_messages_received:" + strconv.FormatInt(s.messagesReceived, 10) + "\r\n"
+}
+
+// size returns the number of nodes serving at least one slot. It must be
+// called with s.mu held.
+func (s *State) size() int {
+	return len(s.serving())
+}
+
+// serving returns the nodes serving at least one slot. It must be called with
+// s.mu held.
+func (s *State) serving() map[*Node]bool {
+	serving := make(map[*Node]bool)
+	for _, owner := range s.slots {
+		if owner != nil {
+			serving[owner] = true
+		}
+	}
+	return serving
+}
+
+// Nodes returns the reply of CLUSTER NODES, which is also the format of the
+// configuration file.
+func (s *State) Nodes() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodesLines(true)
+}
+
+// nodesLines formats the nodes, leaving out the nodes in handshake unless
+// handshake is set. It must be called with s.mu held.
+func (s *State) nodesLines(handshake bool) string {
+	var b strings.Builder
+	for _, node := range s.sortedNodes() {
+		if node.handshake && !handshake {
+			continue
+		}
+		linkState := "disconnected"
+		if node == s.myself || node.linked {
+			linkState = "connected"
+		}
+		b.WriteString(node.ID + " " + node.Host + ":" + strconv.Itoa(node.Port) + "@" + strconv.Itoa(node.BusPort) + " " +
+			s.flags(node) + " - " +
+			millis(node.pingSent) + " " + millis(node.pongReceived) + " " +
+			strconv.FormatInt(node.configEpoch, 10) + " " + linkState)
+		for _, r := range s.slotRanges(node) {
+			if r[0] == r[1] {
+				b.WriteString(" " + strconv.Itoa(r[0]))
+			} else {
+				b.WriteString(" " + strconv.Itoa(r[0]) + "-" + strconv.Itoa(r[1]))
+			}
+		}
+		if node == s.myself {
+			for slot := 0; slot < SlotCount; slot++ {
+				if target := s.migrating[slot]; target != nil {
+					b.WriteString(" [" + strconv.Itoa(slot) + "->-" + target.ID + "]")
+				}
+				if source := s.importing[slot]; source != nil {
+					b.WriteString(" [" + strconv.Itoa(slot) + "-<-" + source.ID + "]")
+				}
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// flags must be called with s.mu held.
+func (s *State) flags(node *Node) string {
+	var flags []string
+	if node == s.myself {
+		flags = append(flags, "myself")
+	}
+	flags = append(flags, "master")
+	if node.fail {
+		flags = append(flags, "fail")
+	} else if node.pfail {
+		flags = append(flags, "fail?")
+	}
+	if node.handshake {
+		flags = append(flags, "handshake")
+	}
+	if node.Host == "" && node != s.myself {
+		flags = append(flags, "noaddr")
+	}
+	return strings.Join(flags, ",")
+}
+
+// SlotRange is a range of consecutive slots served by the same node.
+type SlotRange struct {
+	Start, End int
+	Node       *Node
+}
+
+// Ranges returns the ranges of served slots in order, for CLUSTER SLOTS.
+func (s *State) Ranges() []SlotRange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ranges []SlotRange
+	for slot := 0; slot < SlotCount; slot++ {
+		owner := s.slots[slot]
+		if owner == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Node == owner && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot, Node: owner})
+		}
+	}
+	return ranges
+}
+
+// Shard is a node with the slots it serves, for CLUSTER SHARDS.
+type Shard struct {
+	Node   *Node
+	Ranges [][2]int
+	Health string
+}
+
+func (s *State) Shards() []Shard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var shards []Shard
+	for _, node := range s.sortedNodes() {
+		if node.handshake {
+			continue
+		}
+		health := "online"
+		if node.fail || node.pfail {
+			health = "fail"
+		}
+		shards = append(shards, Shard{Node: node, Ranges: s.slotRanges(node), Health: health})
+	}
+	return shards
+}
+
+// slotRanges must be called with s.mu held.
+func (s *State) slotRanges(node *Node) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < SlotCount; slot++ {
+		if s.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// sortedNodes must be called with s.mu held.
+func (s *State) sortedNodes() []*Node {
+	nodes := make([]*Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// millis formats t as a Unix time in milliseconds, or 0 when it is unset.
+func millis(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
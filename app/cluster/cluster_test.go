@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/crc16"
+)
+
+// hashSlot is the slot of s hashed as a whole.
+func hashSlot(s string) int {
+	return int(crc16.Digest([]byte(s)) % SlotCount)
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"", 0},
+		{"123456789", 0x31C3},
+		{"foo", 12182},
+		{"hello", 866},
+		{"somekey", 11058},
+		// Only the hashtag is hashed.
+		{"{foo}.bar", 12182},
+		{"zap{foo}", 12182},
+		// The first hashtag counts, up to the first closing brace.
+		{"foo{bar}{zap}", hashSlot("bar")},
+		{"foo{{bar}}zap", hashSlot("{bar")},
+		// An empty or unterminated hashtag hashes the whole key.
+		{"foo{}{bar}", hashSlot("foo{}{bar}")},
+		{"{foo", hashSlot("{foo")},
+	}
+	for _, tt := range tests {
+		if got := KeySlot(tt.key); got != tt.want {
+			t.Errorf("KeySlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+	if KeySlot("{user1000}.following") != KeySlot("{user1000}.followers") {
+		t.Errorf("keys with the same hashtag map to different slots")
+	}
+	if KeySlot("foo{}{bar}") == KeySlot("bar") {
+		t.Errorf("an empty hashtag must not select the next one")
+	}
+}
+
+func newTestState(t *testing.T) *State {
+	t.Helper()
+	s, err := New(7000, time.Second, filepath.Join(t.TempDir(), "nodes.conf"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func allSlots() []int {
+	slots := make([]int, SlotCount)
+	for i := range slots {
+		slots[i] = i
+	}
+	return slots
+}
+
+func TestRoute(t *testing.T) {
+	s := newTestState(t)
+	if _, redirect := s.Route([]string{"foo"}, false, nil); redirect == nil || redirect.Code != "CLUSTERDOWN" {
+		t.Errorf("Route without slots = %v, want CLUSTERDOWN", redirect)
+	}
+	if err := s.AddSlots(allSlots()); err != nil {
+		t.Fatalf("AddSlots: %v", err)
+	}
+
+	if slot, redirect := s.Route([]string{"foo", "{foo}.bar"}, false, nil); redirect != nil || slot != 12182 {
+		t.Errorf("Route = %d, %v, want 12182 served locally", slot, redirect)
+	}
+	if _, redirect := s.Route([]string{"foo", "bar"}, false, nil); redirect == nil || redirect.Code != "CROSSSLOT" {
+		t.Errorf("Route across slots = %v, want CROSSSLOT", redirect)
+	}
+
+	other := &Node{ID: NewNodeID(), Host: "10.0.0.2", Port: 7001, BusPort: 17001, created: time.Now()}
+	s.mu.Lock()
+	s.nodes[other.ID] = other
+	s.slots[KeySlot("foo")] = other
+	s.mu.Unlock()
+	redirect := func() *Redirect {
+		_, redirect := s.Route([]string{"foo"}, false, func(string) bool { return false })
+		return redirect
+	}
+	if r := redirect(); r == nil || r.Code != "MOVED" || r.Message != "12182 10.0.0.2:7001" {
+		t.Errorf("Route to another node = %v, want MOVED 12182 10.0.0.2:7001", r)
+	}
+}
+
+func TestFailureQuorum(t *testing.T) {
+	s := newTestState(t)
+	nodes := make([]*Node, 4)
+	for i := range nodes {
+		nodes[i] = &Node{ID: NewNodeID(), Host: "127.0.0.1", Port: 7001 + i, created: time.Now()}
+		s.nodes[nodes[i].ID] = nodes[i]
+	}
+	// Three masters serve slots: us, nodes[0] and the failing nodes[1].
+	// nodes[2] and nodes[3] serve none.
+	s.slots[0] = s.myself
+	s.slots[1] = nodes[0]
+	s.slots[2] = nodes[1]
+	failing := nodes[1]
+	failing.failReports = map[string]time.Time{
+		nodes[2].ID: time.Now(),
+		nodes[3].ID: time.Now(),
+	}
+	if got := s.failureReports(failing); got != 1 {
+		t.Errorf("failureReports = %d, want 1: reports of masters without slots do not count", got)
+	}
+
+	failing.failReports[nodes[0].ID] = time.Now()
+	if got, quorum := s.failureReports(failing), s.size()/2+1; got != 2 || got < quorum {
+		t.Errorf("failureReports = %d with quorum %d, want 2 reaching it", got, quorum)
+	}
+}
+
+func TestConfigSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nodes.conf")
+	s, err := New(7000, time.Second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddSlots([]int{0, 1, 2, 100}); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	err = s.saveConfig()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("saveConfig: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "nodes.conf" {
+		t.Errorf("files after saving: %v, want only nodes.conf", entries)
+	}
+
+	loaded, err := New(7000, time.Second, path)
+	if err != nil {
+		t.Fatalf("New from saved config: %v", err)
+	}
+	if loaded.Myself().ID != s.Myself().ID {
+		t.Errorf("node ID = %s, want %s", loaded.Myself().ID, s.Myself().ID)
+	}
+	for _, slot := range []int{0, 1, 2, 100} {
+		if loaded.Owner(slot) != loaded.Myself() {
+			t.Errorf("slot %d not served after loading", slot)
+		}
+	}
+	if loaded.Owner(3) != nil {
+		t.Errorf("slot 3 served after loading")
+	}
+}
+
+func TestRouteMigrating(t *testing.T) {
+	s := newTestState(t)
+	if err := s.AddSlots(allSlots()); err != nil {
+		t.Fatalf("AddSlots: %v", err)
+	}
+	other := &Node{ID: NewNodeID(), Host: "10.0.0.2", Port: 7001, BusPort: 17001, created: time.Now()}
+	slot := KeySlot("foo")
+	s.mu.Lock()
+	s.nodes[other.ID] = other
+	s.migrating[slot] = other
+	s.mu.Unlock()
+
+	// A key of a slot migrating away is served while it is still here, and
+	// asked to the target once it is gone.
+	if _, redirect := s.Route([]string{"foo"}, false, func(string) bool { return true }); redirect != nil {
+		t.Errorf("Route of a key not migrated yet = %v, want it served", redirect)
+	}
+	_, redirect := s.Route([]string{"foo"}, false, func(string) bool { return false })
+	if redirect == nil || redirect.Code != "ASK" || redirect.Message != "12182 10.0.0.2:7001" {
+		t.Errorf("Route of a migrated key = %v, want ASK 12182 10.0.0.2:7001", redirect)
+	}
+	_, redirect = s.Route([]string{"foo", "{foo}.bar"}, false, func(key string) bool { return key == "foo" })
+	if redirect == nil || redirect.Code != "TRYAGAIN" {
+		t.Errorf("Route of partly migrated keys = %v, want TRYAGAIN", redirect)
+	}
+
+	// On the target, a slot being imported is only served after ASKING.
+	s.mu.Lock()
+	s.migrating[slot] = nil
+	s.slots[slot] = other
+	s.importing[slot] = other
+	s.mu.Unlock()
+	exists := func(string) bool { return true }
+	if _, redirect := s.Route([]string{"foo"}, false, exists); redirect == nil || redirect.Code != "MOVED" {
+		t.Errorf("Route of an importing slot without ASKING = %v, want MOVED", redirect)
+	}
+	if _, redirect := s.Route([]string{"foo"}, true, exists); redirect != nil {
+		t.Errorf("Route of an importing slot after ASKING = %v, want it served", redirect)
+	}
+}
+
+func TestAcceptStopsOnClose(t *testing.T) {
+	s := newTestState(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.accept(l)
+		close(done)
+	}()
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("accept kept running after the listener was closed")
+	}
+}
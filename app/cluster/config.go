@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// saveConfig writes the cluster configuration in the CLUSTER NODES format,
+// followed by the epochs, replacing the previous file atomically. It must be
+// called with s.mu held.
+func (s *State) saveConfig() error {
+	content := s.nodesLines(false) +
+		"vars currentEpoch " + strconv.FormatInt(s.currentEpoch, 10) + " lastVoteEpoch 0\n"
+
+	dir := filepath.Dir(s.configPath)
+	temp, err := os.CreateTemp(dir, fmt.Sprintf("temp-%d-*-%s", os.Getpid(), filepath.Base(s.configPath)))
+	if err != nil {
+		return err
+	}
+	_, err = temp.WriteString(content)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.configPath)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	// Make the rename itself durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadConfig restores the cluster configuration saved by saveConfig, if any.
+func (s *State) loadConfig() error {
+	data, err := os.ReadFile(s.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	corrupted := fmt.Errorf("unrecoverable error: corrupted cluster config file %q", s.configPath)
+	nodes := make(map[string]*Node)
+	var myself *Node
+	// Migrating and importing slots refer to nodes that may be listed later.
+	var migrations []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					if s.currentEpoch, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+						return corrupted
+					}
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return corrupted
+		}
+
+		addr, bus, found := strings.Cut(fields[1], "@")
+		if !found {
+			return corrupted
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return corrupted
+		}
+		node := &Node{ID: fields[0], Host: host, created: time.Now()}
+		if node.Port, err = strconv.Atoi(port); err != nil {
+			return corrupted
+		}
+		if node.BusPort, err = strconv.Atoi(bus); err != nil {
+			return corrupted
+		}
+		if node.configEpoch, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+			return corrupted
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "myself":
+				myself = node
+			case "fail":
+				node.fail = true
+			}
+		}
+		nodes[node.ID] = node
+
+		for _, slots := range fields[8:] {
+			if strings.HasPrefix(slots, "[") {
+				migrations = append(migrations, slots)
+				continue
+			}
+			startSlot, endSlot, isRange := strings.Cut(slots, "-")
+			start, err := strconv.Atoi(startSlot)
+			if err != nil {
+				return corrupted
+			}
+			end := start
+			if isRange {
+				if end, err = strconv.Atoi(endSlot); err != nil {
+					return corrupted
+				}
+			}
+			if start < 0 || end >= SlotCount || start > end {
+				return corrupted
+			}
+			for slot := start; slot <= end; slot++ {
+				s.slots[slot] = node
+			}
+		}
+	}
+	if myself == nil {
+		return corrupted
+	}
+	for _, migration := range migrations {
+		slotField, id, found := strings.Cut(strings.Trim(migration, "[]"), "-")
+		slot, err := strconv.Atoi(slotField)
+		if !found || err != nil || slot < 0 || slot >= SlotCount || len(id) < 2 {
+			return corrupted
+		}
+		node, exists := nodes[id[2:]]
+		if !exists {
+			return corrupted
+		}
+		switch id[:2] {
+		case ">-":
+			s.migrating[slot] = node
+		case "<-":
+			s.importing[slot] = node
+		default:
+			return corrupted
+		}
+	}
+	s.myself = myself
+	s.nodes = nodes
+	return nil
+}
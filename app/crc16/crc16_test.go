@@ -0,0 +1,19 @@
+package crc16
+
+import "testing"
+
+func TestDigest(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint16
+	}{
+		{"", 0x0000},
+		{"123456789", 0x31C3},
+		{"A", 0x58E5},
+	}
+	for _, tt := range tests {
+		if got := Digest([]byte(tt.input)); got != tt.want {
+			t.Errorf("Digest(%q) = %#04x, want %#04x", tt.input, got, tt.want)
+		}
+	}
+}
@@ -1,28 +1,55 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+	"github.com/codecrafters-io/redis-starter-go/app/cluster"
 	"github.com/codecrafters-io/redis-starter-go/app/methods"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
 	"github.com/codecrafters-io/redis-starter-go/app/rdb"
 	"github.com/codecrafters-io/redis-starter-go/app/replication"
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/sentinel"
+	"github.com/codecrafters-io/redis-starter-go/app/tracking"
 )
 
 var (
-	mu         sync.Mutex
-	Databases        = make(map[uint8]resp.Database)
-	DatabaseID uint8 = 0
-	Config           = make(map[string]string)
+	mu sync.Mutex
+	// writeMu serializes write commands with their propagation, so replicas
+	// receive them in the order they were applied.
+	writeMu sync.Mutex
+	// replicaReadOnly rejects write commands from normal clients on replicas.
+	replicaReadOnly atomic.Bool
+	// replDisklessSync streams snapshots straight into the connections of
+	// replicas supporting it instead of saving them to disk first.
+	replDisklessSync atomic.Bool
+	Databases              = make(map[uint8]resp.Database)
+	DatabaseID       uint8 = 0
+	Config                 = make(map[string]string)
+	Tracking               = tracking.NewTable()
+	Replication            = replication.New()
+	Persistence            = persistence.New(snapshot, aofRewrite, &writeMu)
+	// Cluster is nil unless cluster mode is enabled.
+	Cluster *cluster.State
+	// loadingAOF is set while the append only file is replayed, whose
+	// commands are neither propagated nor counted as changes.
+	loadingAOF atomic.Bool
 )
 
 func main() {
@@ -30,8 +57,38 @@ func main() {
 	dbfilename_flag := flag.String("dbfilename", "", "File to store data")
 	port_flag := flag.String("port", "6379", "Port to listen on")
 	replicaof_flag := flag.String("replicaof", "", "Replica of")
+	repl_backlog_size_flag := flag.String("repl-backlog-size", "1mb", "Size of the replication backlog")
+	replica_read_only_flag := flag.String("replica-read-only", "yes", "Reject writes from clients on replicas")
+	repl_diskless_sync_flag := flag.String("repl-diskless-sync", "yes", "Send snapshots to replicas without saving them to disk")
+	repl_diskless_load_flag := flag.String("repl-diskless-load", "disabled", "Load snapshots from the master without saving them to disk: disabled, on-empty-db or swapdb")
+	save_flag := flag.String("save", "3600 1 300 100 60 10000", "Save the DB after <seconds> and at least <changes> writes, as pairs of values")
+	rdbcompression_flag := flag.String("rdbcompression", "yes", "Compress strings with LZF in RDB files")
+	appendonly_flag := flag.String("appendonly", "no", "Log every write command to the append only file")
+	appendfilename_flag := flag.String("appendfilename", "appendonly.aof", "Base name of the append only files")
+	appenddirname_flag := flag.String("appenddirname", "appendonlydir", "Directory of the append only files, in dir")
+	appendfsync_flag := flag.String("appendfsync", "everysec", "When to fsync the append only file: always, everysec or no")
+	aof_load_truncated_flag := flag.String("aof-load-truncated", "yes", "Load an append only file whose last command is truncated")
+	aof_use_rdb_preamble_flag := flag.String("aof-use-rdb-preamble", "yes", "Write the base append only file in RDB format")
+	auto_aof_rewrite_percentage_flag := flag.String("auto-aof-rewrite-percentage", "100", "Rewrite the append only file once it grew by this percentage since the last rewrite, 0 to disable")
+	auto_aof_rewrite_min_size_flag := flag.String("auto-aof-rewrite-min-size", "64mb", "Minimum size of the append only file to rewrite it automatically")
+	cluster_enabled_flag := flag.String("cluster-enabled", "no", "Run in cluster mode")
+	cluster_config_file_flag := flag.String("cluster-config-file", "nodes.conf", "File where the cluster configuration is saved")
+	cluster_node_timeout_flag := flag.Int("cluster-node-timeout", 15000, "Time in milliseconds without a reply after which a cluster node is failing")
+	sentinel_flag := flag.Bool("sentinel", false, "Run in sentinel mode")
+	sentinel_monitor_flag := flag.String("sentinel-monitor", "", "Master to monitor in sentinel mode: <name> <host> <port> <quorum>")
+	sentinel_down_after_flag := flag.Int("sentinel-down-after-milliseconds", 30000, "Time without a valid reply after which an instance is down")
+	sentinel_failover_timeout_flag := flag.Int("sentinel-failover-timeout", 180000, "Failover timeout in milliseconds")
 	flag.Parse()
 
+	if *sentinel_flag {
+		port := *port_flag
+		if !isFlagSet("port") {
+			port = "26379"
+		}
+		runSentinel(port, *sentinel_monitor_flag, time.Duration(*sentinel_down_after_flag)*time.Millisecond, time.Duration(*sentinel_failover_timeout_flag)*time.Millisecond)
+		return
+	}
+
 	if *dir_flag != "" {
 		Config["dir"] = *dir_flag
 	}
@@ -39,38 +96,73 @@ func main() {
 		Config["dbfilename"] = *dbfilename_flag
 	}
 
-	metadata, databases, err := rdb.Open(Config["dir"], Config["dbfilename"])
+	_, databases, err := rdb.Open(Config["dir"], Config["dbfilename"])
 	if err != nil {
 		fmt.Println("Failed to open database: ", err.Error())
 		Databases[DatabaseID] = resp.NewDatabase(DatabaseID)
 	} else {
-		Config = metadata
 		Databases = databases
+		if _, exists := Databases[DatabaseID]; !exists {
+			Databases[DatabaseID] = resp.NewDatabase(DatabaseID)
+		}
 		// fmt.Printf("Database opened: %s\n", Databases)
 	}
 
-	if *replicaof_flag != "" {
-		Config["role"] = "slave"
-		Config["master_host"] = strings.Split(*replicaof_flag, " ")[0]
-		Config["master_port"] = strings.Split(*replicaof_flag, " ")[1]
-		Config["connected_slaves"] = "1"
-		Config["master_replid"] = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
-		Config["master_repl_offset"] = "0"
-		conn, err := net.Dial("tcp", Config["master_host"]+":"+Config["master_port"])
+	Config["repl-backlog-size"] = *repl_backlog_size_flag
+	Config["replica-read-only"] = *replica_read_only_flag
+	Config["repl-diskless-sync"] = *repl_diskless_sync_flag
+	Config["repl-diskless-load"] = *repl_diskless_load_flag
+	Config["save"] = *save_flag
+	Config["rdbcompression"] = *rdbcompression_flag
+	Config["appendonly"] = *appendonly_flag
+	Config["appendfilename"] = *appendfilename_flag
+	Config["appenddirname"] = *appenddirname_flag
+	Config["appendfsync"] = *appendfsync_flag
+	Config["aof-load-truncated"] = *aof_load_truncated_flag
+	Config["aof-use-rdb-preamble"] = *aof_use_rdb_preamble_flag
+	Config["auto-aof-rewrite-percentage"] = *auto_aof_rewrite_percentage_flag
+	Config["auto-aof-rewrite-min-size"] = *auto_aof_rewrite_min_size_flag
+	if err := applyConfig(); err != nil {
+		fmt.Println("Invalid configuration: ", err.Error())
+		os.Exit(1)
+	}
+	loadAppendOnlyFile()
+
+	clusterEnabled, err := parseBool(*cluster_enabled_flag)
+	if err != nil {
+		fmt.Println("Invalid cluster-enabled: ", err.Error())
+		os.Exit(1)
+	}
+	if clusterEnabled {
+		port, err := strconv.Atoi(*port_flag)
+		if err != nil {
+			fmt.Println("Invalid port: ", *port_flag)
+			os.Exit(1)
+		}
+		configPath := filepath.Join(Config["dir"], *cluster_config_file_flag)
+		Cluster, err = cluster.New(port, time.Duration(*cluster_node_timeout_flag)*time.Millisecond, configPath)
 		if err != nil {
-			fmt.Println("Failed to connect to master: ", err.Error())
+			fmt.Println("Failed to load cluster configuration: ", err.Error())
+			os.Exit(1)
+		}
+		if err := Cluster.Start(); err != nil {
+			fmt.Println("Failed to bind to cluster bus port ", port+cluster.BusPortOffset)
 			os.Exit(1)
 		}
-		defer conn.Close()
+	}
 
-		replication.SendHandshake(conn, &Config)
-	} else {
-		Config["role"] = "master"
-		Config["master_host"] = "localhost"
-		Config["master_port"] = *port_flag
-		Config["connected_slaves"] = "0"
-		Config["master_replid"] = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
-		Config["master_repl_offset"] = "0"
+	Replication.Configure(*port_flag, replication.Handler{
+		Load:  loadSnapshot,
+		Apply: execute,
+		Lock:  &writeMu,
+	})
+	if *replicaof_flag != "" {
+		masterAddr := strings.Fields(*replicaof_flag)
+		if len(masterAddr) != 2 {
+			fmt.Println("Invalid replicaof address: ", *replicaof_flag)
+			os.Exit(1)
+		}
+		Replication.ReplicaOf(masterAddr[0], masterAddr[1])
 	}
 	l, err := net.Listen("tcp", "0.0.0.0:"+*port_flag)
 	if err != nil {
@@ -81,14 +173,25 @@ func main() {
 	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM, os.Kill)
 
 	go startExpiryChecker(stopCh)
+	go Persistence.Cron()
 
 	fmt.Println("Server started on port ", *port_flag)
 
 	// Start a goroutine to handle server shutdown
 	go func() {
-		<-stopCh
-		fmt.Println("\nShutting down server...")
-		os.Exit(0)
+		for range stopCh {
+			fmt.Println("\nShutting down server...")
+			if Persistence.HasSavePoints() {
+				fmt.Println("Saving the final RDB snapshot before exiting.")
+				if err := Persistence.SaveOnShutdown(); err != nil {
+					fmt.Println("Error trying to save the DB, can't exit.")
+					continue
+				}
+			}
+			// Closing the AOF syncs the last writes to disk.
+			Persistence.DisableAOF()
+			os.Exit(0)
+		}
 	}()
 
 	// Main server loop
@@ -108,101 +211,892 @@ func main() {
 	}
 }
 
+// runSentinel runs the server in sentinel mode, monitoring the master given
+// as "<name> <host> <port> <quorum>".
+func runSentinel(port string, monitor string, downAfter time.Duration, failoverTimeout time.Duration) {
+	s := sentinel.New(port)
+	if monitor != "" {
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			fmt.Println("Invalid sentinel-monitor: ", monitor)
+			os.Exit(1)
+		}
+		quorum, err := strconv.Atoi(fields[3])
+		if err != nil {
+			fmt.Println("Invalid sentinel-monitor quorum: ", fields[3])
+			os.Exit(1)
+		}
+		if err := s.Monitor(fields[0], fields[1], fields[2], quorum, downAfter, failoverTimeout); err != nil {
+			fmt.Println("Invalid sentinel-monitor: ", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	l, err := net.Listen("tcp", "0.0.0.0:"+port)
+	if err != nil {
+		fmt.Println("Failed to bind to port ", port)
+		os.Exit(1)
+	}
+	fmt.Println("Sentinel started on port ", port)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection: ", err.Error())
+			continue
+		}
+		go s.Handle(conn)
+	}
+}
+
+// isFlagSet reports whether the flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func handle(conn net.Conn) {
 	defer conn.Close()
 	fmt.Println("Client connected: ", conn.RemoteAddr().String())
 
-	buf := make([]byte, 1024)
+	c := client.New(conn)
+	defer func() {
+		Tracking.Disable(c.ID)
+		Replication.RemoveReplica(c)
+		client.Remove(c.ID)
+	}()
+
+	reader := resp.NewReader(conn)
 	for {
-		n, err := conn.Read(buf)
+		commands, _, err := reader.ReadValue()
 		if err != nil {
 			if err != io.EOF {
 				fmt.Println("Error reading from connection:", err.Error())
+				c.Write(resp.ToError("Protocol error: " + err.Error()))
 			}
 			break
 		}
-		// fmt.Printf("Command: %q\n", string(buf[:n]))
-		commands, rest, err := resp.Parse(buf[:n])
-		if err != nil {
-			conn.Write(resp.ToError("parsing RESP: " + err.Error()))
-			break
+		execute(c, commands)
+	}
+}
+
+// execute runs a single command and writes its reply to the client.
+func execute(c *client.Client, commands resp.Value) {
+	if commands.Type != resp.RESPTypeArray {
+		c.Write(resp.ToError("wrong command structure"))
+		return
+	}
+
+	if len(commands.Array) == 0 {
+		c.Write(resp.ToError("no elements in command"))
+		return
+	}
+
+	command := commands.Array[0]
+
+	if command.Type != resp.RESPTypeSimpleString && command.Type != resp.RESPTypeBulkString {
+		c.Write(resp.ToError("wrong command type"))
+		return
+	}
+
+	name := strings.ToUpper(command.String)
+	cmd, exists := methods.LookupCommand(name)
+	if !exists {
+		c.Write(resp.ToError("unknown command"))
+		return
+	}
+	if !cmd.CheckArity(commands) {
+		c.Write(resp.ToError("wrong number of arguments for '" + cmd.Name + "' command"))
+		return
+	}
+
+	if c.Protocol() < 3 && len(c.Subscriptions()) > 0 && cmd.Flags&methods.FlagPubSub == 0 && name != "QUIT" && name != "RESET" {
+		c.Write(resp.ToError("Can't execute '" + cmd.Name + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"))
+		return
+	}
+
+	// In cluster mode, commands are only served for keys in our slots. The
+	// master link is exempt as it applies whatever the master served.
+	asking := c.Flags&client.FlagAsking != 0 || name == "RESTORE-ASKING"
+	if name != "ASKING" {
+		c.Flags &^= client.FlagAsking
+	}
+	if Cluster != nil && c.Flags&client.FlagMaster == 0 {
+		exists := keyExists
+		if name == "MIGRATE" {
+			exists = nil
+		}
+		if _, redirect := Cluster.Route(cmd.Keys(commands), asking, exists); redirect != nil {
+			c.Write(resp.ToErrorWithCode(redirect.Code, redirect.Message))
+			return
 		}
+	}
 
-		if len(rest) > 0 {
-			conn.Write(resp.ToError("rest data: " + string(rest)))
-			continue
+	write := cmd.Flags&methods.FlagWrite != 0
+	// Commands from our master are applied with writeMu already held by the
+	// replication link.
+	locked := write && c.Flags&client.FlagMaster == 0
+	if locked {
+		if Replication.Role() == "slave" && replicaReadOnly.Load() {
+			c.Write(resp.ToErrorWithCode("READONLY", "You can't write against a read only replica."))
+			return
 		}
-		if commands.Type != resp.RESPTypeArray {
-			conn.Write(resp.ToError("wrong command structure"))
-			continue
+		writeMu.Lock()
+		// A FAILOVER holds writeMu while demoting us, so the role is checked
+		// again once writes are allowed.
+		if Replication.Role() == "slave" && replicaReadOnly.Load() {
+			writeMu.Unlock()
+			c.Write(resp.ToErrorWithCode("READONLY", "You can't write against a read only replica."))
+			return
 		}
+	}
 
-		if len(commands.Array) == 0 {
-			conn.Write(resp.ToError("no elements in command"))
-			continue
+	keys := cmd.Keys(commands)
+	expireKeys(c, keys, locked)
+
+	mu.Lock()
+	db := Databases[DatabaseID]
+	mu.Unlock()
+
+	var reply []byte
+	// changes counts the keys the command changed: it is propagated only
+	// when there are some.
+	changes := 0
+	switch name {
+	case "PING":
+		reply = resp.ToSimpleString("PONG")
+	case "INFO":
+		reply = methods.Info(commands, Replication, Persistence)
+	case "ECHO":
+		reply = methods.Echo(commands)
+	case "SET":
+		reply, changes = methods.Set(commands, &mu, &db)
+	case "GET":
+		reply = methods.Get(commands, &mu, &db)
+	case "KEYS":
+		reply = methods.Keys(commands, &mu, &db)
+	case "TYPE":
+		reply = methods.Type(commands, &mu, &db)
+	case "CONFIG":
+		reply = configCommand(commands)
+	case "SAVE":
+		if err := Persistence.Save(); err != nil {
+			reply = resp.ToError("Failed to save database: " + err.Error())
+		} else {
+			reply = resp.ToSimpleString("OK")
+		}
+	case "BGSAVE":
+		reply = methods.BgSave(commands, Persistence)
+	case "BGREWRITEAOF":
+		reply = methods.BgRewriteAOF(Persistence)
+	case "LASTSAVE":
+		reply = resp.ToInteger(int(Persistence.LastSave().Unix()))
+	case "REPLCONF":
+		reply = methods.ReplConf(commands, c, Replication)
+	case "PSYNC":
+		psync(c, commands)
+	case "REPLICAOF", "SLAVEOF":
+		reply = methods.ReplicaOf(commands, Replication)
+	case "FAILOVER":
+		reply = methods.Failover(commands, Replication)
+	case "ROLE":
+		reply = methods.Role(commands, Replication)
+	case "WAIT":
+		reply = methods.Wait(commands, c, Replication)
+	case "HELLO":
+		reply = methods.Hello(commands, c, Replication)
+	case "CLIENT":
+		reply = methods.HandleClient(commands, c, Tracking)
+	case "SUBSCRIBE":
+		reply = methods.Subscribe(commands, c)
+	case "UNSUBSCRIBE":
+		reply = methods.Unsubscribe(commands, c)
+	case "PUBLISH":
+		reply = methods.Publish(commands)
+	case "CLUSTER":
+		reply = methods.HandleCluster(commands, Cluster, &mu, &db)
+	case "ASKING":
+		if Cluster == nil {
+			reply = resp.ToError("This instance has cluster support disabled")
+		} else {
+			c.Flags |= client.FlagAsking
+			reply = resp.ToSimpleString("OK")
+		}
+	case "DEL":
+		reply, changes = methods.Del(commands, &mu, &db)
+	case "DUMP":
+		reply = methods.Dump(commands, &mu, &db)
+	case "RESTORE", "RESTORE-ASKING":
+		reply, changes = methods.Restore(commands, &mu, &db)
+	case "MIGRATE":
+		// writeMu is released while the keys are sent, so that a MIGRATE to
+		// this instance can restore them. Replicas delete the migrated keys
+		// instead of migrating them again, even when MIGRATE failed for some
+		// of the others.
+		if locked {
+			writeMu.Unlock()
+		}
+		var moved []string
+		reply, moved = methods.Migrate(commands, &mu, &db, Cluster != nil)
+		if locked {
+			writeMu.Lock()
+		}
+		if len(moved) > 0 {
+			del := delCommand(moved)
+			methods.Del(del, &mu, &db)
+			propagateDel(c, del, moved)
+		}
+	}
+
+	if len(reply) > 0 && reply[0] != byte(resp.RESPTypeError) {
+		if write {
+			if changes > 0 && !loadingAOF.Load() {
+				propagate(c, propagated(name, commands))
+				Tracking.Invalidate(c.ID, keys...)
+				Persistence.Dirty(int64(changes))
+			}
+		} else if cmd.Flags&methods.FlagReadOnly != 0 && len(keys) > 0 {
+			Tracking.Remember(c.ID, keys...)
 		}
+	}
+	if locked {
+		writeMu.Unlock()
+	}
+	c.Write(reply)
+	Tracking.AfterCommand(c.ID)
+}
 
-		command := commands.Array[0]
+// keyExists reports whether key is in the current database, for the
+// redirection of keys already moved away from a migrating slot.
+func keyExists(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	val, exists := Databases[DatabaseID].Store[key]
+	return exists && (val.ExpireAt.IsZero() || val.ExpireAt.After(time.Now()))
+}
 
-		if command.Type != resp.RESPTypeSimpleString && command.Type != resp.RESPTypeBulkString {
-			conn.Write(resp.ToError("wrong command type"))
-			continue
+// expireKeys deletes the keys of a command that expired before it runs,
+// like the active expiry does, so that replicas and the AOF get a DEL for
+// them. Replicas leave that to their master, the command finding the keys
+// missing all the same. writeMu must be held when locked is set.
+func expireKeys(c *client.Client, keys []string, locked bool) {
+	if len(keys) == 0 || loadingAOF.Load() || c.Flags&client.FlagMaster != 0 || Replication.Role() == "slave" {
+		return
+	}
+	expired := func() []string {
+		var expired []string
+		now := time.Now()
+		for _, key := range keys {
+			if val, exists := Databases[DatabaseID].Store[key]; exists && !val.ExpireAt.IsZero() && !val.ExpireAt.After(now) {
+				expired = append(expired, key)
+			}
 		}
+		return expired
+	}
+	mu.Lock()
+	found := len(expired()) > 0
+	mu.Unlock()
+	if !found {
+		return
+	}
 
-		db := Databases[DatabaseID]
-
-		// fmt.Printf("Command: ")
-		// for _, value := range commands.Array {
-		// 	fmt.Printf("%q ", value.String)
-		// }
-		// fmt.Println()
-		switch strings.ToUpper(command.String) {
-		case "PING":
-			conn.Write(resp.ToSimpleString("PONG"))
-		case "INFO":
-			conn.Write(methods.Info(commands, Config))
-		case "ECHO":
-			conn.Write(methods.Echo(commands))
-		case "SET":
-			conn.Write(methods.Set(commands, &mu, &db))
-		case "GET":
-			conn.Write(methods.Get(commands, &mu, &db))
-		case "KEYS":
-			conn.Write(methods.Keys(commands, &mu, &db))
-		case "CONFIG":
-			conn.Write(methods.HandleConfig(commands, &mu, Config))
-		case "SAVE":
-			{
-				err = rdb.Save(Config["dir"], Config["dbfilename"], Config, Databases)
-				if err != nil {
-					conn.Write(resp.ToError("Failed to save database: " + err.Error()))
-				}
-				conn.Write(resp.ToSimpleString("OK"))
+	if !locked {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+	}
+	mu.Lock()
+	db := Databases[DatabaseID]
+	keys = expired()
+	for _, key := range keys {
+		delete(db.ExpiryMap, db.Store[key].ExpireAt)
+		delete(db.Store, key)
+	}
+	mu.Unlock()
+	if len(keys) > 0 {
+		propagateDel(c, delCommand(keys), keys)
+	}
+}
+
+// delCommand returns the DEL command of keys.
+func delCommand(keys []string) resp.Value {
+	del := resp.Value{Type: resp.RESPTypeArray, Array: []resp.Value{resp.NewBulkString("DEL")}}
+	for _, key := range keys {
+		del.Array = append(del.Array, resp.NewBulkString(key))
+	}
+	return del
+}
+
+// propagateDel propagates the deletion of keys, which del deleted or which
+// were removed as del would. It must be called with writeMu held.
+func propagateDel(c *client.Client, del resp.Value, keys []string) {
+	propagate(c, del)
+	Tracking.Invalidate(c.ID, keys...)
+	Persistence.Dirty(int64(len(keys)))
+}
+
+// propagated returns the form of a write command that was just applied to
+// send to the replicas and the AOF, so that they end up with the same key
+// and expiry time however late they apply it. SET becomes a plain SET with
+// PXAT when the key expires, and RESTORE gets ABSTTL; either becomes a DEL
+// when its expiry time had already passed. It must be called with writeMu
+// held.
+func propagated(name string, commands resp.Value) resp.Value {
+	args := commands.Array
+	switch name {
+	case "SET", "RESTORE", "RESTORE-ASKING":
+	default:
+		return commands
+	}
+
+	key := args[1].String
+	mu.Lock()
+	val, exists := Databases[DatabaseID].Store[key]
+	mu.Unlock()
+	if !exists {
+		return delCommand([]string{key})
+	}
+	ttl := strconv.FormatInt(val.ExpireAt.UnixMilli(), 10)
+	if name == "SET" {
+		rewritten := []resp.Value{args[0], args[1], args[2]}
+		if !val.ExpireAt.IsZero() {
+			rewritten = append(rewritten, resp.NewBulkString("PXAT"), resp.NewBulkString(ttl))
+		}
+		return resp.Value{Type: resp.RESPTypeArray, Array: rewritten}
+	}
+	if val.ExpireAt.IsZero() {
+		return commands
+	}
+	rewritten := append([]resp.Value{}, args...)
+	rewritten[2] = resp.NewBulkString(ttl)
+	for _, arg := range args[4:] {
+		if strings.ToUpper(arg.String) == "ABSTTL" {
+			return resp.Value{Type: resp.RESPTypeArray, Array: rewritten}
+		}
+	}
+	rewritten = append(rewritten, resp.NewBulkString("ABSTTL"))
+	return resp.Value{Type: resp.RESPTypeArray, Array: rewritten}
+}
+
+// propagate sends a write command that was just applied to the replicas and
+// the AOF. It must be called with writeMu held.
+func propagate(c *client.Client, commands resp.Value) {
+	data, err := resp.ParseValue(commands)
+	if err != nil {
+		fmt.Println("Error encoding command for propagation: ", err.Error())
+		return
+	}
+	Persistence.Append(data)
+	c.WriteOffset = Replication.Propagate(data)
+}
+
+// loadAppendOnlyFile rebuilds the keyspace from the AOF when appendonly is
+// enabled, replaying its commands like the ones received from a master. When
+// there is no AOF yet, the keyspace loaded from the RDB file is kept and
+// written to a new one.
+func loadAppendOnlyFile() {
+	mu.Lock()
+	enabled, _ := parseBool(Config["appendonly"])
+	loadTruncated, _ := parseBool(Config["aof-load-truncated"])
+	dir, dirname, filename := Config["dir"], Config["appenddirname"], Config["appendfilename"]
+	mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	log, err := aof.OpenLog(dir, dirname, filename, "no")
+	if err != nil {
+		fmt.Println("Failed to open the append only file: ", err.Error())
+		os.Exit(1)
+	}
+	loaded := Databases
+	mu.Lock()
+	Databases = map[uint8]resp.Database{DatabaseID: resp.NewDatabase(DatabaseID)}
+	mu.Unlock()
+
+	c := client.New(nil)
+	c.Flags |= client.FlagMaster
+	loadingAOF.Store(true)
+	found, err := log.Load(loadTruncated, loadAOFBase, func(command resp.Value) error {
+		execute(c, command)
+		if reply := c.DroppedError(); reply != "" {
+			return errors.New(reply)
+		}
+		return nil
+	})
+	loadingAOF.Store(false)
+	client.Remove(c.ID)
+
+	if err != nil {
+		fmt.Println("Failed to load the append only file: ", err.Error())
+		os.Exit(1)
+	}
+	if found {
+		fmt.Println("DB loaded from append only file: ", filepath.Join(dir, dirname))
+	} else {
+		mu.Lock()
+		Databases = loaded
+		mu.Unlock()
+	}
+	if err := updateAppendOnly(!found); err != nil {
+		fmt.Println("Failed to open the append only file: ", err.Error())
+		os.Exit(1)
+	}
+}
+
+// loadAOFBase loads a base file of the AOF in RDB format.
+func loadAOFBase(r io.Reader) error {
+	_, databases, err := rdb.Read(r)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	Databases = databases
+	if _, exists := Databases[DatabaseID]; !exists {
+		Databases[DatabaseID] = resp.NewDatabase(DatabaseID)
+	}
+	return nil
+}
+
+// updateAppendOnly opens or closes the AOF following appendonly. A newly
+// opened AOF is first rewritten with the current keyspace when rewrite is
+// set, i.e. unless it was just loaded.
+func updateAppendOnly(rewrite bool) error {
+	mu.Lock()
+	enabled, _ := parseBool(Config["appendonly"])
+	mu.Unlock()
+
+	if !enabled {
+		Persistence.DisableAOF()
+		return nil
+	}
+	return Persistence.EnableAOF(rewrite)
+}
+
+// aofRewrite captures the keyspace for the base file of the AOF: an RDB file
+// with rdbPreamble, otherwise a RESTORE of the DUMP payload of every key with
+// its absolute expiry.
+func aofRewrite(rdbPreamble bool) func() ([]byte, error) {
+	mu.Lock()
+	databases := copyDatabases()
+	metadata := snapshotMetadata()
+	mu.Unlock()
+
+	if rdbPreamble {
+		metadata["aof-base"] = "1"
+		return func() ([]byte, error) {
+			return rdb.Encode(metadata, databases)
+		}
+	}
+	return func() ([]byte, error) {
+		var data []byte
+		now := time.Now()
+		for key, val := range databases[DatabaseID].Store {
+			if !val.ExpireAt.IsZero() && !val.ExpireAt.After(now) {
+				continue
+			}
+			payload, err := rdb.DumpValue(val)
+			if err != nil {
+				return nil, err
 			}
-		default:
-			conn.Write(resp.ToError("unknown command"))
+			expireAt := int64(0)
+			if !val.ExpireAt.IsZero() {
+				expireAt = val.ExpireAt.UnixMilli()
+			}
+			data = append(data, resp.ToArray([]any{"RESTORE", key, strconv.FormatInt(expireAt, 10), string(payload), "REPLACE", "ABSTTL"})...)
+		}
+		return data, nil
+	}
+}
+
+// psync performs a full resynchronization of a replica: it replies with
+// FULLRESYNC, then transfers a snapshot of the keyspace followed by the write
+// commands that happened in the meantime.
+func psync(c *client.Client, commands resp.Value) {
+	if len(commands.Array) > 4 {
+		c.Write(resp.ToError("wrong number of arguments for 'psync' command"))
+		return
+	}
+	if len(commands.Array) == 4 {
+		// Our master hands over its role to us (FAILOVER).
+		if strings.ToUpper(commands.Array[3].String) != "FAILOVER" {
+			c.Write(resp.ToError("syntax error"))
+			return
 		}
+		if err := Replication.TakeOver(commands.Array[1].String); err != nil {
+			c.Write(resp.ToError(err.Error()))
+			return
+		}
+	}
+
+	writeMu.Lock()
+	if offset, err := strconv.ParseInt(commands.Array[2].String, 10, 64); err == nil && Replication.ContinuePartial(c, commands.Array[1].String, offset) {
+		writeMu.Unlock()
+		return
+	}
+	mu.Lock()
+	databases := copyDatabases()
+	dir, dbfilename := Config["dir"], Config["dbfilename"]
+	mu.Unlock()
+	reply, err := Replication.StartFullResync(c)
+	writeMu.Unlock()
+	if err != nil {
+		c.Write(resp.ToErrorWithCode("NOMASTERLINK", err.Error()))
+		return
+	}
+	c.Write(reply)
+
+	metadata := map[string]string{"redis-ver": "7.2.0", "redis-bits": "64"}
+	if replDisklessSync.Load() && Replication.SupportsEOF(c) {
+		err = Replication.StreamSnapshot(c, func(w io.Writer) error {
+			return rdb.Write(w, metadata, databases)
+		})
+	} else {
+		err = sendSnapshotFile(c, dir, dbfilename, metadata, databases)
+	}
+	if err == nil {
+		err = Replication.FinishFullResync(c)
+	}
+	if err != nil {
+		fmt.Println("Error sending snapshot to replica: ", err.Error())
+		c.Conn.Close()
+	}
+}
+
+// snapshot freezes a copy of the keyspace and the configuration, and returns
+// the function saving it to the RDB file.
+func snapshot() func() error {
+	mu.Lock()
+	databases := copyDatabases()
+	metadata := snapshotMetadata()
+	dir, dbfilename := Config["dir"], Config["dbfilename"]
+	mu.Unlock()
+	return func() error {
+		return rdb.Save(dir, dbfilename, metadata, databases)
+	}
+}
+
+// snapshotMetadata returns the auxiliary fields of a snapshot taken now: its
+// creation time, the memory in use and the replication ID and offset it
+// matches, along with rdbcompression. It must be called with mu held.
+func snapshotMetadata() map[string]string {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	replID, offset := Replication.ReplID()
+	return map[string]string{
+		"ctime":          strconv.FormatInt(time.Now().Unix(), 10),
+		"used-mem":       strconv.FormatUint(memStats.Alloc, 10),
+		"repl-id":        replID,
+		"repl-offset":    strconv.FormatInt(offset, 10),
+		"rdbcompression": Config["rdbcompression"],
+	}
+}
+
+// copyDatabases returns a point-in-time copy of the keyspace. It must be
+// called with mu held.
+func copyDatabases() map[uint8]resp.Database {
+	databases := make(map[uint8]resp.Database, len(Databases))
+	for id, db := range Databases {
+		databases[id] = db.Copy()
 	}
+	return databases
+}
+
+// sendSnapshotFile saves the snapshot to the RDB file and transfers it from
+// there to the replica.
+func sendSnapshotFile(c *client.Client, dir string, dbfilename string, metadata map[string]string, databases map[uint8]resp.Database) error {
+	if err := rdb.Save(dir, dbfilename, metadata, databases); err != nil {
+		return err
+	}
+	file, err := os.Open(rdb.Path(dir, dbfilename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return Replication.SendSnapshot(c, file, info.Size())
+}
+
+// loadSnapshot replaces the keyspace with the snapshot received from our
+// master. Depending on repl-diskless-load it is parsed straight from the
+// connection into a staging keyspace, or saved to the RDB file and loaded
+// from there.
+func loadSnapshot(payload io.Reader) error {
+	mu.Lock()
+	mode, dir, dbfilename := Config["repl-diskless-load"], Config["dir"], Config["dbfilename"]
+	empty := true
+	for _, db := range Databases {
+		if len(db.Store) > 0 {
+			empty = false
+		}
+	}
+	mu.Unlock()
+
+	var databases map[uint8]resp.Database
+	var err error
+	if mode == "swapdb" || (mode == "on-empty-db" && empty) {
+		_, databases, err = rdb.Read(payload)
+	} else {
+		databases, err = receiveSnapshotFile(payload, dir, dbfilename)
+	}
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	Databases = databases
+	if _, exists := Databases[DatabaseID]; !exists {
+		Databases[DatabaseID] = resp.NewDatabase(DatabaseID)
+	}
+	mu.Unlock()
+	Tracking.Flush()
+	Persistence.RestartAOF()
+	return nil
+}
+
+// receiveSnapshotFile writes the snapshot to a temporary file, renames it over
+// the RDB file once complete and loads it.
+func receiveSnapshotFile(payload io.Reader, dir string, dbfilename string) (map[uint8]resp.Database, error) {
+	target := rdb.Path(dir, dbfilename)
+	temp := filepath.Join(filepath.Dir(target), fmt.Sprintf("temp-%d-%d.rdb", time.Now().Unix(), os.Getpid()))
+	file, err := os.Create(temp)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, payload); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	if err := os.Rename(temp, target); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	_, databases, err := rdb.Open(dir, dbfilename)
+	return databases, err
+}
+
+// configCommand runs CONFIG. A CONFIG SET value is validated before it is
+// stored, so that an invalid one never reaches Config, then applied.
+func configCommand(commands resp.Value) []byte {
+	if len(commands.Array) < 2 || strings.ToUpper(commands.Array[1].String) != "SET" {
+		return methods.HandleConfig(commands, &mu, Config)
+	}
+	if len(commands.Array) < 4 {
+		return resp.ToError("wrong number of arguments for 'config|set' command")
+	}
+	key, value := commands.Array[2].String, commands.Array[3].String
+	if err := validateConfig(key, value); err != nil {
+		return resp.ToError("CONFIG SET failed: " + err.Error())
+	}
+	mu.Lock()
+	previous := Config[key]
+	mu.Unlock()
+	reply := methods.HandleConfig(commands, &mu, Config)
+	if err := applyConfig(); err != nil {
+		return resp.ToError("CONFIG SET failed: " + err.Error())
+	}
+	// Only a change of the AOF settings opens or closes it.
+	if (key == "appendonly" || key == "appendfsync") && value != previous {
+		if err := updateAppendOnly(true); err != nil {
+			return resp.ToError("CONFIG SET failed: appendonly: " + err.Error())
+		}
+	}
+	return reply
+}
+
+// runtimeConfig holds the configuration values that can be changed at
+// runtime, parsed from Config.
+type runtimeConfig struct {
+	savePoints       []persistence.SavePoint
+	aof              persistence.AOFConfig
+	backlogSize      int
+	replicaReadOnly  bool
+	replDisklessSync bool
+}
+
+// parseConfig checks and parses the configuration values that can be
+// changed at runtime.
+func parseConfig(config map[string]string) (runtimeConfig, error) {
+	var c runtimeConfig
+	var err error
+	if c.savePoints, err = persistence.ParseSavePoints(config["save"]); err != nil {
+		return c, fmt.Errorf("save: %v", err)
+	}
+	if c.aof, err = parseAOFConfig(config); err != nil {
+		return c, err
+	}
+	if c.backlogSize, err = parseBytes(config["repl-backlog-size"]); err != nil {
+		return c, fmt.Errorf("repl-backlog-size: %v", err)
+	}
+	if c.replicaReadOnly, err = parseBool(config["replica-read-only"]); err != nil {
+		return c, fmt.Errorf("replica-read-only: %v", err)
+	}
+	if c.replDisklessSync, err = parseBool(config["repl-diskless-sync"]); err != nil {
+		return c, fmt.Errorf("repl-diskless-sync: %v", err)
+	}
+
+	switch config["repl-diskless-load"] {
+	case "disabled", "on-empty-db", "swapdb":
+	default:
+		return c, fmt.Errorf("repl-diskless-load: argument must be 'disabled', 'on-empty-db' or 'swapdb'")
+	}
+
+	if _, err := parseBool(config["rdbcompression"]); err != nil {
+		return c, fmt.Errorf("rdbcompression: %v", err)
+	}
+	if _, err := parseBool(config["appendonly"]); err != nil {
+		return c, fmt.Errorf("appendonly: %v", err)
+	}
+	if _, err := parseBool(config["aof-load-truncated"]); err != nil {
+		return c, fmt.Errorf("aof-load-truncated: %v", err)
+	}
+	return c, nil
+}
+
+// validateConfig checks that setting key to value leaves a valid
+// configuration, before CONFIG SET stores it.
+func validateConfig(key string, value string) error {
+	mu.Lock()
+	config := make(map[string]string, len(Config)+1)
+	for k, v := range Config {
+		config[k] = v
+	}
+	mu.Unlock()
+	config[key] = value
+	_, err := parseConfig(config)
+	return err
+}
+
+// applyConfig pushes configuration values that can be changed at runtime
+// into the subsystems using them.
+func applyConfig() error {
+	mu.Lock()
+	c, err := parseConfig(Config)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Persistence takes mu to snapshot the keyspace, so it must not be
+	// called with mu held.
+	Persistence.SetSavePoints(c.savePoints)
+	Persistence.SetAOFConfig(c.aof)
+
+	mu.Lock()
+	defer mu.Unlock()
+	Replication.SetBacklogSize(c.backlogSize)
+	replicaReadOnly.Store(c.replicaReadOnly)
+	replDisklessSync.Store(c.replDisklessSync)
+	return nil
+}
+
+// parseAOFConfig reads the settings of the AOF from config.
+func parseAOFConfig(config map[string]string) (persistence.AOFConfig, error) {
+	aofConfig := persistence.AOFConfig{
+		Dir:      config["dir"],
+		DirName:  config["appenddirname"],
+		Filename: config["appendfilename"],
+		Fsync:    config["appendfsync"],
+	}
+	switch aofConfig.Fsync {
+	case "always", "everysec", "no":
+	default:
+		return aofConfig, fmt.Errorf("appendfsync: argument must be 'always', 'everysec' or 'no'")
+	}
+	var err error
+	if aofConfig.RDBPreamble, err = parseBool(config["aof-use-rdb-preamble"]); err != nil {
+		return aofConfig, fmt.Errorf("aof-use-rdb-preamble: %v", err)
+	}
+	percentage, err := strconv.Atoi(config["auto-aof-rewrite-percentage"])
+	if err != nil || percentage < 0 {
+		return aofConfig, fmt.Errorf("auto-aof-rewrite-percentage: argument must be a positive integer")
+	}
+	aofConfig.RewritePercentage = int64(percentage)
+	minSize, err := parseBytes(config["auto-aof-rewrite-min-size"])
+	if err != nil {
+		return aofConfig, fmt.Errorf("auto-aof-rewrite-min-size: %v", err)
+	}
+	aofConfig.RewriteMinSize = int64(minSize)
+	return aofConfig, nil
+}
+
+// parseBool parses yes/no configuration values.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("argument must be 'yes' or 'no'")
+	}
+}
+
+// parseBytes parses memory sizes such as "1024", "16kb" or "1mb".
+func parseBytes(value string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1}}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := 1
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size: %q", value)
+	}
+	return n * multiplier, nil
 }
 
 func startExpiryChecker(stopCh <-chan os.Signal) {
 	ticker := time.NewTicker(1 * time.Second) // Check every second
 	defer ticker.Stop()
 
-	for id, _ := range Databases {
+	for {
 		select {
 		case now := <-ticker.C:
+			// The expired keys of the current database are deleted like a DEL
+			// would, so that replicas and the AOF drop them too.
+			writeMu.Lock()
 			mu.Lock()
-			for timestamp, key := range Databases[id].ExpiryMap {
-				if now.After(timestamp) {
-					if val, exists := Databases[id].Store[key]; exists && val.ExpireAt == timestamp {
-						delete(Databases[id].Store, key)
-					}
+			var expired []string
+			for id, db := range Databases {
+				for timestamp, key := range db.ExpiryMap {
+					if now.After(timestamp) {
+						if val, exists := db.Store[key]; exists && val.ExpireAt == timestamp {
+							delete(db.Store, key)
+							if id == DatabaseID {
+								expired = append(expired, key)
+							}
+						}
 
-					delete(Databases[id].ExpiryMap, timestamp)
+						delete(db.ExpiryMap, timestamp)
+					}
 				}
 			}
 			mu.Unlock()
+			if len(expired) > 0 {
+				propagateDel(&client.Client{}, delCommand(expired), expired)
+			}
+			writeMu.Unlock()
 		case <-stopCh:
 			return // Exit the goroutine when stopCh is closed
 		}
@@ -0,0 +1,171 @@
+package methods
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/cluster"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// HandleCluster runs the CLUSTER subcommands. state is nil when cluster mode
+// is disabled.
+func HandleCluster(commands resp.Value, state *cluster.State, mu *sync.Mutex, db *resp.Database) []byte {
+	if state == nil {
+		return resp.ToError("This instance has cluster support disabled")
+	}
+	args := commands.Array[2:]
+	switch subcommand := strings.ToLower(commands.Array[1].String); subcommand {
+	case "keyslot":
+		if len(args) != 1 {
+			return resp.ToError("wrong number of arguments for 'cluster|keyslot' command")
+		}
+		return resp.ToInteger(cluster.KeySlot(args[0].String))
+	case "myid":
+		return resp.ToBulkString(state.Myself().ID)
+	case "info":
+		return resp.ToBulkString(state.Info())
+	case "nodes":
+		return resp.ToBulkString(state.Nodes())
+	case "slots":
+		var slots []any
+		for _, r := range state.Ranges() {
+			slots = append(slots, []any{r.Start, r.End, []any{r.Node.Host, r.Node.Port, r.Node.ID}})
+		}
+		return resp.ToArray(slots)
+	case "shards":
+		var shards []any
+		for _, shard := range state.Shards() {
+			var slots []any
+			for _, r := range shard.Ranges {
+				slots = append(slots, r[0], r[1])
+			}
+			node := []any{"id", shard.Node.ID, "port", shard.Node.Port, "ip", shard.Node.Host, "endpoint", shard.Node.Host, "role", "master", "health", shard.Health}
+			shards = append(shards, []any{"slots", slots, "nodes", []any{node}})
+		}
+		return resp.ToArray(shards)
+	case "meet":
+		if len(args) != 2 && len(args) != 3 {
+			return resp.ToError("wrong number of arguments for 'cluster|meet' command")
+		}
+		port, err := strconv.Atoi(args[1].String)
+		if err != nil || port < 0 || port > 65535 {
+			return resp.ToError("Invalid base port specified: " + args[1].String)
+		}
+		busPort := port + cluster.BusPortOffset
+		if len(args) == 3 {
+			if busPort, err = strconv.Atoi(args[2].String); err != nil || busPort < 0 || busPort > 65535 {
+				return resp.ToError("Invalid bus port specified: " + args[2].String)
+			}
+		}
+		if err := state.Meet(args[0].String, port, busPort); err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	case "addslots", "delslots":
+		if len(args) == 0 {
+			return resp.ToError("wrong number of arguments for 'cluster|" + subcommand + "' command")
+		}
+		slots := make([]int, len(args))
+		for i, arg := range args {
+			slot, err := strconv.Atoi(arg.String)
+			if err != nil || slot < 0 || slot >= cluster.SlotCount {
+				return resp.ToError("Invalid or out of range slot")
+			}
+			slots[i] = slot
+		}
+		var err error
+		if subcommand == "addslots" {
+			err = state.AddSlots(slots)
+		} else {
+			err = state.DelSlots(slots)
+		}
+		if err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	case "forget":
+		if len(args) != 1 {
+			return resp.ToError("wrong number of arguments for 'cluster|forget' command")
+		}
+		if err := state.Forget(args[0].String); err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	case "setslot":
+		if len(args) < 2 {
+			return resp.ToError("wrong number of arguments for 'cluster|setslot' command")
+		}
+		slot, err := strconv.Atoi(args[0].String)
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return resp.ToError("Invalid or out of range slot")
+		}
+		action := strings.ToUpper(args[1].String)
+		if (action == "STABLE" && len(args) != 2) || (action != "STABLE" && len(args) != 3) {
+			return resp.ToError("syntax error")
+		}
+		switch action {
+		case "MIGRATING":
+			err = state.SetSlotMigrating(slot, args[2].String)
+		case "IMPORTING":
+			err = state.SetSlotImporting(slot, args[2].String)
+		case "STABLE":
+			state.SetSlotStable(slot)
+		case "NODE":
+			err = state.SetSlotNode(slot, args[2].String, len(keysInSlot(mu, db, slot)))
+		default:
+			return resp.ToError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		}
+		if err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return resp.ToError("wrong number of arguments for 'cluster|countkeysinslot' command")
+		}
+		slot, err := strconv.Atoi(args[0].String)
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return resp.ToError("Invalid slot")
+		}
+		return resp.ToInteger(len(keysInSlot(mu, db, slot)))
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return resp.ToError("wrong number of arguments for 'cluster|getkeysinslot' command")
+		}
+		slot, err := strconv.Atoi(args[0].String)
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return resp.ToError("Invalid slot")
+		}
+		count, err := strconv.Atoi(args[1].String)
+		if err != nil || count < 0 {
+			return resp.ToError("Invalid number of keys")
+		}
+		keys := keysInSlot(mu, db, slot)
+		reply := make([]any, 0, min(count, len(keys)))
+		for _, key := range keys[:min(count, len(keys))] {
+			reply = append(reply, key)
+		}
+		return resp.ToArray(reply)
+	default:
+		return resp.ToError("unknown subcommand '" + commands.Array[1].String + "'. Try CLUSTER HELP.")
+	}
+}
+
+// keysInSlot returns the keys of the database hashing to slot, in order. The
+// keyspace is not indexed by slot, so it is scanned.
+func keysInSlot(mu *sync.Mutex, db *resp.Database, slot int) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var keys []string
+	for key := range (*db).Store {
+		if _, exists := lookupKey(db, key); exists && cluster.KeySlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,101 @@
+package methods
+
+import (
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+type CommandFlag uint32
+
+const (
+	// FlagWrite marks commands that may modify the keyspace. They are
+	// propagated to replicas and rejected by read-only replicas.
+	FlagWrite CommandFlag = 1 << iota
+	// FlagReadOnly marks commands that only read keys.
+	FlagReadOnly
+	// FlagAdmin marks server administration commands.
+	FlagAdmin
+	// FlagPubSub marks commands allowed while a RESP2 client is subscribed.
+	FlagPubSub
+)
+
+// Command describes a command the way Redis' command table does: Arity is
+// the exact number of arguments including the command name, or the minimum
+// when negative, and FirstKey, LastKey and Step give the positions of its
+// keys (LastKey -1 meaning the last argument).
+type Command struct {
+	Name     string
+	Arity    int
+	Flags    CommandFlag
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+var commandTable = map[string]Command{
+	"PING":         {"ping", -1, FlagPubSub, 0, 0, 0},
+	"ECHO":         {"echo", 2, 0, 0, 0, 0},
+	"INFO":         {"info", -1, 0, 0, 0, 0},
+	"SET":          {"set", -3, FlagWrite, 1, 1, 1},
+	"GET":          {"get", 2, FlagReadOnly, 1, 1, 1},
+	"KEYS":         {"keys", 2, FlagReadOnly, 0, 0, 0},
+	"TYPE":         {"type", 2, FlagReadOnly, 1, 1, 1},
+	"CONFIG":       {"config", -2, FlagAdmin, 0, 0, 0},
+	"SAVE":         {"save", 1, FlagAdmin, 0, 0, 0},
+	"BGSAVE":       {"bgsave", -1, FlagAdmin, 0, 0, 0},
+	"BGREWRITEAOF": {"bgrewriteaof", 1, FlagAdmin, 0, 0, 0},
+	"LASTSAVE":     {"lastsave", 1, 0, 0, 0, 0},
+	"REPLCONF":     {"replconf", -1, FlagAdmin, 0, 0, 0},
+	"PSYNC":        {"psync", -3, FlagAdmin, 0, 0, 0},
+	"WAIT":         {"wait", 3, 0, 0, 0, 0},
+	"REPLICAOF":    {"replicaof", 3, FlagAdmin, 0, 0, 0},
+	"SLAVEOF":      {"slaveof", 3, FlagAdmin, 0, 0, 0},
+	"FAILOVER":     {"failover", -1, FlagAdmin, 0, 0, 0},
+	"ROLE":         {"role", 1, 0, 0, 0, 0},
+	"HELLO":        {"hello", -1, 0, 0, 0, 0},
+	"CLIENT":       {"client", -2, 0, 0, 0, 0},
+	"SUBSCRIBE":    {"subscribe", -2, FlagPubSub, 0, 0, 0},
+	"UNSUBSCRIBE":  {"unsubscribe", -1, FlagPubSub, 0, 0, 0},
+	"PUBLISH":      {"publish", 3, 0, 0, 0, 0},
+	"CLUSTER":      {"cluster", -2, 0, 0, 0, 0},
+	"ASKING":       {"asking", 1, 0, 0, 0, 0},
+	"DEL":          {"del", -2, FlagWrite, 1, -1, 1},
+	"MIGRATE":      {"migrate", -6, FlagWrite, 3, 3, 1},
+	"DUMP":         {"dump", 2, FlagReadOnly, 1, 1, 1},
+	"RESTORE":      {"restore", -4, FlagWrite, 1, 1, 1},
+	// RESTORE-ASKING is sent by MIGRATE in cluster mode: a RESTORE that is
+	// accepted for an importing slot, as if preceded by ASKING.
+	"RESTORE-ASKING": {"restore-asking", -4, FlagWrite, 1, 1, 1},
+}
+
+func LookupCommand(name string) (Command, bool) {
+	command, exists := commandTable[strings.ToUpper(name)]
+	return command, exists
+}
+
+func (command Command) CheckArity(commands resp.Value) bool {
+	if command.Arity < 0 {
+		return len(commands.Array) >= -command.Arity
+	}
+	return len(commands.Array) == command.Arity
+}
+
+// Keys returns the keys the command operates on.
+func (command Command) Keys(commands resp.Value) []string {
+	if command.Name == "migrate" {
+		return MigrateKeys(commands)
+	}
+	if command.FirstKey == 0 {
+		return nil
+	}
+	last := command.LastKey
+	if last < 0 {
+		last = len(commands.Array) + last
+	}
+	keys := make([]string, 0, 1)
+	for i := command.FirstKey; i <= last && i < len(commands.Array); i += command.Step {
+		keys = append(keys, commands.Array[i].String)
+	}
+	return keys
+}
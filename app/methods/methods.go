@@ -1,17 +1,20 @@
 package methods
 
 import (
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+	"github.com/codecrafters-io/redis-starter-go/app/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/tracking"
 )
 
-var nullTimeStamp = time.Time{}
-
 func Echo(commands resp.Value) []byte {
 	if len(commands.Array) < 2 {
 		return resp.ToError("wrong number of arguments for 'echo' command")
@@ -26,42 +29,76 @@ func Echo(commands resp.Value) []byte {
 	return value
 }
 
-func Set(commands resp.Value, mu *sync.Mutex, db *resp.Database) (respBytes []byte) {
+// Set sets a key to a string (SET key value [NX | XX] [GET] [EX seconds |
+// PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds |
+// KEEPTTL]). It also returns the number of keys changed: none when NX or XX
+// prevented the write. An expiry time already in the past deletes the key.
+func Set(commands resp.Value, mu *sync.Mutex, db *resp.Database) ([]byte, int) {
 	if len(commands.Array) < 3 {
-		return resp.ToError("wrong number of arguments for 'set' command")
+		return resp.ToError("wrong number of arguments for 'set' command"), 0
 	}
 	if commands.Array[1].Type != resp.RESPTypeBulkString && commands.Array[1].Type != resp.RESPTypeSimpleString {
-		return resp.ToError("set key must be a string")
+		return resp.ToError("set key must be a string"), 0
 	}
 	if commands.Array[2].Type != resp.RESPTypeBulkString && commands.Array[2].Type != resp.RESPTypeSimpleString {
-		return resp.ToError("set value must be a string")
+		return resp.ToError("set value must be a string"), 0
 	}
 
-	expiration := time.Duration(0)
-	if len(commands.Array) == 5 {
-		if commands.Array[3].Type != resp.RESPTypeBulkString && commands.Array[3].Type != resp.RESPTypeSimpleString {
-			return resp.ToError("set expiration type must be a string")
-		}
-
-		if commands.Array[4].Type != resp.RESPTypeInteger && commands.Array[4].Type != resp.RESPTypeBulkString && commands.Array[4].Type != resp.RESPTypeSimpleString {
-			return resp.ToError("set expiration value must be an integer")
+	var nx, xx, get, keepTTL bool
+	var expireAt time.Time
+	args := commands.Array[3:]
+	for i := 0; i < len(args); i++ {
+		if args[i].Type != resp.RESPTypeBulkString && args[i].Type != resp.RESPTypeSimpleString {
+			return resp.ToError("syntax error"), 0
 		}
-		expirationValue := 0
-		if commands.Array[4].Type == resp.RESPTypeInteger {
-			expirationValue = commands.Array[4].Integer
-		} else {
-			eval, err := strconv.Atoi(commands.Array[4].String)
-			if err != nil {
-				return resp.ToError("set expiration value must be an integer")
+		switch option := strings.ToUpper(args[i].String); option {
+		case "NX", "XX":
+			if (option == "NX" && xx) || (option == "XX" && nx) {
+				return resp.ToError("syntax error"), 0
 			}
-			expirationValue = eval
-		}
-		if strings.ToUpper(commands.Array[3].String) == "EX" {
-			expiration = time.Second * time.Duration(expirationValue)
-		} else if strings.ToUpper(commands.Array[3].String) == "PX" {
-			expiration = time.Millisecond * time.Duration(expirationValue)
-		} else {
-			return resp.ToError("set expiration type must be 'EX' or 'PX'")
+			nx, xx = nx || option == "NX", xx || option == "XX"
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if !expireAt.IsZero() {
+				return resp.ToError("syntax error"), 0
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || !expireAt.IsZero() || i+1 >= len(args) {
+				return resp.ToError("syntax error"), 0
+			}
+			i++
+			if args[i].Type != resp.RESPTypeInteger && args[i].Type != resp.RESPTypeBulkString && args[i].Type != resp.RESPTypeSimpleString {
+				return resp.ToError("set expiration value must be an integer"), 0
+			}
+			expirationValue := int64(args[i].Integer)
+			if args[i].Type != resp.RESPTypeInteger {
+				eval, err := strconv.ParseInt(args[i].String, 10, 64)
+				if err != nil {
+					return resp.ToError("value is not an integer or out of range"), 0
+				}
+				expirationValue = eval
+			}
+			seconds := option == "EX" || option == "EXAT"
+			if expirationValue <= 0 || (seconds && expirationValue > math.MaxInt64/1000) {
+				return resp.ToError("invalid expire time in 'set' command"), 0
+			}
+			// EXAT and PXAT are absolute Unix times, which is how SET is
+			// propagated so that replicas and the AOF expire the key at the
+			// same time.
+			switch option {
+			case "EX":
+				expireAt = time.Now().Add(time.Second * time.Duration(expirationValue))
+			case "PX":
+				expireAt = time.Now().Add(time.Millisecond * time.Duration(expirationValue))
+			case "EXAT":
+				expireAt = time.Unix(expirationValue, 0)
+			case "PXAT":
+				expireAt = time.UnixMilli(expirationValue)
+			}
+		default:
+			return resp.ToError("syntax error"), 0
 		}
 	}
 
@@ -70,32 +107,40 @@ func Set(commands resp.Value, mu *sync.Mutex, db *resp.Database) (respBytes []by
 
 	key := commands.Array[1].String
 	if key == "" {
-		return resp.ToError("empty key")
+		return resp.ToError("empty key"), 0
 	}
 
-	// Check if key exists and clean up old expiry if needed
-	if oldVal, exists := (*db).Store[key]; exists {
-		if !oldVal.ExpireAt.IsZero() {
-			delete((*db).ExpiryMap, oldVal.ExpireAt)
+	old, exists := lookupKey(db, key)
+	reply := resp.ToSimpleString("OK")
+	if get {
+		if exists && old.Object != nil {
+			return resp.ToErrorWithCode("WRONGTYPE", "Operation against a key holding the wrong kind of value"), 0
 		}
-	}
-
-	// Set new value and expiry
-	if expiration != time.Duration(0) {
-		timeStamp := time.Now().Add(expiration)
-		(*db).Store[key] = resp.StoreValue{
-			Value:    commands.Array[2],
-			ExpireAt: timeStamp,
+		reply = resp.ToBulkString("")
+		if exists {
+			reply = resp.ToBulkBytes(old.String.Bytes())
 		}
-		(*db).ExpiryMap[timeStamp] = key
-	} else {
-		// fmt.Println("SET", key, commands.Array[2].String, expiration)
-		(*db).Store[key] = resp.StoreValue{
-			Value:    commands.Array[2],
-			ExpireAt: nullTimeStamp,
+	}
+	if (nx && exists) || (xx && !exists) {
+		if !get {
+			reply = resp.ToBulkString("")
 		}
+		return reply, 0
 	}
-	return resp.ToSimpleString("OK")
+
+	if keepTTL && exists {
+		expireAt = old.ExpireAt
+	}
+	if !expireAt.IsZero() && !expireAt.After(time.Now()) {
+		// The key is set and expires at once.
+		deleteKey(db, key)
+		return reply, 1
+	}
+	storeKey(db, key, resp.StoreValue{
+		String:   resp.NewString([]byte(commands.Array[2].String)),
+		ExpireAt: expireAt,
+	})
+	return reply, 1
 }
 
 func Get(commands resp.Value, mu *sync.Mutex, db *resp.Database) []byte {
@@ -110,23 +155,74 @@ func Get(commands resp.Value, mu *sync.Mutex, db *resp.Database) []byte {
 	mu.Lock()
 	defer mu.Unlock()
 
-	if val, exists := (*db).Store[key]; exists {
-		// fmt.Printf("Expired GET %s %s\n", key, val.ExpireAt)
-		if !val.ExpireAt.IsZero() && val.ExpireAt.Before(time.Now()) {
-			delete((*db).ExpiryMap, val.ExpireAt)
-			delete((*db).Store, key)
-			return resp.ToBulkString("")
+	// Expired keys are left to the caller to delete, as their deletion must
+	// be propagated.
+	if val, exists := lookupKey(db, key); exists {
+		if val.Object != nil {
+			return resp.ToErrorWithCode("WRONGTYPE", "Operation against a key holding the wrong kind of value")
 		}
-		value := val.Value
+		return resp.ToBulkBytes(val.String.Bytes())
+	} else {
+		return resp.ToBulkString("")
+	}
+}
 
-		BytesValue, err := resp.ParseValue(value)
-		if err != nil {
-			return resp.ToError("Err parsing value: " + err.Error())
+// Type returns the type of the value of a key, or none when it does not
+// exist (TYPE key).
+func Type(commands resp.Value, mu *sync.Mutex, db *resp.Database) []byte {
+	mu.Lock()
+	defer mu.Unlock()
+
+	val, exists := lookupKey(db, commands.Array[1].String)
+	if !exists {
+		return resp.ToSimpleString("none")
+	}
+	return resp.ToSimpleString(val.TypeName())
+}
+
+// Del deletes keys (DEL key [key ...]), and also returns the number of keys
+// deleted.
+func Del(commands resp.Value, mu *sync.Mutex, db *resp.Database) ([]byte, int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	deleted := 0
+	for _, key := range commands.Array[1:] {
+		if _, exists := lookupKey(db, key.String); exists {
+			deleted++
 		}
+		deleteKey(db, key.String)
+	}
+	return resp.ToInteger(deleted), deleted
+}
 
-		return BytesValue
-	} else {
-		return resp.ToBulkString("")
+// lookupKey returns the value of key, treating expired keys as missing. It
+// must be called with mu held.
+func lookupKey(db *resp.Database, key string) (resp.StoreValue, bool) {
+	val, exists := (*db).Store[key]
+	if !exists || (!val.ExpireAt.IsZero() && val.ExpireAt.Before(time.Now())) {
+		return resp.StoreValue{}, false
+	}
+	return val, true
+}
+
+// storeKey sets key, replacing any previous value and expiry. It must be
+// called with mu held.
+func storeKey(db *resp.Database, key string, val resp.StoreValue) {
+	deleteKey(db, key)
+	(*db).Store[key] = val
+	if !val.ExpireAt.IsZero() {
+		(*db).ExpiryMap[val.ExpireAt] = key
+	}
+}
+
+// deleteKey must be called with mu held.
+func deleteKey(db *resp.Database, key string) {
+	if val, exists := (*db).Store[key]; exists {
+		if !val.ExpireAt.IsZero() {
+			delete((*db).ExpiryMap, val.ExpireAt)
+		}
+		delete((*db).Store, key)
 	}
 }
 
@@ -187,7 +283,7 @@ func HandleConfig(commands resp.Value, mu *sync.Mutex, config map[string]string)
 }
 
 func ConfigGet(commands resp.Value, mu *sync.Mutex, config map[string]string) []byte {
-	if len(commands.Array) < 2 {
+	if len(commands.Array) < 3 {
 		return resp.ToError("wrong number of arguments for 'config' command")
 	}
 	if commands.Array[2].Type != resp.RESPTypeBulkString && commands.Array[2].Type != resp.RESPTypeSimpleString {
@@ -205,10 +301,10 @@ func ConfigGet(commands resp.Value, mu *sync.Mutex, config map[string]string) []
 }
 
 func ConfigSet(commands resp.Value, mu *sync.Mutex, config map[string]string) []byte {
-	if len(commands.Array) < 3 {
+	if len(commands.Array) < 4 {
 		return resp.ToError("wrong number of arguments for 'config' command")
 	}
-	if commands.Array[2].Type != resp.RESPTypeBulkString && commands.Array[2].Type != resp.RESPTypeSimpleString && commands.Array[3].Type != resp.RESPTypeBulkString && commands.Array[3].Type != resp.RESPTypeSimpleString {
+	if (commands.Array[2].Type != resp.RESPTypeBulkString && commands.Array[2].Type != resp.RESPTypeSimpleString) || (commands.Array[3].Type != resp.RESPTypeBulkString && commands.Array[3].Type != resp.RESPTypeSimpleString) {
 		return resp.ToError("config key and value must be a string")
 	}
 	key := commands.Array[2].String
@@ -219,19 +315,387 @@ func ConfigSet(commands resp.Value, mu *sync.Mutex, config map[string]string) []
 	return resp.ToBulkString("OK")
 }
 
-func Info(commands resp.Value, config map[string]string) []byte {
+func Info(commands resp.Value, repl *replication.State, persist *persistence.State) []byte {
 	if len(commands.Array) == 1 {
 		return resp.ToSimpleString("PONG")
 	}
 
-	if (commands.Array[1].Type == resp.RESPTypeBulkString || commands.Array[1].Type == resp.RESPTypeSimpleString) && strings.ToLower(commands.Array[1].String) == "replication" {
-		return resp.ToBulkString(
-			"# Replication\n" +
-				"role:" + config["role"] + "\n" +
-				"connected_slaves:" + config["connected_slaves"] + "\n" +
-				"master_replid:" + config["master_replid"] + "\n" +
-				"master_repl_offset:" + config["master_repl_offset"] + "\n",
-		)
+	if commands.Array[1].Type == resp.RESPTypeBulkString || commands.Array[1].Type == resp.RESPTypeSimpleString {
+		switch strings.ToLower(commands.Array[1].String) {
+		case "replication":
+			return resp.ToBulkString(repl.Info())
+		case "persistence":
+			return resp.ToBulkString(persist.Info())
+		}
 	}
 	return resp.ToSimpleString("PONG")
 }
+
+func BgSave(commands resp.Value, persist *persistence.State) []byte {
+	if len(commands.Array) > 2 {
+		return resp.ToError("wrong number of arguments for 'bgsave' command")
+	}
+	schedule := false
+	if len(commands.Array) == 2 {
+		if strings.ToUpper(commands.Array[1].String) != "SCHEDULE" {
+			return resp.ToError("syntax error")
+		}
+		schedule = true
+	}
+	status, err := persist.BgSave(schedule)
+	if err != nil {
+		return resp.ToError(err.Error())
+	}
+	return resp.ToSimpleString(status)
+}
+
+// BgRewriteAOF rewrites the append-only file in the background
+// (BGREWRITEAOF).
+func BgRewriteAOF(persist *persistence.State) []byte {
+	status, err := persist.BgRewriteAOF()
+	if err != nil {
+		return resp.ToError(err.Error())
+	}
+	return resp.ToSimpleString(status)
+}
+
+func ReplConf(commands resp.Value, c *client.Client, repl *replication.State) []byte {
+	if len(commands.Array) < 3 || len(commands.Array)%2 == 0 {
+		return resp.ToError("wrong number of arguments for 'replconf' command")
+	}
+	switch strings.ToLower(commands.Array[1].String) {
+	case "getack":
+		// Sent by our master, the reply goes through the replication link.
+		repl.SendAck()
+		return nil
+	case "ack":
+		repl.ReplConf(c, "ack", commands.Array[2].String)
+		return nil
+	}
+	for i := 1; i < len(commands.Array); i += 2 {
+		if err := repl.ReplConf(c, commands.Array[i].String, commands.Array[i+1].String); err != nil {
+			return resp.ToError(err.Error())
+		}
+	}
+	return resp.ToSimpleString("OK")
+}
+
+func Wait(commands resp.Value, c *client.Client, repl *replication.State) []byte {
+	if len(commands.Array) != 3 {
+		return resp.ToError("wrong number of arguments for 'wait' command")
+	}
+	if repl.Role() != "master" {
+		return resp.ToError("WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	numReplicas, err := strconv.Atoi(commands.Array[1].String)
+	if err != nil {
+		return resp.ToError("value is not an integer or out of range")
+	}
+	timeout, err := strconv.Atoi(commands.Array[2].String)
+	if err != nil || timeout < 0 {
+		return resp.ToError("timeout is not an integer or out of range")
+	}
+	return resp.ToInteger(repl.Wait(numReplicas, time.Duration(timeout)*time.Millisecond, c.WriteOffset))
+}
+
+func ReplicaOf(commands resp.Value, repl *replication.State) []byte {
+	if len(commands.Array) != 3 {
+		return resp.ToError("wrong number of arguments for 'replicaof' command")
+	}
+	host, port := commands.Array[1].String, commands.Array[2].String
+	if strings.ToUpper(host) == "NO" && strings.ToUpper(port) == "ONE" {
+		repl.Promote()
+		return resp.ToSimpleString("OK")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return resp.ToError("Invalid master port")
+	}
+	repl.ReplicaOf(host, port)
+	return resp.ToSimpleString("OK")
+}
+
+func Failover(commands resp.Value, repl *replication.State) []byte {
+	var host, port string
+	var timeout int
+	var force, abort bool
+	for i := 1; i < len(commands.Array); i++ {
+		switch arg := strings.ToUpper(commands.Array[i].String); {
+		case arg == "TO" && i+2 < len(commands.Array) && host == "":
+			host, port = commands.Array[i+1].String, commands.Array[i+2].String
+			if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+				return resp.ToError("Invalid port")
+			}
+			i += 2
+		case arg == "TIMEOUT" && i+1 < len(commands.Array) && timeout == 0:
+			t, err := strconv.Atoi(commands.Array[i+1].String)
+			if err != nil {
+				return resp.ToError("value is not an integer or out of range")
+			}
+			if t <= 0 {
+				return resp.ToError("FAILOVER timeout must be greater than 0")
+			}
+			timeout = t
+			i++
+		case arg == "FORCE" && !force:
+			force = true
+		case arg == "ABORT" && !abort:
+			abort = true
+		default:
+			return resp.ToError("syntax error")
+		}
+	}
+
+	if abort {
+		if host != "" || timeout != 0 || force {
+			return resp.ToError("FAILOVER ABORT cannot be used with other options.")
+		}
+		if err := repl.AbortFailover(); err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	}
+	if force && (host == "" || timeout == 0) {
+		return resp.ToError("FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if err := repl.Failover(host, port, time.Duration(timeout)*time.Millisecond, force); err != nil {
+		return resp.ToError(err.Error())
+	}
+	return resp.ToSimpleString("OK")
+}
+
+func Role(commands resp.Value, repl *replication.State) []byte {
+	return resp.ToArray(repl.RoleInfo())
+}
+
+func Hello(commands resp.Value, c *client.Client, repl *replication.State) []byte {
+	protocol := c.Protocol()
+	for i := 1; i < len(commands.Array); i++ {
+		arg := commands.Array[i]
+		if arg.Type != resp.RESPTypeBulkString && arg.Type != resp.RESPTypeSimpleString {
+			return resp.ToError("hello arguments must be strings")
+		}
+		switch {
+		case i == 1:
+			version, err := strconv.Atoi(arg.String)
+			if err != nil {
+				return resp.ToError("Protocol version is not an integer or out of range")
+			}
+			if version != 2 && version != 3 {
+				return resp.ToErrorWithCode("NOPROTO", "unsupported protocol version")
+			}
+			protocol = version
+		case strings.ToUpper(arg.String) == "SETNAME" && i+1 < len(commands.Array):
+			c.SetName(commands.Array[i+1].String)
+			i++
+		case strings.ToUpper(arg.String) == "AUTH" && i+2 < len(commands.Array):
+			// No authentication is configured, so any credentials are accepted.
+			i += 2
+		default:
+			return resp.ToError("Syntax error in HELLO option '" + arg.String + "'")
+		}
+	}
+	c.SetProtocol(protocol)
+
+	return toMap(c, []any{
+		"server", "redis",
+		"version", "7.2.0",
+		"proto", protocol,
+		"id", int(c.ID),
+		"mode", "standalone",
+		"role", repl.Role(),
+		"modules", []any{},
+	})
+}
+
+func HandleClient(commands resp.Value, c *client.Client, table *tracking.Table) []byte {
+	if len(commands.Array) < 2 {
+		return resp.ToError("wrong number of arguments for 'client' command")
+	}
+	if commands.Array[1].Type != resp.RESPTypeBulkString && commands.Array[1].Type != resp.RESPTypeSimpleString {
+		return resp.ToError("client subcommand must be a string")
+	}
+	switch strings.ToUpper(commands.Array[1].String) {
+	case "ID":
+		return resp.ToInteger(int(c.ID))
+	case "SETNAME":
+		if len(commands.Array) != 3 {
+			return resp.ToError("wrong number of arguments for 'client|setname' command")
+		}
+		if strings.ContainsAny(commands.Array[2].String, " \n") {
+			return resp.ToError("Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.SetName(commands.Array[2].String)
+		return resp.ToSimpleString("OK")
+	case "GETNAME":
+		return resp.ToBulkString(c.Name())
+	case "TRACKING":
+		return ClientTracking(commands, c, table)
+	case "CACHING":
+		if len(commands.Array) != 3 {
+			return resp.ToError("wrong number of arguments for 'client|caching' command")
+		}
+		var yes bool
+		switch strings.ToUpper(commands.Array[2].String) {
+		case "YES":
+			yes = true
+		case "NO":
+			yes = false
+		default:
+			return resp.ToError("syntax error")
+		}
+		if err := table.Caching(c.ID, yes); err != nil {
+			return resp.ToError(err.Error())
+		}
+		return resp.ToSimpleString("OK")
+	case "GETREDIR":
+		opts, _, enabled := table.Info(c.ID)
+		if !enabled {
+			return resp.ToInteger(-1)
+		}
+		return resp.ToInteger(int(opts.Redirect))
+	case "TRACKINGINFO":
+		opts, caching, enabled := table.Info(c.ID)
+		if !enabled {
+			return toMap(c, []any{"flags", []any{"off"}, "redirect", -1, "prefixes", []any{}})
+		}
+		flags := []any{"on"}
+		if opts.Bcast {
+			flags = append(flags, "bcast")
+		}
+		if opts.OptIn {
+			flags = append(flags, "optin")
+		}
+		if opts.OptOut {
+			flags = append(flags, "optout")
+		}
+		if caching != "" {
+			flags = append(flags, "caching-"+caching)
+		}
+		if opts.NoLoop {
+			flags = append(flags, "noloop")
+		}
+		if _, exists := client.Get(opts.Redirect); opts.Redirect != 0 && !exists {
+			flags = append(flags, "broken_redirect")
+		}
+		prefixes := make([]any, 0, len(opts.Prefixes))
+		for _, prefix := range opts.Prefixes {
+			prefixes = append(prefixes, prefix)
+		}
+		return toMap(c, []any{"flags", flags, "redirect", int(opts.Redirect), "prefixes", prefixes})
+	default:
+		return resp.ToError("unknown client subcommand '" + commands.Array[1].String + "'")
+	}
+}
+
+func ClientTracking(commands resp.Value, c *client.Client, table *tracking.Table) []byte {
+	if len(commands.Array) < 3 {
+		return resp.ToError("wrong number of arguments for 'client|tracking' command")
+	}
+	switch strings.ToUpper(commands.Array[2].String) {
+	case "ON":
+	case "OFF":
+		table.Disable(c.ID)
+		return resp.ToSimpleString("OK")
+	default:
+		return resp.ToError("syntax error")
+	}
+
+	opts := tracking.Options{}
+	for i := 3; i < len(commands.Array); i++ {
+		switch strings.ToUpper(commands.Array[i].String) {
+		case "REDIRECT":
+			if i+1 >= len(commands.Array) {
+				return resp.ToError("syntax error")
+			}
+			id, err := strconv.ParseInt(commands.Array[i+1].String, 10, 64)
+			if err != nil {
+				return resp.ToError("value is not an integer or out of range")
+			}
+			if _, exists := client.Get(id); !exists {
+				return resp.ToError("The client ID you want redirect to does not exist")
+			}
+			opts.Redirect = id
+			i++
+		case "PREFIX":
+			if i+1 >= len(commands.Array) {
+				return resp.ToError("syntax error")
+			}
+			opts.Prefixes = append(opts.Prefixes, commands.Array[i+1].String)
+			i++
+		case "BCAST":
+			opts.Bcast = true
+		case "OPTIN":
+			opts.OptIn = true
+		case "OPTOUT":
+			opts.OptOut = true
+		case "NOLOOP":
+			opts.NoLoop = true
+		default:
+			return resp.ToError("syntax error")
+		}
+	}
+
+	if err := table.Enable(c.ID, opts); err != nil {
+		return resp.ToError(err.Error())
+	}
+	return resp.ToSimpleString("OK")
+}
+
+func Subscribe(commands resp.Value, c *client.Client) []byte {
+	if len(commands.Array) < 2 {
+		return resp.ToError("wrong number of arguments for 'subscribe' command")
+	}
+	var buf []byte
+	for _, channel := range commands.Array[1:] {
+		count := c.Subscribe(channel.String)
+		buf = append(buf, toPush(c, []any{"subscribe", channel.String, count})...)
+	}
+	return buf
+}
+
+func Unsubscribe(commands resp.Value, c *client.Client) []byte {
+	channels := make([]string, 0, len(commands.Array))
+	for _, channel := range commands.Array[1:] {
+		channels = append(channels, channel.String)
+	}
+	if len(channels) == 0 {
+		channels = c.Subscriptions()
+	}
+	if len(channels) == 0 {
+		return toPush(c, []any{"unsubscribe", nil, 0})
+	}
+	var buf []byte
+	for _, channel := range channels {
+		count := c.Unsubscribe(channel)
+		buf = append(buf, toPush(c, []any{"unsubscribe", channel, count})...)
+	}
+	return buf
+}
+
+// toMap replies with a RESP3 map, or a flat array for RESP2 clients.
+func toMap(c *client.Client, pairs []any) []byte {
+	if c.Protocol() >= 3 {
+		return resp.ToMap(pairs)
+	}
+	return resp.ToArray(pairs)
+}
+
+func Publish(commands resp.Value) []byte {
+	if len(commands.Array) != 3 {
+		return resp.ToError("wrong number of arguments for 'publish' command")
+	}
+	channel, message := commands.Array[1].String, commands.Array[2].String
+	subscribers := client.Subscribers(channel)
+	for _, c := range subscribers {
+		c.Write(toPush(c, []any{"message", channel, message}))
+	}
+	return resp.ToInteger(len(subscribers))
+}
+
+// toPush replies with a RESP3 push, or a plain array for RESP2 clients.
+func toPush(c *client.Client, value []any) []byte {
+	if c.Protocol() >= 3 {
+		return resp.ToPush(value)
+	}
+	return resp.ToArray(value)
+}
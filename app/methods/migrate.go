@@ -0,0 +1,290 @@
+package methods
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Dump serializes the value of a key so that it can be restored with
+// RESTORE, here or on another Redis server (DUMP key).
+func Dump(commands resp.Value, mu *sync.Mutex, db *resp.Database) []byte {
+	mu.Lock()
+	val, exists := lookupKey(db, commands.Array[1].String)
+	mu.Unlock()
+	if !exists {
+		return resp.ToBulkString("")
+	}
+	payload, err := rdb.DumpValue(val)
+	if err != nil {
+		return resp.ToError("Err serializing value: " + err.Error())
+	}
+	return resp.ToBulkString(string(payload))
+}
+
+// Restore creates a key from a payload produced by DUMP (RESTORE key ttl
+// payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]). ttl is in
+// milliseconds, 0 meaning no expiry, or a Unix time in milliseconds with
+// ABSTTL. IDLETIME and FREQ are validated but have no effect, as keys carry
+// no LRU or LFU information. It also returns the number of keys changed.
+func Restore(commands resp.Value, mu *sync.Mutex, db *resp.Database) ([]byte, int) {
+	key := commands.Array[1].String
+	ttl, err := strconv.ParseInt(commands.Array[2].String, 10, 64)
+	if err != nil {
+		return resp.ToError("value is not an integer or out of range"), 0
+	}
+	if ttl < 0 {
+		return resp.ToError("Invalid TTL value, must be >= 0"), 0
+	}
+	replace, absTTL, idleTime, freq := false, false, false, false
+	args := commands.Array[4:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].String) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || freq {
+				return resp.ToError("syntax error"), 0
+			}
+			i++
+			seconds, err := strconv.ParseInt(args[i].String, 10, 64)
+			if err != nil {
+				return resp.ToError("value is not an integer or out of range"), 0
+			}
+			if seconds < 0 {
+				return resp.ToError("Invalid IDLETIME value, must be >= 0"), 0
+			}
+			idleTime = true
+		case "FREQ":
+			if i+1 >= len(args) || idleTime {
+				return resp.ToError("syntax error"), 0
+			}
+			i++
+			frequency, err := strconv.ParseInt(args[i].String, 10, 64)
+			if err != nil {
+				return resp.ToError("value is not an integer or out of range"), 0
+			}
+			if frequency < 0 || frequency > 255 {
+				return resp.ToError("Invalid FREQ value, must be >= 0 and <= 255"), 0
+			}
+			freq = true
+		default:
+			return resp.ToError("syntax error"), 0
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := lookupKey(db, key); exists && !replace {
+		return resp.ToErrorWithCode("BUSYKEY", "Target key name already exists."), 0
+	}
+	value, err := rdb.RestoreValue([]byte(commands.Array[3].String))
+	if err != nil {
+		return resp.ToError(err.Error()), 0
+	}
+
+	var expireAt time.Time
+	if absTTL && ttl > 0 {
+		expireAt = time.UnixMilli(ttl)
+	} else if ttl > 0 {
+		expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	if !expireAt.IsZero() && !expireAt.After(time.Now()) {
+		// The key is already expired: it is not created, but still replaces
+		// the previous value.
+		if _, exists := lookupKey(db, key); !exists {
+			return resp.ToSimpleString("OK"), 0
+		}
+		deleteKey(db, key)
+		return resp.ToSimpleString("OK"), 1
+	}
+	value.ExpireAt = expireAt
+	storeKey(db, key, value)
+	return resp.ToSimpleString("OK"), 1
+}
+
+// MigrateKeys returns the keys of a MIGRATE command: its key argument, or the
+// keys following KEYS when it is empty.
+func MigrateKeys(commands resp.Value) []string {
+	if len(commands.Array) < 6 {
+		return nil
+	}
+	if commands.Array[3].String != "" {
+		return []string{commands.Array[3].String}
+	}
+	for i := 6; i < len(commands.Array); i++ {
+		if strings.ToUpper(commands.Array[i].String) == "KEYS" {
+			keys := make([]string, 0, len(commands.Array)-i-1)
+			for _, key := range commands.Array[i+1:] {
+				keys = append(keys, key.String)
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// Migrate moves keys to another instance (MIGRATE host port key|"" db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...]).
+// The keys are serialized like DUMP does and restored on the target, with
+// RESTORE-ASKING in cluster mode so that it accepts them for a slot it is
+// importing. Unless COPY is given, the keys restored on the target are
+// returned for the caller to delete. No lock is held while talking to the
+// target, so that a slow target, or this instance itself, does not block the
+// other clients.
+func Migrate(commands resp.Value, mu *sync.Mutex, db *resp.Database, cluster bool) ([]byte, []string) {
+	host, port := commands.Array[1].String, commands.Array[2].String
+	dbID, err := strconv.Atoi(commands.Array[4].String)
+	if err != nil {
+		return resp.ToError("value is not an integer or out of range"), nil
+	}
+	timeoutMillis, err := strconv.Atoi(commands.Array[5].String)
+	if err != nil {
+		return resp.ToError("value is not an integer or out of range"), nil
+	}
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	copyKeys, replace := false, false
+	var auth []any
+	args := commands.Array[6:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].String) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return resp.ToError("syntax error"), nil
+			}
+			auth = []any{"AUTH", args[i+1].String}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return resp.ToError("syntax error"), nil
+			}
+			auth = []any{"AUTH", args[i+1].String, args[i+2].String}
+			i += 2
+		case "KEYS":
+			if commands.Array[3].String != "" {
+				return resp.ToError("When using MIGRATE KEYS option, the key argument must be set to the empty string"), nil
+			}
+			i = len(args)
+		default:
+			return resp.ToError("syntax error"), nil
+		}
+	}
+
+	// Serialize the keys that exist, with their remaining time to live.
+	restore := "RESTORE"
+	if cluster {
+		restore = "RESTORE-ASKING"
+	}
+	var keys []string
+	var request []byte
+	mu.Lock()
+	for _, key := range MigrateKeys(commands) {
+		val, exists := lookupKey(db, key)
+		if !exists {
+			continue
+		}
+		payload, err := rdb.DumpValue(val)
+		if err != nil {
+			mu.Unlock()
+			return resp.ToError("Err serializing value: " + err.Error()), nil
+		}
+		ttl := int64(0)
+		if !val.ExpireAt.IsZero() {
+			ttl = max(time.Until(val.ExpireAt).Milliseconds(), 1)
+		}
+		restoreCommand := []any{restore, key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			restoreCommand = append(restoreCommand, "REPLACE")
+		}
+		request = append(request, resp.ToArray(restoreCommand)...)
+		keys = append(keys, key)
+	}
+	mu.Unlock()
+	if len(keys) == 0 {
+		return resp.ToSimpleString("NOKEY"), nil
+	}
+
+	var setup []byte
+	setupCommands := 0
+	if auth != nil {
+		setup = append(setup, resp.ToArray(auth)...)
+		setupCommands++
+	}
+	if dbID != 0 {
+		setup = append(setup, resp.ToArray([]any{"SELECT", strconv.Itoa(dbID)})...)
+		setupCommands++
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return resp.ToErrorWithCode("IOERR", "error or timeout connecting to the client"), nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// AUTH and SELECT must succeed before any key is sent, or the keys would
+	// be restored unauthenticated or in the wrong database of a target that
+	// does not know these commands.
+	reader := resp.NewReader(conn)
+	if setupCommands > 0 {
+		if _, err := conn.Write(setup); err != nil {
+			return resp.ToErrorWithCode("IOERR", "error or timeout writing to target instance"), nil
+		}
+		for range setupCommands {
+			reply, _, err := reader.ReadValue()
+			if err != nil {
+				return resp.ToErrorWithCode("IOERR", "error or timeout reading to target instance"), nil
+			}
+			if reply.Type == resp.RESPTypeError {
+				return resp.ToError("Target instance replied with error: " + reply.String), nil
+			}
+		}
+	}
+	if _, err := conn.Write(request); err != nil {
+		return resp.ToErrorWithCode("IOERR", "error or timeout writing to target instance"), nil
+	}
+
+	// Keys restored on the target are moved, even if another one failed.
+	var moved []string
+	var failure string
+	for _, key := range keys {
+		reply, _, err := reader.ReadValue()
+		if err != nil {
+			failure = "IOERR"
+			break
+		}
+		if reply.Type == resp.RESPTypeError {
+			failure = reply.String
+			continue
+		}
+		moved = append(moved, key)
+	}
+	if copyKeys {
+		moved = nil
+	}
+
+	switch failure {
+	case "":
+		return resp.ToSimpleString("OK"), moved
+	case "IOERR":
+		return resp.ToErrorWithCode("IOERR", "error or timeout reading to target instance"), moved
+	default:
+		return resp.ToError("Target instance replied with error: " + failure), moved
+	}
+}
@@ -0,0 +1,532 @@
+// Package persistence coordinates the snapshots of the keyspace saved to the
+// RDB file, in the foreground (SAVE) or in the background (BGSAVE), and the
+// append-only file.
+package persistence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+)
+
+const (
+	cronPeriod = 100 * time.Millisecond
+	// retryDelay is the minimum time between automatic BGSAVE or AOF rewrite
+	// attempts after a failure.
+	retryDelay = 5 * time.Second
+)
+
+// Snapshot captures a point-in-time copy of the keyspace and returns the
+// function writing that copy to disk, which may run while the keyspace keeps
+// changing.
+type Snapshot func() (write func() error)
+
+// Rewrite captures a point-in-time copy of the keyspace like Snapshot, and
+// returns the function encoding it as the base file of the AOF: an RDB file
+// when rdbPreamble is set, RESP commands otherwise.
+type Rewrite func(rdbPreamble bool) (encode func() ([]byte, error))
+
+// AOFConfig holds the settings of the AOF.
+type AOFConfig struct {
+	Dir      string
+	DirName  string
+	Filename string
+	Fsync    string
+	// RDBPreamble writes the base file in RDB format.
+	RDBPreamble bool
+	// The AOF is rewritten once it grew by RewritePercentage percent since
+	// the last rewrite and is at least RewriteMinSize bytes; 0 disables it.
+	RewritePercentage int64
+	RewriteMinSize    int64
+}
+
+// State tracks the saves in progress and the outcome of the last ones.
+type State struct {
+	mu       sync.Mutex
+	snapshot Snapshot
+	rewrite  Rewrite
+	// writes is held while a rewrite starts, so that no command is both in
+	// its snapshot and appended after it.
+	writes sync.Locker
+	// child is the kind of background job in progress: "" when idle, "rdb"
+	// for BGSAVE and "aof" for BGREWRITEAOF. Only one runs at a time.
+	child string
+	// childExited is broadcast whenever the background job ends.
+	childExited *sync.Cond
+	// bgsaveScheduled and aofRewriteScheduled run a BGSAVE or BGREWRITEAOF
+	// as soon as the current job ends.
+	bgsaveScheduled     bool
+	aofRewriteScheduled bool
+	bgsaveStart         time.Time
+	lastSave            time.Time
+	lastBgsaveDuration  time.Duration
+	// lastBgsaveErr is the outcome of the last save, foreground or not.
+	lastBgsaveErr error
+	lastBgsaveTry time.Time
+
+	// dirty counts the changes to the keyspace since the last save, and
+	// dirtyAtBgsave the part of them the BGSAVE in progress covers. It is
+	// updated while writes are held, so without s.mu.
+	dirty         atomic.Int64
+	dirtyAtBgsave int64
+	savePoints    []SavePoint
+
+	aofConfig AOFConfig
+	// aof is the append-only file while appendonly is enabled. It is
+	// appended to while writes are held, so without s.mu.
+	aof                    atomic.Pointer[aof.Log]
+	aofRewriteStart        time.Time
+	lastAOFRewriteDuration time.Duration
+	lastAOFRewriteErr      error
+	lastAOFRewriteTry      time.Time
+}
+
+// SavePoint triggers a BGSAVE once at least Changes writes happened and
+// Seconds elapsed since the last save.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSavePoints parses the save configuration: pairs of seconds and
+// changes, e.g. "3600 1 300 100 60 10000". An empty value disables automatic
+// saves.
+func ParseSavePoints(value string) ([]SavePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Invalid save parameters")
+	}
+	var points []SavePoint
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+// New returns the persistence state. writes must be held by the callers of
+// Append and Dirty, and Rewrite is called with it held.
+func New(snapshot Snapshot, rewrite Rewrite, writes sync.Locker) *State {
+	s := &State{
+		snapshot:               snapshot,
+		rewrite:                rewrite,
+		writes:                 writes,
+		lastSave:               time.Now(),
+		lastBgsaveDuration:     -1,
+		lastAOFRewriteDuration: -1,
+	}
+	s.childExited = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *State) SetSavePoints(points []SavePoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.savePoints = points
+}
+
+// HasSavePoints reports whether automatic saves are enabled, in which case
+// the keyspace is also saved on shutdown.
+func (s *State) HasSavePoints() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.savePoints) > 0
+}
+
+func (s *State) SetAOFConfig(config AOFConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aofConfig = config
+	if log := s.aof.Load(); log != nil {
+		log.SetFsync(config.Fsync)
+	}
+}
+
+// EnableAOF starts appending the write commands to the AOF. When rewrite is
+// set, its base file is first rewritten with the current keyspace; otherwise
+// the commands are appended to the AOF that was just loaded.
+func (s *State) EnableAOF(rewrite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aof.Load() != nil {
+		return nil
+	}
+	if s.child == "aof" {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+	config := s.aofConfig
+	log, err := aof.OpenLog(config.Dir, config.DirName, config.Filename, config.Fsync)
+	if err != nil {
+		return err
+	}
+	if !rewrite {
+		if err := log.OpenIncr(); err != nil {
+			return err
+		}
+		s.aof.Store(log)
+		return nil
+	}
+
+	s.writes.Lock()
+	err = log.StartRewrite()
+	var encode func() ([]byte, error)
+	if err == nil {
+		encode = s.rewrite(config.RDBPreamble)
+		s.aof.Store(log)
+	}
+	s.writes.Unlock()
+	if err != nil {
+		return err
+	}
+	base, err := encode()
+	if err == nil {
+		err = log.FinishRewrite(base, config.RDBPreamble)
+	}
+	if err != nil {
+		s.aof.Store(nil)
+		log.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *State) DisableAOF() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if log := s.aof.Swap(nil); log != nil {
+		log.Close()
+	}
+}
+
+// AOFEnabled reports whether write commands are appended to the AOF.
+func (s *State) AOFEnabled() bool {
+	return s.aof.Load() != nil
+}
+
+// Append writes a command that was just applied to the AOF, if enabled.
+func (s *State) Append(data []byte) {
+	log := s.aof.Load()
+	if log == nil {
+		return
+	}
+	if err := log.Append(data); err != nil {
+		fmt.Println("Error writing to the AOF file: ", err.Error())
+	}
+}
+
+// BgRewriteAOF rewrites the AOF in the background (BGREWRITEAOF) and returns
+// the status to reply with. While a BGSAVE runs, the rewrite is scheduled to
+// run after it.
+func (s *State) BgRewriteAOF() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.child {
+	case "aof":
+		return "", fmt.Errorf("Background append only file rewriting already in progress")
+	case "":
+	default:
+		s.aofRewriteScheduled = true
+		return "Background append only file rewriting scheduled", nil
+	}
+	if err := s.startAOFRewrite(); err != nil {
+		return "", fmt.Errorf("Can't execute an AOF background rewriting. Please check the server logs for more information.")
+	}
+	return "Background append only file rewriting started", nil
+}
+
+// RestartAOF rewrites the AOF after the keyspace was replaced, e.g. by a
+// full resynchronization with our master. A rewrite already in progress may
+// have captured the keyspace before that, so another one is scheduled.
+func (s *State) RestartAOF() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aof.Load() == nil {
+		return
+	}
+	if s.child != "" {
+		s.aofRewriteScheduled = true
+		return
+	}
+	s.startAOFRewrite()
+}
+
+// startAOFRewrite must be called with s.mu held. When the AOF is disabled,
+// its files are rewritten all the same.
+func (s *State) startAOFRewrite() error {
+	config := s.aofConfig
+	log := s.aof.Load()
+	enabled := log != nil
+	if !enabled {
+		var err error
+		if log, err = aof.OpenLog(config.Dir, config.DirName, config.Filename, config.Fsync); err != nil {
+			fmt.Println("Can't rewrite append only file in background: ", err.Error())
+			return err
+		}
+	}
+
+	s.writes.Lock()
+	err := log.StartRewrite()
+	var encode func() ([]byte, error)
+	if err == nil {
+		encode = s.rewrite(config.RDBPreamble)
+	}
+	s.writes.Unlock()
+	s.lastAOFRewriteTry = time.Now()
+	if err != nil {
+		fmt.Println("Can't rewrite append only file in background: ", err.Error())
+		s.lastAOFRewriteErr = err
+		if !enabled {
+			log.Close()
+		}
+		return err
+	}
+
+	s.child = "aof"
+	s.aofRewriteScheduled = false
+	s.aofRewriteStart = time.Now()
+	fmt.Println("Background append only file rewriting started")
+	go func() {
+		base, err := encode()
+		if err == nil {
+			err = log.FinishRewrite(base, config.RDBPreamble)
+		}
+		if !enabled {
+			log.Close()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			fmt.Println("Background AOF rewrite error: ", err.Error())
+		} else {
+			fmt.Println("Background AOF rewrite finished successfully")
+		}
+		s.lastAOFRewriteErr = err
+		s.lastAOFRewriteDuration = time.Since(s.aofRewriteStart)
+		s.childDone()
+	}()
+	return nil
+}
+
+// Dirty records changes to the keyspace.
+func (s *State) Dirty(changes int64) {
+	s.dirty.Add(changes)
+}
+
+// Cron starts a BGSAVE whenever a save point is reached, and an AOF rewrite
+// whenever the AOF grew enough. After a failure, it waits retryDelay before
+// trying again.
+func (s *State) Cron() {
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		if s.child == "" {
+			for _, point := range s.savePoints {
+				elapsed := time.Since(s.lastSave)
+				if s.dirty.Load() >= point.Changes && elapsed >= time.Duration(point.Seconds)*time.Second &&
+					(s.lastBgsaveErr == nil || time.Since(s.lastBgsaveTry) > retryDelay) {
+					fmt.Println(point.Changes, "changes in", point.Seconds, "seconds. Saving...")
+					s.startBgSave()
+					break
+				}
+			}
+		}
+		retryRewrite := s.lastAOFRewriteErr == nil || time.Since(s.lastAOFRewriteTry) > retryDelay
+		if s.child == "" && s.aofRewriteScheduled && retryRewrite {
+			s.startAOFRewrite()
+		}
+		if log := s.aof.Load(); s.child == "" && log != nil && s.aofConfig.RewritePercentage > 0 && retryRewrite {
+			size, base := log.Sizes()
+			growth := (size - max(base, 1)) * 100 / max(base, 1)
+			if size >= s.aofConfig.RewriteMinSize && growth >= s.aofConfig.RewritePercentage {
+				fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+				s.startAOFRewrite()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Save writes the snapshot in the foreground (SAVE).
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.child == "rdb" {
+		return fmt.Errorf("Background save already in progress")
+	}
+	return s.save()
+}
+
+// SaveOnShutdown writes the snapshot in the foreground once the BGSAVE in
+// progress, if any, is over: it may have started before the last writes.
+func (s *State) SaveOnShutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.child == "rdb" {
+		fmt.Println("Waiting for the background save in progress before exiting.")
+	}
+	for s.child == "rdb" {
+		s.childExited.Wait()
+	}
+	return s.save()
+}
+
+// save must be called with s.mu held.
+func (s *State) save() error {
+	err := s.snapshot()()
+	s.lastBgsaveErr = err
+	if err != nil {
+		fmt.Println("Error saving DB on disk: ", err.Error())
+		return err
+	}
+	s.lastSave = time.Now()
+	s.dirty.Store(0)
+	return nil
+}
+
+// BgSave writes the snapshot in the background (BGSAVE [SCHEDULE]) and
+// returns the status to reply with. While another background job runs, the
+// save is only scheduled to run after it when schedule is set.
+func (s *State) BgSave(schedule bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.child == "rdb":
+		return "", fmt.Errorf("Background save already in progress")
+	case s.child != "" && schedule:
+		s.bgsaveScheduled = true
+		return "Background saving scheduled", nil
+	case s.child != "":
+		return "", fmt.Errorf("Another child process is active (AOF?): can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+	}
+	s.startBgSave()
+	return "Background saving started", nil
+}
+
+// startBgSave must be called with s.mu held.
+func (s *State) startBgSave() {
+	write := s.snapshot()
+	s.child = "rdb"
+	s.bgsaveScheduled = false
+	s.bgsaveStart = time.Now()
+	s.lastBgsaveTry = s.bgsaveStart
+	s.dirtyAtBgsave = s.dirty.Load()
+	go func() {
+		err := write()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			fmt.Println("Background saving error: ", err.Error())
+		} else {
+			fmt.Println("Background saving terminated with success")
+			s.lastSave = time.Now()
+			s.dirty.Add(-s.dirtyAtBgsave)
+		}
+		s.lastBgsaveErr = err
+		s.lastBgsaveDuration = time.Since(s.bgsaveStart)
+		s.childDone()
+	}()
+}
+
+// childDone marks the end of the background job, then starts the scheduled
+// BGSAVE or AOF rewrite if any, the other one running after it. It must be
+// called with s.mu held.
+func (s *State) childDone() {
+	s.child = ""
+	s.childExited.Broadcast()
+	if s.bgsaveScheduled {
+		s.startBgSave()
+	} else if s.aofRewriteScheduled {
+		s.startAOFRewrite()
+	}
+}
+
+// LastSave returns the time of the last successful save (LASTSAVE).
+func (s *State) LastSave() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSave
+}
+
+// Info returns the persistence section of INFO.
+func (s *State) Info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bgsaveInProgress, currentBgsave := "0", "-1"
+	if s.child == "rdb" {
+		bgsaveInProgress = "1"
+		currentBgsave = strconv.Itoa(int(time.Since(s.bgsaveStart).Seconds()))
+	}
+	lastBgsaveStatus := "ok"
+	if s.lastBgsaveErr != nil {
+		lastBgsaveStatus = "err"
+	}
+	lastBgsave := "-1"
+	if s.lastBgsaveDuration >= 0 {
+		lastBgsave = strconv.Itoa(int(s.lastBgsaveDuration.Seconds()))
+	}
+	aofEnabled, aofStatus, aofSizes := "0", "ok", ""
+	if log := s.aof.Load(); log != nil {
+		aofEnabled = "1"
+		if log.LastError() != nil {
+			aofStatus = "err"
+		}
+		size, base := log.Sizes()
+		aofSizes = "aof_current_size:" + strconv.FormatInt(size, 10) + "\n" +
+			"aof_base_size:" + strconv.FormatInt(base, 10) + "\n"
+	}
+	rewriteInProgress, currentRewrite := "0", "-1"
+	if s.child == "aof" {
+		rewriteInProgress = "1"
+		currentRewrite = strconv.Itoa(int(time.Since(s.aofRewriteStart).Seconds()))
+	}
+	rewriteScheduled := "0"
+	if s.aofRewriteScheduled {
+		rewriteScheduled = "1"
+	}
+	lastRewrite := "-1"
+	if s.lastAOFRewriteDuration >= 0 {
+		lastRewrite = strconv.Itoa(int(s.lastAOFRewriteDuration.Seconds()))
+	}
+	lastRewriteStatus := "ok"
+	if s.lastAOFRewriteErr != nil {
+		lastRewriteStatus = "err"
+	}
+	return "# Persistence\n" +
+		"loading:0\n" +
+		"async_loading:0\n" +
+		"rdb_changes_since_last_save:" + strconv.FormatInt(s.dirty.Load(), 10) + "\n" +
+		"rdb_bgsave_in_progress:" + bgsaveInProgress + "\n" +
+		"rdb_last_save_time:" + strconv.FormatInt(s.lastSave.Unix(), 10) + "\n" +
+		"rdb_last_bgsave_status:" + lastBgsaveStatus + "\n" +
+		"rdb_last_bgsave_time_sec:" + lastBgsave + "\n" +
+		"rdb_current_bgsave_time_sec:" + currentBgsave + "\n" +
+		"aof_enabled:" + aofEnabled + "\n" +
+		"aof_rewrite_in_progress:" + rewriteInProgress + "\n" +
+		"aof_rewrite_scheduled:" + rewriteScheduled + "\n" +
+		"aof_last_rewrite_time_sec:" + lastRewrite + "\n" +
+		"aof_current_rewrite_time_sec:" + currentRewrite + "\n" +
+		"aof_last_bgrewrite_status:" + lastRewriteStatus + "\n" +
+		"aof_last_write_status:" + aofStatus + "\n" +
+		aofSizes
+}
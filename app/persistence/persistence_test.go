@@ -0,0 +1,242 @@
+package persistence
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSnapshot counts the snapshots taken and written. While block is set,
+// writes wait for a value on release, which is also the error they return.
+type fakeSnapshot struct {
+	mu      sync.Mutex
+	taken   int
+	written int
+	block   bool
+	release chan error
+}
+
+func newFakeSnapshot() *fakeSnapshot {
+	return &fakeSnapshot{release: make(chan error)}
+}
+
+func (f *fakeSnapshot) snapshot() func() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.taken++
+	block := f.block
+	return func() error {
+		var err error
+		if block {
+			err = <-f.release
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if err == nil {
+			f.written++
+		}
+		return err
+	}
+}
+
+func (f *fakeSnapshot) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.taken, f.written
+}
+
+func newTestState(f *fakeSnapshot) *State {
+	return New(f.snapshot, nil, &sync.Mutex{})
+}
+
+// waitIdle waits for the background job in progress to end.
+func waitIdle(t *testing.T, s *State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		child := s.child
+		s.mu.Unlock()
+		if child == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background job still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBgSaveInProgress(t *testing.T) {
+	f := newFakeSnapshot()
+	f.block = true
+	s := newTestState(f)
+	s.Dirty(3)
+	before := s.LastSave()
+
+	if status, err := s.BgSave(false); err != nil || status != "Background saving started" {
+		t.Fatalf("BgSave = %q, %v", status, err)
+	}
+	// Writes during the save are not covered by it.
+	s.Dirty(2)
+	if _, err := s.BgSave(false); err == nil {
+		t.Errorf("BGSAVE accepted while another one is in progress")
+	}
+	if _, err := s.BgSave(true); err == nil {
+		t.Errorf("BGSAVE SCHEDULE accepted while another BGSAVE is in progress")
+	}
+	if err := s.Save(); err == nil {
+		t.Errorf("SAVE accepted while a BGSAVE is in progress")
+	}
+	if _, written := f.counts(); written != 0 {
+		t.Errorf("%d snapshots written before the BGSAVE ended", written)
+	}
+
+	f.release <- nil
+	waitIdle(t, s)
+	if taken, written := f.counts(); taken != 1 || written != 1 {
+		t.Errorf("%d snapshots taken and %d written, want 1", taken, written)
+	}
+	if got := s.dirty.Load(); got != 2 {
+		t.Errorf("dirty = %d after the BGSAVE, want the 2 changes made during it", got)
+	}
+	if !s.LastSave().After(before) {
+		t.Errorf("LASTSAVE not updated by the BGSAVE")
+	}
+}
+
+func TestBgSaveFailure(t *testing.T) {
+	f := newFakeSnapshot()
+	f.block = true
+	s := newTestState(f)
+	s.Dirty(3)
+	before := s.LastSave()
+
+	if _, err := s.BgSave(false); err != nil {
+		t.Fatal(err)
+	}
+	f.release <- errors.New("disk full")
+	waitIdle(t, s)
+	if got := s.dirty.Load(); got != 3 {
+		t.Errorf("dirty = %d after a failed BGSAVE, want 3", got)
+	}
+	if s.LastSave() != before {
+		t.Errorf("LASTSAVE updated by a failed BGSAVE")
+	}
+}
+
+func TestParseSavePoints(t *testing.T) {
+	points, err := ParseSavePoints("3600 1 300 100 60 10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SavePoint{{3600, 1}, {300, 100}, {60, 10000}}
+	if len(points) != len(want) {
+		t.Fatalf("ParseSavePoints = %v, want %v", points, want)
+	}
+	for i := range want {
+		if points[i] != want[i] {
+			t.Errorf("ParseSavePoints = %v, want %v", points, want)
+		}
+	}
+	if points, err := ParseSavePoints(""); err != nil || len(points) != 0 {
+		t.Errorf("ParseSavePoints(\"\") = %v, %v, want no save points", points, err)
+	}
+	for _, value := range []string{"60", "0 1", "60 -1", "x 1"} {
+		if _, err := ParseSavePoints(value); err == nil {
+			t.Errorf("ParseSavePoints(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSavePointTriggersBgSave(t *testing.T) {
+	f := newFakeSnapshot()
+	s := newTestState(f)
+	s.SetSavePoints([]SavePoint{{Seconds: 1, Changes: 2}})
+	go s.Cron()
+
+	// Not enough changes.
+	s.Dirty(1)
+	time.Sleep(1200 * time.Millisecond)
+	if taken, _ := f.counts(); taken != 0 {
+		t.Fatalf("BGSAVE started with 1 change, want 2")
+	}
+
+	s.Dirty(1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, written := f.counts(); written == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("save point reached without a BGSAVE")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitIdle(t, s)
+	if got := s.dirty.Load(); got != 0 {
+		t.Errorf("dirty = %d after the BGSAVE, want 0", got)
+	}
+	// The next save needs new changes.
+	time.Sleep(1200 * time.Millisecond)
+	if taken, _ := f.counts(); taken != 1 {
+		t.Errorf("%d snapshots taken without new changes, want 1", taken)
+	}
+}
+
+func TestSaveOnShutdownWaitsForBgSave(t *testing.T) {
+	f := newFakeSnapshot()
+	f.block = true
+	s := newTestState(f)
+	if _, err := s.BgSave(false); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after the BGSAVE started only make it to the final save.
+	f.mu.Lock()
+	f.block = false
+	f.mu.Unlock()
+	s.Dirty(1)
+
+	done := make(chan error, 1)
+	go func() { done <- s.SaveOnShutdown() }()
+	select {
+	case err := <-done:
+		t.Fatalf("SaveOnShutdown returned %v before the BGSAVE ended", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	f.release <- nil
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SaveOnShutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SaveOnShutdown still waiting after the BGSAVE ended")
+	}
+	if taken, written := f.counts(); taken != 2 || written != 2 {
+		t.Errorf("%d snapshots taken and %d written, want the BGSAVE and the final save", taken, written)
+	}
+	if got := s.dirty.Load(); got != 0 {
+		t.Errorf("dirty = %d after the final save, want 0", got)
+	}
+}
+
+func TestSaveOnShutdownFailure(t *testing.T) {
+	f := newFakeSnapshot()
+	f.block = true
+	s := newTestState(f)
+	s.Dirty(1)
+
+	// The error is returned, so that the server refuses to exit.
+	done := make(chan error, 1)
+	go func() { done <- s.SaveOnShutdown() }()
+	f.release <- errors.New("disk full")
+	if err := <-done; err == nil {
+		t.Fatalf("SaveOnShutdown succeeded with a failed save")
+	}
+	if got := s.dirty.Load(); got != 1 {
+		t.Errorf("dirty = %d after a failed save, want 1", got)
+	}
+}
@@ -0,0 +1,61 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/codecrafters-io/redis-starter-go/app/crc64"
+)
+
+// preallocLimit caps the capacity reserved ahead from a length read in the
+// payload, which may be corrupt: larger collections grow as they are read.
+const preallocLimit = 1024
+
+// decoder reads the RDB format from a stream, hashing every byte it
+// consumes so that the checksum at the end is verified without holding the
+// payload in memory.
+type decoder struct {
+	r    *bufio.Reader
+	hash hash.Hash64
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r), hash: crc64.New()}
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.hash.Write([]byte{b})
+	return b, nil
+}
+
+// readBytes reads the next n bytes. The buffer grows as they arrive, so a
+// corrupt length fails at the end of the stream instead of allocating it.
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(min(n, 1<<16))
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.hash.Write(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// atEnd reports whether the stream has no more data.
+func (d *decoder) atEnd() bool {
+	_, err := d.r.Peek(1)
+	return err != nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/codecrafters-io/redis-starter-go/app/crc64"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// RDB_VERSION is the version number in REDIS_VERSION, also stamped on DUMP
+// payloads.
+const RDB_VERSION = 11
+
+// DumpValue serializes a single value the way DUMP does: its RDB type and
+// encoding, followed by the RDB version and a CRC64 of the whole payload,
+// both little endian.
+func DumpValue(value resp.StoreValue) ([]byte, error) {
+	var buf bytes.Buffer
+	valType, valueBytes, err := encodeStoreValue(value, false)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte(valType)
+	buf.Write(valueBytes)
+
+	binary.Write(&buf, binary.LittleEndian, uint16(RDB_VERSION))
+	binary.Write(&buf, binary.LittleEndian, crc64.Digest(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// RestoreValue parses a payload produced by DumpValue, or by DUMP on a Redis
+// server using an RDB version we can read. The value has no expiry.
+func RestoreValue(payload []byte) (resp.StoreValue, error) {
+	if len(payload) < 10 {
+		return resp.StoreValue{}, fmt.Errorf("DUMP payload version or checksum are wrong")
+	}
+	footer := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[footer:])
+	checksum := binary.LittleEndian.Uint64(payload[footer+2:])
+	if version > RDB_VERSION || checksum != crc64.Digest(payload[:footer+2]) {
+		return resp.StoreValue{}, fmt.Errorf("DUMP payload version or checksum are wrong")
+	}
+
+	d := newDecoder(bytes.NewReader(payload[:footer]))
+	valueType, err := d.readByte()
+	if err != nil {
+		return resp.StoreValue{}, fmt.Errorf("Bad data format")
+	}
+	value, err := decodeStoreValue(ValueEncoding(valueType), d)
+	if err != nil || !d.atEnd() {
+		return resp.StoreValue{}, fmt.Errorf("Bad data format")
+	}
+	return value, nil
+}
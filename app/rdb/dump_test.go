@@ -0,0 +1,84 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	for key, value := range roundTripDatabases()[0] {
+		t.Run(key, func(t *testing.T) {
+			payload, err := DumpValue(value)
+			if err != nil {
+				t.Fatalf("DumpValue: %v", err)
+			}
+			got, err := RestoreValue(payload)
+			if err != nil {
+				t.Fatalf("RestoreValue: %v", err)
+			}
+			// The expiry is not part of the payload.
+			value.ExpireAt = got.ExpireAt
+			assertValue(t, key, got, value)
+		})
+	}
+}
+
+func TestDumpFormat(t *testing.T) {
+	payload, err := DumpValue(str("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value type, the string, then the RDB version and the checksum.
+	want := []byte{0x00, 0x05, 'h', 'e', 'l', 'l', 'o', RDB_VERSION, 0x00}
+	if string(payload[:len(want)]) != string(want) || len(payload) != len(want)+8 {
+		t.Errorf("DumpValue = %x, want %x followed by a checksum", payload, want)
+	}
+
+	// An integer is dumped in its integer encoding.
+	payload, err = DumpValue(str("-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload[1] != 0xC0 || payload[2] != 0xFE {
+		t.Errorf("DumpValue(-2) = %x, want an 8 bit integer encoding", payload)
+	}
+}
+
+func TestRestoreRejectsCorruptPayloads(t *testing.T) {
+	payload, err := DumpValue(obj(set("a", "b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte(nil), payload...)
+	corrupt[3] ^= 0xFF
+	if _, err := RestoreValue(corrupt); err == nil {
+		t.Errorf("RestoreValue accepted a payload with a wrong checksum")
+	}
+
+	unchecked := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint64(unchecked[len(unchecked)-8:], 0)
+	if _, err := RestoreValue(unchecked); err == nil {
+		t.Errorf("RestoreValue accepted a payload without a checksum")
+	}
+
+	newer := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], RDB_VERSION+1)
+	if _, err := RestoreValue(newer); err == nil {
+		t.Errorf("RestoreValue accepted a payload of a newer RDB version")
+	}
+
+	if _, err := RestoreValue(payload[:5]); err == nil {
+		t.Errorf("RestoreValue accepted a truncated payload")
+	}
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// DUMP of the string "10" by a Redis server writing RDB version 6.
+	payload := []byte("\x00\xc0\x0a\x06\x00\xf8\x72\x3f\xc5\xfb\xfb\x5f\x28")
+	got, err := RestoreValue(payload)
+	if err != nil {
+		t.Fatalf("RestoreValue: %v", err)
+	}
+	assertValue(t, "payload", got, str("10"))
+}
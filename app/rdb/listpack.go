@@ -0,0 +1,349 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Redis stores small lists, sets, hashes and sorted sets, and the nodes of
+// quicklists and streams, as a single string holding a compact encoding of
+// their elements: a listpack, or before Redis 7 a ziplist, a zipmap for
+// hashes and an intset for sets of integers. Integers are returned in their
+// decimal representation, as Redis does.
+
+// listpackEntries returns the elements of a listpack: its total size and
+// number of elements, then the elements, each an encoding byte, its data
+// and the size of both for backward iteration, then 0xFF.
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < 7 || int(binary.LittleEndian.Uint32(lp)) != len(lp) {
+		return nil, fmt.Errorf("invalid listpack size")
+	}
+	var entries []string
+	p := lp[6:]
+	for {
+		if len(p) == 0 {
+			return nil, fmt.Errorf("unterminated listpack")
+		}
+		b := p[0]
+		if b == 0xFF {
+			break
+		}
+		// The number of bytes of the encoding, and of the string data.
+		header, length := 1, 0
+		var value int64
+		switch {
+		case b&0x80 == 0:
+			value = int64(b & 0x7F)
+		case b&0xC0 == 0x80:
+			length = int(b & 0x3F)
+		case b&0xE0 == 0xC0:
+			header = 2
+		case b&0xF0 == 0xE0:
+			header = 2
+		case b == 0xF0:
+			header = 5
+		case b == 0xF1:
+			header = 3
+		case b == 0xF2:
+			header = 4
+		case b == 0xF3:
+			header = 5
+		case b == 0xF4:
+			header = 9
+		default:
+			return nil, fmt.Errorf("invalid listpack encoding: %d", b)
+		}
+		if len(p) < header {
+			return nil, fmt.Errorf("truncated listpack")
+		}
+		switch {
+		case b&0xE0 == 0xC0:
+			// A 13 bits signed integer.
+			value = int64(int16(uint16(b&0x1F)<<8|uint16(p[1])) << 3 >> 3)
+		case b&0xF0 == 0xE0:
+			length = int(b&0x0F)<<8 | int(p[1])
+		case b == 0xF0:
+			length = int(binary.LittleEndian.Uint32(p[1:]))
+		case b == 0xF1:
+			value = int64(int16(binary.LittleEndian.Uint16(p[1:])))
+		case b == 0xF2:
+			value = int64(int32(uint32(p[1])|uint32(p[2])<<8|uint32(p[3])<<16) << 8 >> 8)
+		case b == 0xF3:
+			value = int64(int32(binary.LittleEndian.Uint32(p[1:])))
+		case b == 0xF4:
+			value = int64(binary.LittleEndian.Uint64(p[1:]))
+		}
+
+		size := header + length
+		if length < 0 || size > len(p) {
+			return nil, fmt.Errorf("truncated listpack")
+		}
+		if b&0xC0 == 0x80 || b&0xF0 == 0xE0 || b == 0xF0 {
+			entries = append(entries, string(p[header:size]))
+		} else {
+			entries = append(entries, strconv.FormatInt(value, 10))
+		}
+		size += listpackBacklenSize(size)
+		if size > len(p) {
+			return nil, fmt.Errorf("truncated listpack")
+		}
+		p = p[size:]
+	}
+	return entries, nil
+}
+
+// listpackBacklenSize returns the number of bytes the size of an element is
+// stored on, 7 bits per byte.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// encodeListpack builds a listpack of items, storing the ones that are the
+// decimal representation of an integer as integers, as Redis does.
+func encodeListpack(items []string) []byte {
+	lp := make([]byte, 6)
+	for _, item := range items {
+		start := len(lp)
+		if value, err := strconv.ParseInt(item, 10, 64); err == nil && strconv.FormatInt(value, 10) == item {
+			switch {
+			case value >= 0 && value <= 127:
+				lp = append(lp, byte(value))
+			case value >= -4096 && value < 4096:
+				lp = append(lp, 0xC0|byte(uint16(value)>>8&0x1F), byte(value))
+			case value >= -1<<15 && value < 1<<15:
+				lp = append(lp, 0xF1)
+				lp = binary.LittleEndian.AppendUint16(lp, uint16(value))
+			case value >= -1<<23 && value < 1<<23:
+				lp = append(lp, 0xF2, byte(value), byte(value>>8), byte(value>>16))
+			case value >= -1<<31 && value < 1<<31:
+				lp = append(lp, 0xF3)
+				lp = binary.LittleEndian.AppendUint32(lp, uint32(value))
+			default:
+				lp = append(lp, 0xF4)
+				lp = binary.LittleEndian.AppendUint64(lp, uint64(value))
+			}
+		} else {
+			switch n := len(item); {
+			case n < 64:
+				lp = append(lp, 0x80|byte(n))
+			case n < 4096:
+				lp = append(lp, 0xE0|byte(n>>8), byte(n))
+			default:
+				lp = append(lp, 0xF0)
+				lp = binary.LittleEndian.AppendUint32(lp, uint32(n))
+			}
+			lp = append(lp, item...)
+		}
+
+		// The size of the element, most significant bits first, each byte
+		// but the first flagged with the high bit.
+		size := len(lp) - start
+		n := listpackBacklenSize(size)
+		for i := n - 1; i >= 0; i-- {
+			b := byte(size >> (7 * i) & 0x7F)
+			if i < n-1 {
+				b |= 0x80
+			}
+			lp = append(lp, b)
+		}
+	}
+	lp = append(lp, 0xFF)
+
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(min(len(items), 65535)))
+	return lp
+}
+
+// ziplistEntries returns the elements of a ziplist: its total size, the
+// offset of its last element and its number of elements, then the elements,
+// each the size of the previous one, an encoding and its data, then 0xFF.
+func ziplistEntries(zl []byte) ([]string, error) {
+	if len(zl) < 11 || int(binary.LittleEndian.Uint32(zl)) != len(zl) {
+		return nil, fmt.Errorf("invalid ziplist size")
+	}
+	var entries []string
+	p := zl[10:]
+	for {
+		if len(p) == 0 {
+			return nil, fmt.Errorf("unterminated ziplist")
+		}
+		if p[0] == 0xFF {
+			break
+		}
+		prevlen := 1
+		if p[0] == 0xFE {
+			prevlen = 5
+		}
+		if len(p) < prevlen+1 {
+			return nil, fmt.Errorf("truncated ziplist")
+		}
+		p = p[prevlen:]
+
+		b := p[0]
+		// The number of bytes of the encoding and of the data, and whether
+		// the data is a string.
+		header, length, isString := 1, 0, true
+		switch {
+		case b>>6 == 0:
+			length = int(b & 0x3F)
+		case b>>6 == 1:
+			header = 2
+		case b>>6 == 2:
+			header = 5
+		default:
+			isString = false
+			switch {
+			case b == 0xC0:
+				length = 2
+			case b == 0xD0:
+				length = 4
+			case b == 0xE0:
+				length = 8
+			case b == 0xF0:
+				length = 3
+			case b == 0xFE:
+				length = 1
+			case b >= 0xF1 && b <= 0xFD:
+			default:
+				return nil, fmt.Errorf("invalid ziplist encoding: %d", b)
+			}
+		}
+		if len(p) < header {
+			return nil, fmt.Errorf("truncated ziplist")
+		}
+		switch header {
+		case 2:
+			length = int(b&0x3F)<<8 | int(p[1])
+		case 5:
+			length = int(binary.BigEndian.Uint32(p[1:]))
+		}
+		size := header + length
+		if length < 0 || size > len(p) {
+			return nil, fmt.Errorf("truncated ziplist")
+		}
+		data := p[header:size]
+		p = p[size:]
+
+		if isString {
+			entries = append(entries, string(data))
+			continue
+		}
+		var value int64
+		switch b {
+		case 0xC0:
+			value = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 0xD0:
+			value = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 0xE0:
+			value = int64(binary.LittleEndian.Uint64(data))
+		case 0xF0:
+			value = int64(int32(uint32(data[0])|uint32(data[1])<<8|uint32(data[2])<<16) << 8 >> 8)
+		case 0xFE:
+			value = int64(int8(data[0]))
+		default:
+			// An immediate integer from 0 to 12.
+			value = int64(b&0x0F) - 1
+		}
+		entries = append(entries, strconv.FormatInt(value, 10))
+	}
+	return entries, nil
+}
+
+// zipmapEntries returns the fields and values of a zipmap: its number of
+// fields, then each field and value preceded by its length, values also by
+// a number of unused bytes following them, then 0xFF.
+func zipmapEntries(zm []byte) ([]string, error) {
+	if len(zm) == 0 {
+		return nil, fmt.Errorf("invalid zipmap size")
+	}
+	var entries []string
+	p := zm[1:]
+	next := func(value bool) (string, error) {
+		if len(p) == 0 {
+			return "", fmt.Errorf("truncated zipmap")
+		}
+		length := int(p[0])
+		p = p[1:]
+		if length == 254 {
+			if len(p) < 4 {
+				return "", fmt.Errorf("truncated zipmap")
+			}
+			length = int(binary.LittleEndian.Uint32(p))
+			p = p[4:]
+		} else if length == 255 {
+			return "", fmt.Errorf("invalid zipmap length")
+		}
+		free := 0
+		if value {
+			if len(p) == 0 {
+				return "", fmt.Errorf("truncated zipmap")
+			}
+			free = int(p[0])
+			p = p[1:]
+		}
+		if length < 0 || length+free > len(p) {
+			return "", fmt.Errorf("truncated zipmap")
+		}
+		s := string(p[:length])
+		p = p[length+free:]
+		return s, nil
+	}
+	for {
+		if len(p) == 0 {
+			return nil, fmt.Errorf("unterminated zipmap")
+		}
+		if p[0] == 0xFF {
+			break
+		}
+		field, err := next(false)
+		if err != nil {
+			return nil, err
+		}
+		value, err := next(true)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, field, value)
+	}
+	return entries, nil
+}
+
+// intsetEntries returns the members of an intset: the size of its integers,
+// 2, 4 or 8 bytes, and their number, then the sorted integers, all little
+// endian.
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, fmt.Errorf("invalid intset size")
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || n < 0 || len(is) != 8+n*width {
+		return nil, fmt.Errorf("invalid intset size")
+	}
+	entries := make([]string, 0, n)
+	for p := is[8:]; len(p) > 0; p = p[width:] {
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			value = int64(binary.LittleEndian.Uint64(p))
+		}
+		entries = append(entries, strconv.FormatInt(value, 10))
+	}
+	return entries, nil
+}
@@ -0,0 +1,65 @@
+package rdb
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListpackRoundTrip(t *testing.T) {
+	// Integers at the boundaries of each encoding, and strings of each
+	// length encoding, with sizes needing 1 to 3 bytes of backlen.
+	var items []string
+	for _, n := range []int64{0, 127, 128, -1, -4096, 4095, 4096, -32768, 32767, 32768,
+		-1 << 23, 1<<23 - 1, 1 << 23, -1 << 31, 1<<31 - 1, 1 << 31, -1 << 63, 1<<63 - 1} {
+		items = append(items, strconv.FormatInt(n, 10))
+	}
+	items = append(items, "", "a", "007", "+1", "1.5", strings.Repeat("s", 63), strings.Repeat("m", 64),
+		strings.Repeat("m", 4095), strings.Repeat("l", 4096), strings.Repeat("l", 20000))
+
+	lp := encodeListpack(items)
+	got, err := listpackEntries(lp)
+	if err != nil {
+		t.Fatalf("listpackEntries: %v", err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Errorf("listpackEntries(encodeListpack(items)) differs from items")
+	}
+}
+
+func TestListpackIntegerEncoding(t *testing.T) {
+	tests := []struct {
+		value    string
+		encoding []byte
+	}{
+		{"5", []byte{0x05}},
+		{"-1", []byte{0xDF, 0xFF}},
+		{"1000", []byte{0xC3, 0xE8}},
+		{"-5000", []byte{0xF1, 0x78, 0xEC}},
+		{"007", []byte{0x83, '0', '0', '7'}},
+	}
+	for _, tt := range tests {
+		lp := encodeListpack([]string{tt.value})
+		// The header, then the element and its 1 byte backlen, then 0xFF.
+		if element := lp[6 : len(lp)-2]; string(element) != string(tt.encoding) {
+			t.Errorf("encodeListpack(%q) element = %x, want %x", tt.value, element, tt.encoding)
+		}
+	}
+}
+
+func TestCorruptEncodings(t *testing.T) {
+	lp := encodeListpack([]string{"a", "b"})
+	if _, err := listpackEntries(lp[:len(lp)-1]); err == nil {
+		t.Errorf("listpackEntries accepted a listpack of the wrong size")
+	}
+	if _, err := intsetEntries([]byte{3, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0}); err == nil {
+		t.Errorf("intsetEntries accepted an invalid width")
+	}
+	if _, err := zipmapEntries([]byte{1, 5, 'a'}); err == nil {
+		t.Errorf("zipmapEntries accepted a truncated field")
+	}
+	if _, err := ziplistEntries([]byte{11, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Errorf("ziplistEntries accepted an unterminated ziplist")
+	}
+}
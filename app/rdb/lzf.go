@@ -0,0 +1,116 @@
+package rdb
+
+import "fmt"
+
+// LZF is the compression Redis applies to strings in RDB files when
+// rdbcompression is enabled. The compressed data is a sequence of chunks,
+// each starting with a control byte:
+//
+//	000LLLLL                    a literal run of L+1 bytes follows
+//	LLLooooo oooooooo           a back reference of L+2 bytes, at offset o+1
+//	111ooooo LLLLLLLL oooooooo  a back reference of L+9 bytes, at offset o+1
+const (
+	lzfHashLog   = 14
+	lzfMaxLit    = 1 << 5
+	lzfMaxOff    = 1 << 13
+	lzfMaxRef    = 1<<8 + 1<<3
+	lzfMinLength = 20
+)
+
+// lzfDecompress decompresses in, which must expand to exactly length bytes.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	// A 3-byte back reference expands the most, to lzfMaxRef bytes.
+	if length > len(in)*lzfMaxRef {
+		return nil, fmt.Errorf("LZF data cannot expand to %d bytes", length)
+	}
+	out := make([]byte, 0, length)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			run := ctrl + 1
+			if ip+run > len(in) || len(out)+run > length {
+				return nil, fmt.Errorf("invalid LZF literal run")
+			}
+			out = append(out, in[ip:ip+run]...)
+			ip += run
+			continue
+		}
+
+		run := ctrl >> 5
+		if run == 7 {
+			if ip >= len(in) {
+				return nil, fmt.Errorf("invalid LZF back reference")
+			}
+			run += int(in[ip])
+			ip++
+		}
+		run += 2
+		if ip >= len(in) {
+			return nil, fmt.Errorf("invalid LZF back reference")
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 || len(out)+run > length {
+			return nil, fmt.Errorf("invalid LZF back reference")
+		}
+		// The reference may overlap the bytes it produces, so it is copied
+		// one byte at a time.
+		for i := 0; i < run; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != length {
+		return nil, fmt.Errorf("LZF data expands to %d bytes instead of %d", len(out), length)
+	}
+	return out, nil
+}
+
+// lzfCompress compresses in, or returns nil when that does not make it
+// shorter.
+func lzfCompress(in []byte) []byte {
+	var table [1 << lzfHashLog]int
+	out := make([]byte, 0, len(in))
+
+	literal := 0
+	flushLiterals := func(end int) {
+		for literal < end {
+			run := min(end-literal, lzfMaxLit)
+			out = append(out, byte(run-1))
+			out = append(out, in[literal:literal+run]...)
+			literal += run
+		}
+	}
+
+	for ip := 0; ip+2 < len(in); {
+		hash := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashLog)
+		// Positions are stored plus one, so that 0 is an empty slot.
+		ref := table[hash] - 1
+		table[hash] = ip + 1
+		offset := ip - ref - 1
+		if ref < 0 || offset >= lzfMaxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			ip++
+			continue
+		}
+
+		length := 3
+		for length < lzfMaxRef && ip+length < len(in) && in[ref+length] == in[ip+length] {
+			length++
+		}
+		flushLiterals(ip)
+		if run := length - 2; run < 7 {
+			out = append(out, byte(run<<5|offset>>8))
+		} else {
+			out = append(out, byte(7<<5|offset>>8), byte(run-7))
+		}
+		out = append(out, byte(offset))
+		ip += length
+		literal = ip
+	}
+	flushLiterals(len(in))
+
+	if len(out) >= len(in) {
+		return nil
+	}
+	return out
+}
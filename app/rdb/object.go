@@ -0,0 +1,664 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Flags of the entries of a stream node.
+const (
+	streamItemDeleted    = 1 << 0
+	streamItemSameFields = 1 << 1
+	// streamNodeMaxEntries is the number of entries per node when writing a
+	// stream, Redis' default stream-node-max-entries.
+	streamNodeMaxEntries = 100
+)
+
+// Containers of the nodes of a quicklist 2: a single element stored as is,
+// or a listpack of elements.
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// decodeObject decodes the value of a key holding another type than a
+// string, stored with the given RDB value type.
+func decodeObject(valueType ValueEncoding, d *decoder) (resp.Object, error) {
+	switch valueType {
+	case ListEncoding:
+		items, err := decodeStrings(d, 1)
+		return resp.List(items), err
+	case SetEncoding:
+		items, err := decodeStrings(d, 1)
+		return newSet(items), err
+	case HashEncoding:
+		items, err := decodeStrings(d, 2)
+		if err != nil {
+			return nil, err
+		}
+		return newHash(items)
+	case SortedSetEncoding, SortedSet2Encoding:
+		n, err := decodeLength(d)
+		if err != nil {
+			return nil, err
+		}
+		zset := make(resp.SortedSet, 0, min(n, preallocLimit))
+		for range n {
+			member, err := decodeString(d)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if valueType == SortedSetEncoding {
+				score, err = decodeStringDouble(d)
+			} else {
+				score, err = decodeBinaryDouble(d)
+			}
+			if err != nil {
+				return nil, err
+			}
+			zset = append(zset, resp.SortedSetMember{Member: member, Score: score})
+		}
+		return newSortedSet(zset), nil
+	case ModuleEncoding, Module2Encoding:
+		return nil, fmt.Errorf("module values are not supported")
+	case StreamListpacksEncoding, StreamListpacks2Encoding, StreamListpacks3Encoding:
+		return decodeStream(valueType, d)
+	case ListQuicklistEncoding, ListQuicklist2Encoding:
+		nodes, err := decodeLength(d)
+		if err != nil {
+			return nil, err
+		}
+		var list resp.List
+		for range nodes {
+			container := quicklistNodePacked
+			if valueType == ListQuicklist2Encoding {
+				if container, err = decodeLength(d); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := decodeString(d)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case container == quicklistNodePlain:
+				list = append(list, blob)
+				continue
+			case container != quicklistNodePacked:
+				return nil, fmt.Errorf("invalid quicklist node container: %d", container)
+			}
+			var items []string
+			if valueType == ListQuicklistEncoding {
+				items, err = ziplistEntries([]byte(blob))
+			} else {
+				items, err = listpackEntries([]byte(blob))
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, items...)
+		}
+		return list, nil
+	}
+
+	// The other encodings hold a single blob: a zipmap, ziplist, intset or
+	// listpack.
+	blob, err := decodeString(d)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	switch valueType {
+	case HashZipmapEncoding:
+		items, err = zipmapEntries([]byte(blob))
+	case SetIntsetEncoding:
+		items, err = intsetEntries([]byte(blob))
+	case ListZiplistEncoding, SortedSetZiplistEncoding, HashZiplistEncoding:
+		items, err = ziplistEntries([]byte(blob))
+	case SetListpackEncoding, SortedSetListpackEncoding, HashListpackEncoding:
+		items, err = listpackEntries([]byte(blob))
+	default:
+		return nil, fmt.Errorf("invalid value type: %v", valueType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch valueType {
+	case ListZiplistEncoding:
+		return resp.List(items), nil
+	case SetIntsetEncoding, SetListpackEncoding:
+		return newSet(items), nil
+	case HashZipmapEncoding, HashZiplistEncoding, HashListpackEncoding:
+		return newHash(items)
+	default:
+		if len(items)%2 != 0 {
+			return nil, fmt.Errorf("odd number of sorted set elements")
+		}
+		zset := make(resp.SortedSet, 0, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			score, err := strconv.ParseFloat(items[i+1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sorted set score: %q", items[i+1])
+			}
+			zset = append(zset, resp.SortedSetMember{Member: items[i], Score: score})
+		}
+		return newSortedSet(zset), nil
+	}
+}
+
+// encodeObject encodes the value of a key holding another type than a
+// string, in the simplest RDB value type of each: Redis reads them all and
+// converts them to its own encodings.
+func encodeObject(object resp.Object, compress bool) (ValueEncoding, []byte, error) {
+	var buf bytes.Buffer
+	writeString := func(s string) error {
+		encoded, err := encodeStringCompressed(s, compress)
+		buf.Write(encoded)
+		return err
+	}
+
+	switch object := object.(type) {
+	case resp.List:
+		buf.Write(encodeLength64(uint64(len(object))))
+		for _, item := range object {
+			if err := writeString(item); err != nil {
+				return 0, nil, err
+			}
+		}
+		return ListEncoding, buf.Bytes(), nil
+	case resp.Set:
+		buf.Write(encodeLength64(uint64(len(object))))
+		for _, member := range sortedKeys(object) {
+			if err := writeString(member); err != nil {
+				return 0, nil, err
+			}
+		}
+		return SetEncoding, buf.Bytes(), nil
+	case resp.Hash:
+		buf.Write(encodeLength64(uint64(len(object))))
+		for _, field := range sortedKeys(object) {
+			if err := writeString(field); err != nil {
+				return 0, nil, err
+			}
+			if err := writeString(object[field]); err != nil {
+				return 0, nil, err
+			}
+		}
+		return HashEncoding, buf.Bytes(), nil
+	case resp.SortedSet:
+		buf.Write(encodeLength64(uint64(len(object))))
+		for _, member := range object {
+			if err := writeString(member.Member); err != nil {
+				return 0, nil, err
+			}
+			binary.Write(&buf, binary.LittleEndian, math.Float64bits(member.Score))
+		}
+		return SortedSet2Encoding, buf.Bytes(), nil
+	case *resp.Stream:
+		if err := encodeStream(&buf, object, writeString); err != nil {
+			return 0, nil, err
+		}
+		return StreamListpacks3Encoding, buf.Bytes(), nil
+	default:
+		return 0, nil, fmt.Errorf("unknown object type: %T", object)
+	}
+}
+
+// decodeStrings decodes a length followed by that many groups of size
+// strings.
+func decodeStrings(d *decoder, size int) ([]string, error) {
+	n, err := decodeLength(d)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, min(n*size, preallocLimit))
+	for range n * size {
+		item, err := decodeString(d)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func newSet(members []string) resp.Set {
+	set := make(resp.Set, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return set
+}
+
+func newHash(items []string) (resp.Hash, error) {
+	if len(items)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hash elements")
+	}
+	hash := make(resp.Hash, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		hash[items[i]] = items[i+1]
+	}
+	return hash, nil
+}
+
+func newSortedSet(zset resp.SortedSet) resp.SortedSet {
+	sort.Slice(zset, func(i, j int) bool {
+		if zset[i].Score != zset[j].Score {
+			return zset[i].Score < zset[j].Score
+		}
+		return zset[i].Member < zset[j].Member
+	})
+	return zset
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeStringDouble decodes a score of the original sorted set type: its
+// length on one byte, 253 to 255 standing for NaN, +inf and -inf, followed
+// by its decimal representation.
+func decodeStringDouble(d *decoder) (float64, error) {
+	length, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	data, err := d.readBytes(int(length))
+	if err != nil {
+		return 0, fmt.Errorf("truncated double")
+	}
+	value, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid double: %v", err)
+	}
+	return value, nil
+}
+
+func decodeBinaryDouble(d *decoder) (float64, error) {
+	data, err := d.readBytes(8)
+	if err != nil {
+		return 0, fmt.Errorf("truncated double")
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+}
+
+// decodeMillisecondTime decodes a Unix time in milliseconds, little endian.
+func decodeMillisecondTime(d *decoder) (int64, error) {
+	data, err := d.readBytes(8)
+	if err != nil {
+		return 0, fmt.Errorf("truncated time")
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// decodeStreamID decodes an ID stored as 16 raw bytes, big endian.
+func decodeStreamID(data []byte) resp.StreamID {
+	return resp.StreamID{Ms: binary.BigEndian.Uint64(data), Seq: binary.BigEndian.Uint64(data[8:])}
+}
+
+func encodeStreamID(id resp.StreamID) []byte {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, id.Ms)
+	binary.BigEndian.PutUint64(raw[8:], id.Seq)
+	return raw
+}
+
+// decodeLengthID decodes an ID stored as two lengths.
+func decodeLengthID(d *decoder) (resp.StreamID, error) {
+	ms, err := decodeLength64(d)
+	if err != nil {
+		return resp.StreamID{}, err
+	}
+	seq, err := decodeLength64(d)
+	if err != nil {
+		return resp.StreamID{}, err
+	}
+	return resp.StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// decodeStream decodes a stream: its entries, in listpacks keyed by the ID
+// their entries are relative to, then its metadata and consumer groups.
+// Versions 2 and 3 add the metadata tracking the history of the stream and
+// the active time of consumers.
+func decodeStream(valueType ValueEncoding, d *decoder) (*resp.Stream, error) {
+	stream := &resp.Stream{}
+	nodes, err := decodeLength(d)
+	if err != nil {
+		return nil, err
+	}
+	for range nodes {
+		nodeKey, err := decodeString(d)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeKey) != 16 {
+			return nil, fmt.Errorf("invalid stream node key length: %d", len(nodeKey))
+		}
+		master := decodeStreamID([]byte(nodeKey))
+		blob, err := decodeString(d)
+		if err != nil {
+			return nil, err
+		}
+		items, err := listpackEntries([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamNode(master, items)
+		if err != nil {
+			return nil, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	length, err := decodeLength64(d)
+	if err != nil {
+		return nil, err
+	}
+	if stream.LastID, err = decodeLengthID(d); err != nil {
+		return nil, err
+	}
+	if valueType >= StreamListpacks2Encoding {
+		if stream.FirstID, err = decodeLengthID(d); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedID, err = decodeLengthID(d); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, err = decodeLength64(d); err != nil {
+			return nil, err
+		}
+	} else {
+		// Older streams did not track their history: assume nothing was
+		// ever deleted.
+		stream.EntriesAdded = length
+		if len(stream.Entries) > 0 {
+			stream.FirstID = stream.Entries[0].ID
+		}
+	}
+
+	groups, err := decodeLength(d)
+	if err != nil {
+		return nil, err
+	}
+	for range groups {
+		group := resp.StreamGroup{EntriesRead: -1}
+		if group.Name, err = decodeString(d); err != nil {
+			return nil, err
+		}
+		if group.LastID, err = decodeLengthID(d); err != nil {
+			return nil, err
+		}
+		if valueType >= StreamListpacks2Encoding {
+			entriesRead, err := decodeLength64(d)
+			if err != nil {
+				return nil, err
+			}
+			group.EntriesRead = int64(entriesRead)
+		}
+
+		pending, err := decodeLength(d)
+		if err != nil {
+			return nil, err
+		}
+		for range pending {
+			raw, err := d.readBytes(16)
+			if err != nil {
+				return nil, fmt.Errorf("truncated stream ID")
+			}
+			id := decodeStreamID(raw)
+			entry := resp.StreamPendingEntry{ID: id}
+			if entry.DeliveryTime, err = decodeMillisecondTime(d); err != nil {
+				return nil, err
+			}
+			if entry.DeliveryCount, err = decodeLength64(d); err != nil {
+				return nil, err
+			}
+			group.Pending = append(group.Pending, entry)
+		}
+
+		consumers, err := decodeLength(d)
+		if err != nil {
+			return nil, err
+		}
+		for range consumers {
+			var consumer resp.StreamConsumer
+			if consumer.Name, err = decodeString(d); err != nil {
+				return nil, err
+			}
+			if consumer.SeenTime, err = decodeMillisecondTime(d); err != nil {
+				return nil, err
+			}
+			// Before version 3, the last interaction is the best estimate.
+			consumer.ActiveTime = consumer.SeenTime
+			if valueType >= StreamListpacks3Encoding {
+				if consumer.ActiveTime, err = decodeMillisecondTime(d); err != nil {
+					return nil, err
+				}
+			}
+			pending, err := decodeLength(d)
+			if err != nil {
+				return nil, err
+			}
+			for range pending {
+				raw, err := d.readBytes(16)
+				if err != nil {
+					return nil, fmt.Errorf("truncated stream ID")
+				}
+				id := decodeStreamID(raw)
+				consumer.Pending = append(consumer.Pending, id)
+			}
+			group.Consumers = append(group.Consumers, consumer)
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream, nil
+}
+
+// decodeStreamNode decodes the entries of a stream node, relative to the
+// master ID of the node. The listpack starts with a master entry: the count
+// of valid and deleted entries, then the master fields, which the entries
+// flagged with the same fields omit. Each entry ends with its number of
+// elements, for backward iteration.
+func decodeStreamNode(master resp.StreamID, items []string) ([]resp.StreamEntry, error) {
+	i := 0
+	next := func() (string, error) {
+		if i >= len(items) {
+			return "", fmt.Errorf("truncated stream node")
+		}
+		i++
+		return items[i-1], nil
+	}
+	nextInt := func() (int64, error) {
+		item, err := next()
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid stream node integer: %q", item)
+		}
+		return value, nil
+	}
+
+	// The count of valid and deleted entries.
+	for range 2 {
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+	}
+	masterFieldCount, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	if masterFieldCount < 0 || masterFieldCount > int64(len(items)) {
+		return nil, fmt.Errorf("invalid stream node master fields")
+	}
+	masterFields := make([]string, masterFieldCount)
+	for j := range masterFields {
+		if masterFields[j], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	// The master entry terminator.
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+
+	var entries []resp.StreamEntry
+	for i < len(items) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := resp.StreamEntry{ID: resp.StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}}
+		if flags&streamItemSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, field, value)
+			}
+		} else {
+			fieldCount, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			if fieldCount < 0 || fieldCount > int64(len(items)) {
+				return nil, fmt.Errorf("invalid stream entry fields")
+			}
+			for range fieldCount * 2 {
+				item, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, item)
+			}
+		}
+		// The number of elements of the entry.
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// encodeStream encodes a stream in the version 3 format, in nodes of up to
+// streamNodeMaxEntries entries whose master fields are the ones of their
+// first entry.
+func encodeStream(buf *bytes.Buffer, stream *resp.Stream, writeString func(string) error) error {
+	nodes := (len(stream.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	buf.Write(encodeLength64(uint64(nodes)))
+	for start := 0; start < len(stream.Entries); start += streamNodeMaxEntries {
+		entries := stream.Entries[start:min(start+streamNodeMaxEntries, len(stream.Entries))]
+		master := entries[0].ID
+		var masterFields []string
+		for j := 0; j < len(entries[0].Fields); j += 2 {
+			masterFields = append(masterFields, entries[0].Fields[j])
+		}
+
+		items := []string{strconv.Itoa(len(entries)), "0", strconv.Itoa(len(masterFields))}
+		items = append(items, masterFields...)
+		items = append(items, "0")
+		for _, entry := range entries {
+			var fields []string
+			sameFields := len(entry.Fields) == 2*len(masterFields)
+			for j := 0; j < len(entry.Fields); j += 2 {
+				fields = append(fields, entry.Fields[j])
+				sameFields = sameFields && entry.Fields[j] == masterFields[j/2]
+			}
+			flags := 0
+			if sameFields {
+				flags = streamItemSameFields
+			}
+			items = append(items,
+				strconv.Itoa(flags),
+				strconv.FormatInt(int64(entry.ID.Ms-master.Ms), 10),
+				strconv.FormatInt(int64(entry.ID.Seq-master.Seq), 10))
+			if sameFields {
+				for j := 1; j < len(entry.Fields); j += 2 {
+					items = append(items, entry.Fields[j])
+				}
+				items = append(items, strconv.Itoa(len(fields)+3))
+			} else {
+				items = append(items, strconv.Itoa(len(fields)))
+				items = append(items, entry.Fields...)
+				items = append(items, strconv.Itoa(2*len(fields)+4))
+			}
+		}
+
+		if err := writeString(string(encodeStreamID(master))); err != nil {
+			return err
+		}
+		if err := writeString(string(encodeListpack(items))); err != nil {
+			return err
+		}
+	}
+
+	buf.Write(encodeLength64(uint64(len(stream.Entries))))
+	for _, id := range []resp.StreamID{stream.LastID, stream.FirstID, stream.MaxDeletedID} {
+		buf.Write(encodeLength64(id.Ms))
+		buf.Write(encodeLength64(id.Seq))
+	}
+	buf.Write(encodeLength64(stream.EntriesAdded))
+
+	buf.Write(encodeLength64(uint64(len(stream.Groups))))
+	for _, group := range stream.Groups {
+		if err := writeString(group.Name); err != nil {
+			return err
+		}
+		buf.Write(encodeLength64(group.LastID.Ms))
+		buf.Write(encodeLength64(group.LastID.Seq))
+		buf.Write(encodeLength64(uint64(group.EntriesRead)))
+		buf.Write(encodeLength64(uint64(len(group.Pending))))
+		for _, entry := range group.Pending {
+			buf.Write(encodeStreamID(entry.ID))
+			binary.Write(buf, binary.LittleEndian, entry.DeliveryTime)
+			buf.Write(encodeLength64(entry.DeliveryCount))
+		}
+		buf.Write(encodeLength64(uint64(len(group.Consumers))))
+		for _, consumer := range group.Consumers {
+			if err := writeString(consumer.Name); err != nil {
+				return err
+			}
+			binary.Write(buf, binary.LittleEndian, consumer.SeenTime)
+			binary.Write(buf, binary.LittleEndian, consumer.ActiveTime)
+			buf.Write(encodeLength64(uint64(len(consumer.Pending))))
+			for _, id := range consumer.Pending {
+				buf.Write(encodeStreamID(id))
+			}
+		}
+	}
+	return nil
+}
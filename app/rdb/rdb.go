@@ -1,10 +1,12 @@
 package rdb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -16,50 +18,165 @@ import (
 
 const REDIS_VERSION = "REDIS0011"
 
+// Opcodes of the RDB format, introducing the sections of the file and the
+// data attached to the next key.
+const (
+	opcodeFunction2     = 0xF5
+	opcodeFunctionPreGA = 0xF6
+	opcodeModuleAux     = 0xF7
+	opcodeIdle          = 0xF8
+	opcodeFreq          = 0xF9
+	opcodeAux           = 0xFA
+	opcodeResizeDB      = 0xFB
+	opcodeExpireTimeMs  = 0xFC
+	opcodeExpireTime    = 0xFD
+	opcodeSelectDB      = 0xFE
+	opcodeEOF           = 0xFF
+)
+
+// Types of the values in the auxiliary data of modules.
+const (
+	moduleOpcodeEOF    = 0
+	moduleOpcodeSint   = 1
+	moduleOpcodeUint   = 2
+	moduleOpcodeFloat  = 3
+	moduleOpcodeDouble = 4
+	moduleOpcodeString = 5
+)
+
 type ValueEncoding uint8
 
+// Value types of the RDB format, each a Redis type in one of its encodings.
 const (
-	StringEncoding ValueEncoding = iota
-	ListEncoding
-	SetEncoding
-	SortedSetEncoding
-	HashEncoding
-	ZipmapEncoding
-	ZiplistEncoding
-	IntsetEncoding
-	SortedSetInZiplistEncoding
-	HashmapInZiplistEncoding
-	ListInQuicklistEncoding
+	StringEncoding            ValueEncoding = 0
+	ListEncoding              ValueEncoding = 1
+	SetEncoding               ValueEncoding = 2
+	SortedSetEncoding         ValueEncoding = 3
+	HashEncoding              ValueEncoding = 4
+	SortedSet2Encoding        ValueEncoding = 5
+	ModuleEncoding            ValueEncoding = 6
+	Module2Encoding           ValueEncoding = 7
+	HashZipmapEncoding        ValueEncoding = 9
+	ListZiplistEncoding       ValueEncoding = 10
+	SetIntsetEncoding         ValueEncoding = 11
+	SortedSetZiplistEncoding  ValueEncoding = 12
+	HashZiplistEncoding       ValueEncoding = 13
+	ListQuicklistEncoding     ValueEncoding = 14
+	StreamListpacksEncoding   ValueEncoding = 15
+	HashListpackEncoding      ValueEncoding = 16
+	SortedSetListpackEncoding ValueEncoding = 17
+	ListQuicklist2Encoding    ValueEncoding = 18
+	StreamListpacks2Encoding  ValueEncoding = 19
+	SetListpackEncoding       ValueEncoding = 20
+	StreamListpacks3Encoding  ValueEncoding = 21
 )
 
-func Save(dir string, dbfilename string, metadata map[string]string, databases map[uint8]resp.Database) error {
+// Path returns the location of the RDB file, applying the defaults for an
+// empty dir or dbfilename.
+func Path(dir string, dbfilename string) string {
 	if dir == "" {
 		dir = "./"
 	}
 	if dbfilename == "" {
 		dbfilename = "dump.rdb"
 	}
+	return filepath.Join(dir, dbfilename)
+}
 
-	filePath := filepath.Join(dir, dbfilename)
-	file, err := os.Create(filePath)
+// Save writes the databases to the RDB file. The snapshot is written to a
+// temporary file in the same directory, synced, then renamed over the RDB
+// file, so that a crash never leaves a partial file in place of the previous
+// snapshot.
+func Save(dir string, dbfilename string, metadata map[string]string, databases map[uint8]resp.Database) error {
+	filePath := Path(dir, dbfilename)
+	file, err := os.CreateTemp(filepath.Dir(filePath), fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
 	if err != nil {
 		return fmt.Errorf("error creating file: %v", err)
 	}
-	defer file.Close()
+	tempPath := file.Name()
+	if err = Write(file, metadata, databases); err == nil {
+		if err = file.Sync(); err != nil {
+			err = fmt.Errorf("error syncing file: %v", err)
+		}
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing file: %v", closeErr)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
 
-	buf := bytes.Buffer{}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("error renaming temp file: %v", err)
+	}
+	return syncDir(filepath.Dir(filePath))
+}
 
-	_, err = buf.Write([]byte(REDIS_VERSION))
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		return fmt.Errorf("error writing REDIS_VERSION: %v", err)
+		return fmt.Errorf("error opening directory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory: %v", err)
 	}
+	return nil
+}
 
-	// Start of Metadata Field
-	_, err = buf.Write([]byte{0xFA})
+// Encode serializes the databases into a complete RDB payload, including the
+// trailing checksum.
+func Encode(metadata map[string]string, databases map[uint8]resp.Database) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Write(&buf, metadata, databases); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// auxFields are the auxiliary fields Redis writes, in its order. Write only
+// writes these, so that the rest of metadata, e.g. the configuration, stays
+// out of the file.
+var auxFields = []string{"redis-ver", "redis-bits", "ctime", "used-mem", "repl-id", "repl-offset", "aof-base"}
+
+// Write streams the RDB serialization of the databases into w, e.g. a
+// replica connection, without building the whole payload in memory. Strings
+// are LZF compressed unless metadata sets rdbcompression to "no". Only the
+// auxFields of metadata are written: redis-ver, redis-bits and ctime default
+// to this server and the current time, the others are left out when unset.
+func Write(w io.Writer, metadata map[string]string, databases map[uint8]resp.Database) error {
+	compress := metadata["rdbcompression"] != "no"
+	bw := bufio.NewWriter(w)
+	hash := crc64.New()
+	buf := io.MultiWriter(bw, hash)
+
+	_, err := buf.Write([]byte(REDIS_VERSION))
 	if err != nil {
-		return fmt.Errorf("error writing metadata: %v", err)
+		return fmt.Errorf("error writing REDIS_VERSION: %v", err)
 	}
-	for key, value := range metadata {
+
+	// Metadata Fields
+	for _, key := range auxFields {
+		value, set := metadata[key]
+		if !set {
+			switch key {
+			case "redis-ver":
+				value = "7.2.0"
+			case "redis-bits":
+				value = strconv.Itoa(strconv.IntSize)
+			case "ctime":
+				value = strconv.FormatInt(time.Now().Unix(), 10)
+			default:
+				continue
+			}
+		}
+		_, err = buf.Write([]byte{opcodeAux})
+		if err != nil {
+			return fmt.Errorf("error writing metadata: %v", err)
+		}
 		keyBytes, err := encodeString(key)
 		if err != nil {
 			fmt.Println("Error encoding key: ", err.Error())
@@ -84,119 +201,105 @@ func Save(dir string, dbfilename string, metadata map[string]string, databases m
 
 	// Database Sections
 	for id, database := range databases {
-		_, err = buf.Write([]byte{0xFE})
+		_, err = buf.Write([]byte{opcodeSelectDB})
 		if err != nil {
 			return fmt.Errorf("error writing database section: %v", err)
 		}
-		_, err = buf.Write([]byte{id})
+		_, err = buf.Write(encodeLength64(uint64(id)))
 		if err != nil {
 			return fmt.Errorf("error writing database id: %v", err)
 		}
-		_, err = buf.Write([]byte{0xFB})
+		_, err = buf.Write([]byte{opcodeResizeDB})
 		if err != nil {
 			return fmt.Errorf("error writing database section: %v", err)
 		}
-		table_size, expiry_size := 0, 0
-		var KVbuf bytes.Buffer
+		table_size, expiry_size := len(database.Store), 0
+		for _, value := range database.Store {
+			if !value.ExpireAt.IsZero() {
+				expiry_size += 1
+			}
+		}
+
+		// Write table size
+		table_size_bytes, err := encodeLength(table_size)
+		if err != nil {
+			return fmt.Errorf("error encoding table size: %v", err)
+		}
+		if _, err = buf.Write(table_size_bytes); err != nil {
+			return fmt.Errorf("error writing table size: %v", err)
+		}
+
+		// Write expiry size
+		expiry_size_bytes, err := encodeLength(expiry_size)
+		if err != nil {
+			return fmt.Errorf("error encoding expiry size: %v", err)
+		}
+		if _, err = buf.Write(expiry_size_bytes); err != nil {
+			return fmt.Errorf("error writing expiry size: %v", err)
+		}
+
+		// Write key, values
 		for key, value := range database.Store {
 			if !value.ExpireAt.IsZero() {
 				// Write expiry marker
-				_, err := KVbuf.Write([]byte{0xFC})
+				_, err := buf.Write([]byte{opcodeExpireTimeMs})
 				if err != nil {
 					return fmt.Errorf("error writing expiry marker: %v", err)
 				}
 
-				// Write expiry time
-				expiryTime := value.ExpireAt.Unix()
-				err = binary.Write(&KVbuf, binary.LittleEndian, expiryTime)
+				// Write expiry time, in milliseconds
+				expiryTime := value.ExpireAt.UnixMilli()
+				err = binary.Write(buf, binary.LittleEndian, expiryTime)
 				if err != nil {
 					return fmt.Errorf("error writing expiry time: %v", err)
 				}
-				expiry_size += 1
 			}
 			// Write value type
-			valType, err := encodeValueType(value.Value)
+			valType, valueBytes, err := encodeStoreValue(value, compress)
 			if err != nil {
+				return fmt.Errorf("error encoding value: %v", err)
+			}
+			if _, err = buf.Write([]byte{valType}); err != nil {
 				return fmt.Errorf("error writing value type: %v", err)
 			}
-			KVbuf.WriteByte(valType)
 
 			// Write key
-			keyBytes, err := encodeString(key)
+			keyBytes, err := encodeStringCompressed(key, compress)
 			if err != nil {
 				return fmt.Errorf("error encoding key: %v", err)
 			}
-			_, err = KVbuf.Write(keyBytes)
+			_, err = buf.Write(keyBytes)
 			if err != nil {
 				return fmt.Errorf("error writing key: %v", err)
 			}
 
 			// Write value
-			valueBytes, err := encodeValue(value.Value)
-			if err != nil {
-				return fmt.Errorf("error encoding value: %v", err)
-			}
-			_, err = KVbuf.Write(valueBytes)
+			_, err = buf.Write(valueBytes)
 			if err != nil {
 				return fmt.Errorf("error writing value: %v", err)
 			}
-			table_size += 1
-		}
-
-		// Write table size
-		table_size_bytes, err := encodeLength(table_size)
-		if err != nil {
-			return fmt.Errorf("error encoding table size: %v", err)
-		}
-		if _, err = buf.Write(table_size_bytes); err != nil {
-			return fmt.Errorf("error writing table size: %v", err)
-		}
-
-		// Write expiry size
-		expiry_size_bytes, err := encodeLength(expiry_size)
-		if err != nil {
-			return fmt.Errorf("error encoding expiry size: %v", err)
-		}
-		if _, err = buf.Write(expiry_size_bytes); err != nil {
-			return fmt.Errorf("error writing expiry size: %v", err)
 		}
-
-		// Write key, values
-		_, err = buf.Write(KVbuf.Bytes())
-		if err != nil {
-			return fmt.Errorf("error writing key, values to database: %v", err)
-		}
-
 	}
 
 	// Write end of database marker
-	if _, err = buf.Write([]byte{0xFF}); err != nil {
+	if _, err = buf.Write([]byte{opcodeEOF}); err != nil {
 		return fmt.Errorf("error writing end of database: %v", err)
 	}
 
-	checksum := crc64.Digest(buf.Bytes())
 	checksumBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(checksumBytes, checksum)
+	binary.LittleEndian.PutUint64(checksumBytes, hash.Sum64())
 
-	if _, err = file.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("error writing buffer to file: %v", err)
-	}
-
-	if _, err = file.Write(checksumBytes); err != nil {
+	if _, err = bw.Write(checksumBytes); err != nil {
 		return fmt.Errorf("error writing checksum: %v", err)
 	}
+	if err = bw.Flush(); err != nil {
+		return fmt.Errorf("error flushing rdb: %v", err)
+	}
 	return nil
 }
 
 func Open(dir string, dbfilename string) (metadata map[string]string, databases map[uint8]resp.Database, err error) {
-	if dir == "" {
-		dir = "./"
-	}
-	if dbfilename == "" {
-		dbfilename = "dump.rdb"
-	}
-
-	filePath := filepath.Join(dir, dbfilename)
+	filePath := Path(dir, dbfilename)
 	// fmt.Printf("Opening file: %v\n", filePath)
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil, nil, fmt.Errorf("file does not exist: %v", filePath)
@@ -207,149 +310,244 @@ func Open(dir string, dbfilename string) (metadata map[string]string, databases
 	}
 	defer file.Close()
 
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error reading file: %v", err)
-	}
-
-	if len(fileBytes) < 8 {
-		return nil, nil, fmt.Errorf("file is too small: % X", fileBytes)
-	}
-
-	// Checksum
-	index := len(fileBytes) - 1
-	for ; index >= 0; index-- {
-		if fileBytes[index] == 0xFF {
-			break
-		}
-	}
-	checksum := crc64.Digest(fileBytes[:index+1])
-	if checksum != binary.LittleEndian.Uint64(fileBytes[index+1:]) {
-		return nil, nil, fmt.Errorf("invalid checksum: %v", checksum)
-	}
-	fileBytes = fileBytes[:index+1]
+	return Read(file)
+}
 
-	// Redis Version
-	redis_version := []byte(REDIS_VERSION)
-	if !bytes.Equal(fileBytes[:len(redis_version)], redis_version) {
-		return nil, nil, fmt.Errorf("invalid rdb version: %v", string(fileBytes[:len(redis_version)]))
-	}
-	fileBytes = fileBytes[len(redis_version):]
+// Read loads an RDB payload from r, e.g. a snapshot received over a
+// replication link, into databases.
+func Read(r io.Reader) (metadata map[string]string, databases map[uint8]resp.Database, err error) {
 	metadata = make(map[string]string)
 	databases = make(map[uint8]resp.Database)
-
-	// Metadata Section
-	for fileBytes[0] == 0xFA {
-		fileBytes = fileBytes[1:]
-		key, err := decodeString(&fileBytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("invalid metadata: %v", err)
-		}
-		value, err := decodeString(&fileBytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("invalid metadata: %v", err)
+	selectDB := func(id uint8) error {
+		if _, exists := databases[id]; !exists {
+			databases[id] = resp.NewDatabase(id)
 		}
-		metadata[key] = value
+		return nil
+	}
+	err = Parse(r, Visitor{
+		Aux: func(key string, value string) error {
+			metadata[key] = value
+			return nil
+		},
+		SelectDB: selectDB,
+		Key: func(db uint8, key string, value resp.StoreValue) error {
+			selectDB(db)
+			// Keys that expired while the file was stored are not loaded.
+			if !value.ExpireAt.IsZero() && value.ExpireAt.Before(time.Now()) {
+				return nil
+			}
+			databases[db].Store[key] = value
+			if !value.ExpireAt.IsZero() {
+				databases[db].ExpiryMap[value.ExpireAt] = key
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return metadata, databases, nil
+}
 
-	// Database Sections
-	for len(fileBytes) > 0 && (fileBytes[0] == 0xFE || fileBytes[0] == 0xFF) {
-		if fileBytes[0] == 0xFF {
-			break
-		}
-		fileBytes = fileBytes[1:]
-
-		databaseId := fileBytes[0]
-		fileBytes = fileBytes[1:]
+// Decode parses a complete RDB payload, e.g. the snapshot a master sends to
+// its replicas during a full resynchronization.
+func Decode(fileBytes []byte) (metadata map[string]string, databases map[uint8]resp.Database, err error) {
+	return Read(bytes.NewReader(fileBytes))
+}
 
-		databases[databaseId] = resp.NewDatabase(databaseId)
+// Visitor receives the contents of an RDB payload as Parse reads them. Nil
+// callbacks are skipped, and an error returned by one stops the parsing.
+type Visitor struct {
+	// Aux is called for each auxiliary field, such as redis-ver.
+	Aux func(key string, value string) error
+	// SelectDB is called when the keys of a database start.
+	SelectDB func(id uint8) error
+	// Key is called for each key, with its value and expiry. Keys before
+	// any SELECTDB belong to database 0.
+	Key func(db uint8, key string, value resp.StoreValue) error
+}
 
-		if fileBytes[0] != 0xFB {
-			return nil, nil, fmt.Errorf("invalid database section: %v", fileBytes[0])
-		}
-		fileBytes = fileBytes[1:]
+// Parse reads an RDB payload from r, handing its contents to v as they are
+// read, so that dumps of any size are processed holding one value at a time.
+// The checksum is verified at the end, once every callback ran: a caller
+// must discard what it got when Parse fails. Parse does not read past the
+// checksum, but r may be read ahead.
+func Parse(r io.Reader, v Visitor) error {
+	d := newDecoder(r)
+	header, err := d.readBytes(len(REDIS_VERSION))
+	if err != nil {
+		return fmt.Errorf("error reading rdb version: %v", err)
+	}
 
-		tableSize, err := decodeLength(&fileBytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("invalid table size: %v", err)
-		}
+	// Redis Version: files of older versions, written by older Redis
+	// servers, are a subset of the format.
+	version, err := strconv.Atoi(string(header[5:]))
+	if !bytes.HasPrefix(header, []byte("REDIS")) || err != nil || version < 1 || version > RDB_VERSION {
+		return fmt.Errorf("invalid rdb version: %v", string(header))
+	}
 
-		expirySize, err := decodeLength(&fileBytes)
+	// The rest is a sequence of opcodes, and of keys introduced by their
+	// value type instead.
+	var databaseId uint8
+	var expiryTime time.Time
+	for {
+		opcode, err := d.readByte()
 		if err != nil {
-			return nil, nil, fmt.Errorf("invalid expiry size: %v", err)
+			return fmt.Errorf("missing end of file marker: %v", err)
 		}
 
-		// fmt.Printf("tableSize: %v, expirySize: %v\n", tableSize, expirySize)
-
-		for tableSize > 0 || expirySize > 0 {
-			expiryTime := time.Time{}
-			if fileBytes[0] == 0xFD {
-				expirySize -= 1
-				fileBytes = fileBytes[1:]
-				sec_time, err := decodeTimeStamp(&fileBytes, 4)
-				if err != nil {
-					return nil, nil, fmt.Errorf("invalid expiry time: %v", err)
+		switch opcode {
+		case opcodeEOF:
+			// Checksum: the 8 bytes following the end of file marker, since
+			// version 5. A zero checksum means the writer had checksums
+			// disabled.
+			if version < 5 {
+				return nil
+			}
+			checksum := d.hash.Sum64()
+			expected, err := d.readBytes(8)
+			if err != nil {
+				return fmt.Errorf("missing checksum: %v", err)
+			}
+			if sum := binary.LittleEndian.Uint64(expected); sum != 0 && sum != checksum {
+				return fmt.Errorf("invalid checksum: %v", checksum)
+			}
+			return nil
+		case opcodeAux:
+			key, err := decodeString(d)
+			if err != nil {
+				return fmt.Errorf("invalid metadata: %v", err)
+			}
+			value, err := decodeString(d)
+			if err != nil {
+				return fmt.Errorf("invalid metadata: %v", err)
+			}
+			if v.Aux != nil {
+				if err := v.Aux(key, value); err != nil {
+					return err
 				}
-				// fmt.Printf("expiryTime: %s\n", sec_time)
-				expiryTime = sec_time
-			} else if fileBytes[0] == 0xFC {
-				expirySize -= 1
-				fileBytes = fileBytes[1:]
-				sec_time, err := decodeTimeStamp(&fileBytes, 8)
-				if err != nil {
-					return nil, nil, fmt.Errorf("invalid expiry time: %v", err)
+			}
+		case opcodeSelectDB:
+			id, err := decodeLength(d)
+			if err != nil || id > math.MaxUint8 {
+				return fmt.Errorf("invalid database section: %v", err)
+			}
+			databaseId = uint8(id)
+			if v.SelectDB != nil {
+				if err := v.SelectDB(databaseId); err != nil {
+					return err
 				}
-				// fmt.Printf("expiryTime: %s\n", sec_time)
-				expiryTime = sec_time
 			}
-
-			valueType := fileBytes[0]
-			fileBytes = fileBytes[1:]
-
-			// fmt.Printf("valueType: %v\n", valueType)
-			// fmt.Printf("fileBytes: % X\n", fileBytes)
-			key, err := decodeString(&fileBytes)
+		case opcodeResizeDB:
+			// The number of keys and of keys with an expiry, only hints to
+			// size the tables.
+			for range 2 {
+				if _, err := decodeLength(d); err != nil {
+					return fmt.Errorf("invalid table size: %v", err)
+				}
+			}
+		case opcodeExpireTime:
+			if expiryTime, err = decodeTimeStamp(d, 4); err != nil {
+				return fmt.Errorf("invalid expiry time: %v", err)
+			}
+		case opcodeExpireTimeMs:
+			if expiryTime, err = decodeTimeStamp(d, 8); err != nil {
+				return fmt.Errorf("invalid expiry time: %v", err)
+			}
+		case opcodeIdle:
+			// The LRU idle time of the next key, in seconds: we do not evict.
+			if _, err := decodeLength64(d); err != nil {
+				return fmt.Errorf("invalid idle time: %v", err)
+			}
+		case opcodeFreq:
+			// The LFU counter of the next key.
+			if _, err := d.readByte(); err != nil {
+				return fmt.Errorf("invalid access frequency: %v", err)
+			}
+		case opcodeModuleAux:
+			if err := skipModuleAux(d); err != nil {
+				return fmt.Errorf("invalid module auxiliary data: %v", err)
+			}
+		case opcodeFunction2:
+			// The code of a function library: functions are not supported,
+			// so it is dropped.
+			if _, err := decodeString(d); err != nil {
+				return fmt.Errorf("invalid function library: %v", err)
+			}
+		case opcodeFunctionPreGA:
+			return fmt.Errorf("pre-GA function format not supported")
+		default:
+			key, err := decodeString(d)
 			if err != nil {
-				return nil, nil, fmt.Errorf("invalid key: %v", err)
+				return fmt.Errorf("invalid key: %v", err)
 			}
-			// fmt.Printf("key: %v\n", key)
-
-			switch valueType {
-			case 0x00:
-				value, err := decodeValue(&fileBytes)
-				// fmt.Printf("value: %s\n", value)
-				if err != nil {
-					return nil, nil, fmt.Errorf("invalid value: %v", err)
-				}
-				if expiryTime != (time.Time{}) && expiryTime.Before(time.Now()) {
-					databases[databaseId].Store[key] = resp.NewStoreValue(resp.NewBulkString(""), expiryTime)
-				} else {
-					databases[databaseId].Store[key] = resp.NewStoreValue(value, expiryTime)
-					if expiryTime != (time.Time{}) {
-						databases[databaseId].ExpiryMap[expiryTime] = key
-					}
+			value, err := decodeStoreValue(ValueEncoding(opcode), d)
+			if err != nil {
+				return fmt.Errorf("invalid value of key %q: %v", key, err)
+			}
+			value.ExpireAt = expiryTime
+			expiryTime = time.Time{}
+			if v.Key != nil {
+				if err := v.Key(databaseId, key, value); err != nil {
+					return err
 				}
-				tableSize -= 1
-			default:
-				return nil, nil, fmt.Errorf("invalid value type: %v", valueType)
 			}
 		}
+	}
+}
 
-		if tableSize != 0 || expirySize != 0 {
-			return nil, nil, fmt.Errorf("invalid table size: %v, expiry size: %v", tableSize, expirySize)
+// skipModuleAux skips the auxiliary data of a module: its ID, when it is
+// loaded relative to the keys, then typed values up to an EOF opcode. We do
+// not run modules, so it is dropped.
+func skipModuleAux(d *decoder) error {
+	// The module ID, the type of the next value, always an unsigned integer,
+	// and that value.
+	if _, err := decodeLength64(d); err != nil {
+		return err
+	}
+	if when, err := decodeLength64(d); err != nil || when != moduleOpcodeUint {
+		return fmt.Errorf("invalid module data")
+	}
+	if _, err := decodeLength64(d); err != nil {
+		return err
+	}
+	for {
+		opcode, err := decodeLength64(d)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case moduleOpcodeEOF:
+			return nil
+		case moduleOpcodeSint, moduleOpcodeUint:
+			_, err = decodeLength64(d)
+		case moduleOpcodeFloat, moduleOpcodeDouble:
+			size := 4
+			if opcode == moduleOpcodeDouble {
+				size = 8
+			}
+			_, err = d.readBytes(size)
+		case moduleOpcodeString:
+			_, err = decodeString(d)
+		default:
+			return fmt.Errorf("invalid module opcode: %d", opcode)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	// fmt.Println("databases: ", databases)
+}
 
-	// End of Database Sections
-	if fileBytes[0] != 0xFF || len(fileBytes) != 1 {
-		return nil, nil, fmt.Errorf("invalid end of database sections: % X", fileBytes)
+func encodeLength(length int) ([]byte, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("invalid length: %d", length)
 	}
-
-	return metadata, databases, nil
+	return encodeLength64(uint64(length)), nil
 }
 
-func encodeLength(length int) ([]byte, error) {
+// encodeLength64 encodes a length, or an unsigned integer such as the parts
+// of a stream ID, which may need the 64-bit form.
+func encodeLength64(length uint64) []byte {
 	var buf bytes.Buffer
 
 	if length < 64 {
@@ -357,41 +555,61 @@ func encodeLength(length int) ([]byte, error) {
 		buf.WriteByte(byte(length))
 	} else if length < 16384 {
 		// 01: Next 14 bits = length (0-16383)
-		// First byte: 01 + 6 bits of length
-		upper := byte((length&0x3F)<<2) | 0x40
-		buf.WriteByte(upper)
-		// Second byte: remaining 8 bits
-		buf.WriteByte(byte(length >> 8))
+		// First byte: 01 + upper 6 bits of length
+		buf.WriteByte(byte(length>>8) | 0x40)
+		// Second byte: lower 8 bits
+		buf.WriteByte(byte(length))
+	} else if length <= math.MaxUint32 {
+		// 10000000: Next 4 bytes = length, big endian
+		buf.WriteByte(0x80)
+		binary.Write(&buf, binary.BigEndian, uint32(length))
 	} else {
-		// 10: Next 4 bytes = length (0-2^32-1)
-		buf.WriteByte(0x80) // 10 + 000000
-		err := binary.Write(&buf, binary.LittleEndian, int32(length))
-		if err != nil {
-			return nil, fmt.Errorf("error writing length: %v", err)
-		}
+		// 10000001: Next 8 bytes = length, big endian
+		buf.WriteByte(0x81)
+		binary.Write(&buf, binary.BigEndian, length)
 	}
-	return buf.Bytes(), nil
+	return buf.Bytes()
 }
 
-func decodeLength(data *[]byte) (int, error) {
-	if len(*data) == 0 {
-		return 0, fmt.Errorf("empty data")
-	}
-
-	firstByte := (*data)[0]
-	*data = (*data)[1:]
-	if (firstByte & 0xC0) == 0x00 {
-		return int(firstByte), nil
-	} else if (firstByte & 0xC0) == 0x40 {
-		secondByte := (*data)[0]
-		*data = (*data)[1:]
-		return int(firstByte&0x3F)<<8 | int(secondByte), nil
-	} else if (firstByte & 0xC0) == 0x80 {
-		var length int32
-		binary.Read(bytes.NewReader((*data)[:4]), binary.LittleEndian, &length)
-		*data = (*data)[4:]
-		return int(length), nil
-	} else {
+func decodeLength(d *decoder) (int, error) {
+	length, err := decodeLength64(d)
+	if err != nil {
+		return 0, err
+	}
+	if length > math.MaxInt32 {
+		return 0, fmt.Errorf("length %d is too large", length)
+	}
+	return int(length), nil
+}
+
+func decodeLength64(d *decoder) (uint64, error) {
+	firstByte, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case (firstByte & 0xC0) == 0x00:
+		return uint64(firstByte), nil
+	case (firstByte & 0xC0) == 0x40:
+		secondByte, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(firstByte&0x3F)<<8 | uint64(secondByte), nil
+	case firstByte == 0x80:
+		data, err := d.readBytes(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(data)), nil
+	case firstByte == 0x81:
+		data, err := d.readBytes(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(data), nil
+	default:
 		return 0, fmt.Errorf("invalid length prefix: %v", firstByte)
 	}
 }
@@ -408,208 +626,149 @@ func encodeString(s string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func decodeString(data *[]byte) (string, error) {
-	if len(*data) == 0 {
-		return "", fmt.Errorf("empty data")
+// encodeStringCompressed encodes s LZF compressed when compress is set and
+// that makes it shorter, as Redis does for strings longer than 20 bytes with
+// rdbcompression, and as a plain string otherwise.
+func encodeStringCompressed(s string, compress bool) ([]byte, error) {
+	if !compress || len(s) <= lzfMinLength {
+		return encodeString(s)
 	}
-
-	// Decode Integer
-	firstByte := (*data)[0]
-	if firstByte == 0xC0 {
-		var value int8
-		*data = (*data)[1:]
-		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-		*data = (*data)[1:]
-		return strconv.FormatInt(int64(value), 10), nil
-	} else if firstByte == 0xC1 {
-		var value int16
-		*data = (*data)[1:]
-		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-		*data = (*data)[2:]
-		return strconv.FormatInt(int64(value), 10), nil
-	} else if firstByte == 0xC2 {
-		var value int32
-		*data = (*data)[1:]
-		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-		*data = (*data)[4:]
-		return strconv.FormatInt(int64(value), 10), nil
+	compressed := lzfCompress([]byte(s))
+	if compressed == nil {
+		return encodeString(s)
 	}
 
-	// Decode String
-	length, err := decodeLength(data)
+	var buf bytes.Buffer
+	buf.WriteByte(0xC3)
+	compressedLength, err := encodeLength(len(compressed))
 	if err != nil {
-		return "", fmt.Errorf("error decoding length prefix: %v", err)
+		return nil, fmt.Errorf("error encoding compressed length: %v", err)
 	}
-
-	str := string((*data)[:length])
-	*data = (*data)[length:]
-	return str, nil
+	buf.Write(compressedLength)
+	length, err := encodeLength(len(s))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding uncompressed length: %v", err)
+	}
+	buf.Write(length)
+	buf.Write(compressed)
+	return buf.Bytes(), nil
 }
 
-func encodeInteger[N uint8 | uint16 | uint32 | int8 | int16 | int32 | int](value N) ([]byte, error) {
-	var buf bytes.Buffer
-
-	// Special format: 11 + type indicator
-	// For integers: 000000 = 8-bit, 000001 = 16-bit, 000010 = 32-bit
-	var typeIndicator byte
-
-	valueInt := int(value)
-	if valueInt < int(256) {
-		typeIndicator = 0xC0
-	} else if valueInt < int(65536) {
-		typeIndicator = 0xC1
-	} else {
-		typeIndicator = 0xC2
+func decodeString(d *decoder) (string, error) {
+	firstByte, err := d.r.Peek(1)
+	if err != nil {
+		return "", unexpectedEOF(err)
 	}
 
-	buf.WriteByte(typeIndicator) // 11 + type indicator
-
-	switch typeIndicator {
-	case 0xC0:
-		err := binary.Write(&buf, binary.LittleEndian, int8(valueInt))
+	// Decode Integer
+	if size := map[byte]int{0xC0: 1, 0xC1: 2, 0xC2: 4}[firstByte[0]]; size > 0 {
+		data, err := d.readBytes(1 + size)
 		if err != nil {
-			return nil, fmt.Errorf("error writing integer: %v", err)
+			return "", fmt.Errorf("truncated integer")
 		}
-	case 0xC1:
-		err := binary.Write(&buf, binary.LittleEndian, int16(valueInt))
+		var value int64
+		switch size {
+		case 1:
+			value = int64(int8(data[1]))
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(data[1:])))
+		default:
+			value = int64(int32(binary.LittleEndian.Uint32(data[1:])))
+		}
+		return strconv.FormatInt(value, 10), nil
+	} else if firstByte[0] == 0xC3 {
+		// LZF compressed string: compressed length, original length, data
+		d.readByte()
+		compressedLength, err := decodeLength(d)
+		if err != nil {
+			return "", fmt.Errorf("error decoding compressed length: %v", err)
+		}
+		length, err := decodeLength(d)
+		if err != nil {
+			return "", fmt.Errorf("error decoding uncompressed length: %v", err)
+		}
+		compressed, err := d.readBytes(compressedLength)
 		if err != nil {
-			return nil, fmt.Errorf("error writing integer: %v", err)
+			return "", fmt.Errorf("compressed string length %d exceeds data", compressedLength)
 		}
-	case 0xC2:
-		err := binary.Write(&buf, binary.LittleEndian, int32(valueInt))
+		str, err := lzfDecompress(compressed, length)
 		if err != nil {
-			return nil, fmt.Errorf("error writing integer: %v", err)
+			return "", err
 		}
+		return string(str), nil
 	}
 
-	return buf.Bytes(), nil
-}
-
-func decodeTimeStamp(data *[]byte, byteCount int) (time.Time, error) {
-	if len(*data) == 0 {
-		return time.Time{}, fmt.Errorf("empty data")
+	// Decode String
+	length, err := decodeLength(d)
+	if err != nil {
+		return "", fmt.Errorf("error decoding length prefix: %v", err)
 	}
-	if byteCount == 4 {
-		var value int32
-		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-		*data = (*data)[4:]
-		sec := int64(value / 1000)
-		nsec := (int64(value%1000) * int64(time.Millisecond))
-		return time.Unix(sec, nsec), nil
-	}
-	if byteCount == 8 {
-		var value int64
-		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-		*data = (*data)[8:]
-		sec := value / 1000
-		nsec := (value % 1000) * int64(time.Millisecond)
-		return time.Unix(sec, nsec), nil
+	str, err := d.readBytes(length)
+	if err != nil {
+		return "", fmt.Errorf("string length %d exceeds data", length)
 	}
-	return time.Time{}, fmt.Errorf("invalid byte count: %v", byteCount)
+	return string(str), nil
 }
 
-// func decodeInteger(data *[]byte) (int, error) {
-// 	if len(*data) == 0 {
-// 		return 0, fmt.Errorf("empty data")
-// 	}
-
-// 	firstByte := (*data)[0]
-// 	*data = (*data)[1:]
-// 	if firstByte == 0xC0 {
-// 		var value int8
-// 		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-// 		*data = (*data)[1:]
-// 		return int(value), nil
-// 	} else if firstByte == 0xC1 {
-// 		var value int16
-// 		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-// 		*data = (*data)[2:]
-// 		return int(value), nil
-// 	} else if firstByte == 0xC2 {
-// 		var value int32
-// 		binary.Read(bytes.NewReader(*data), binary.LittleEndian, &value)
-// 		*data = (*data)[4:]
-// 		return int(value), nil
-// 	} else {
-// 		return 0, fmt.Errorf("invalid integer prefix")
-// 	}
-// }
-
-func encodeValue(value resp.Value) ([]byte, error) {
-	switch value.Type {
-	// case resp.RESPTypeArray:
-	// 	return encodeArray(value)
-	case resp.RESPTypeSimpleString, resp.RESPTypeBulkString:
-		return encodeString(value.String)
-	case resp.RESPTypeInteger:
-		return encodeInteger(value.Integer)
-	case resp.RESPTypeNull:
-		return encodeString("_\r\n")
-	case resp.RESPTypeError:
-		return encodeString(value.String)
-	case resp.RESPTypeBoolean:
-		if value.Boolean {
-			return []byte{0xFE}, nil
-		}
-		return []byte{0xFD}, nil
-	case resp.RESPTypeDouble:
-		str := strconv.FormatFloat(value.Double, 'g', 17, 64) // 'g' format with 17 digits of precision
-		return encodeString(str)
-	case resp.RESPTypeBigNumber:
-		str := strconv.FormatInt(value.BigNumber, 10)
-		return encodeString(str)
+// encodeInteger encodes a string holding a 32-bit integer in the special
+// format for integers: 11 followed by the size, 8, 16 or 32 bits, then the
+// integer, little endian.
+func encodeInteger(value int64) []byte {
+	switch {
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		return []byte{0xC0, byte(value)}
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		return binary.LittleEndian.AppendUint16([]byte{0xC1}, uint16(value))
 	default:
-		return nil, fmt.Errorf("unknown type: %c", value.Type)
+		return binary.LittleEndian.AppendUint32([]byte{0xC2}, uint32(value))
 	}
 }
 
-func decodeValue(data *[]byte) (resp.Value, error) {
-	if len(*data) == 0 {
-		return resp.Value{}, fmt.Errorf("empty data")
+// decodeTimeStamp decodes an expiry time: a Unix time in seconds on 4
+// bytes, or in milliseconds on 8 bytes, little endian.
+func decodeTimeStamp(d *decoder, byteCount int) (time.Time, error) {
+	if byteCount != 4 && byteCount != 8 {
+		return time.Time{}, fmt.Errorf("invalid byte count: %v", byteCount)
 	}
-
-	str, err := decodeString(data)
+	data, err := d.readBytes(byteCount)
 	if err != nil {
-		return resp.Value{}, err
-	}
-
-	if integer, err := strconv.Atoi(str); err == nil {
-		return resp.NewInteger(integer), nil
+		return time.Time{}, fmt.Errorf("truncated time")
 	}
-
-	if double, err := strconv.ParseFloat(str, 64); err == nil {
-		return resp.NewDouble(double), nil
-	}
-
-	if bigNumber, err := strconv.ParseInt(str, 10, 64); err == nil {
-		return resp.NewBigNumber(bigNumber), nil
+	if byteCount == 4 {
+		return time.Unix(int64(binary.LittleEndian.Uint32(data)), 0), nil
 	}
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(data))), nil
+}
 
-	if str == "1" {
-		return resp.NewBoolean(true), nil
+func decodeValue(d *decoder) (resp.String, error) {
+	str, err := decodeString(d)
+	if err != nil {
+		return resp.String{}, err
 	}
+	return resp.NewString([]byte(str)), nil
+}
 
-	if str == "0" {
-		return resp.NewBoolean(false), nil
+// decodeStoreValue decodes a value stored with the given RDB value type.
+func decodeStoreValue(valueType ValueEncoding, d *decoder) (resp.StoreValue, error) {
+	if valueType == StringEncoding {
+		value, err := decodeValue(d)
+		return resp.NewStoreValue(value, time.Time{}), err
 	}
-
-	return resp.NewBulkString(str), nil
+	object, err := decodeObject(valueType, d)
+	return resp.NewStoreObject(object, time.Time{}), err
 }
 
-func encodeValueType(value resp.Value) (byte, error) {
-	switch value.Type {
-	case resp.RESPTypeSimpleString, resp.RESPTypeBulkString, resp.RESPTypeInteger, resp.RESPTypeNull, resp.RESPTypeError, resp.RESPTypeBoolean, resp.RESPTypeDouble, resp.RESPTypeBigNumber:
-		return byte(StringEncoding), nil
-	default:
-		return byte(StringEncoding), nil
+// encodeStoreValue returns the RDB value type of a value and its encoding.
+// Strings holding an integer that fits 32 bits are stored as one, as Redis
+// does; they load back as the same string.
+func encodeStoreValue(value resp.StoreValue, compress bool) (byte, []byte, error) {
+	if value.Object != nil {
+		valueType, data, err := encodeObject(value.Object, compress)
+		return byte(valueType), data, err
+	}
+	if n, ok := value.String.Integer(); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return byte(StringEncoding), encodeInteger(n), nil
 	}
+	data, err := encodeStringCompressed(string(value.String.Bytes()), compress)
+	return byte(StringEncoding), data, err
 }
-
-// func decodeValueType(valueType byte) (resp.ValueType, error) {
-// 	switch valueType {
-// 	case 0xC0, 0xC1, 0xC2:
-// 		return resp.RESPTypeSimpleString, nil
-// 	default:
-// 		return resp.RESPTypeSimpleString, nil
-// 	}
-// }
@@ -0,0 +1,557 @@
+package rdb
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+var futureMs = time.UnixMilli(4102444800000)
+
+func str(s string) resp.StoreValue {
+	return resp.NewStoreValue(resp.NewString([]byte(s)), time.Time{})
+}
+
+func obj(object resp.Object) resp.StoreValue {
+	return resp.NewStoreObject(object, time.Time{})
+}
+
+func expiring(value resp.StoreValue, expireAt time.Time) resp.StoreValue {
+	value.ExpireAt = expireAt
+	return value
+}
+
+func set(members ...string) resp.Set {
+	s := make(resp.Set)
+	for _, member := range members {
+		s[member] = struct{}{}
+	}
+	return s
+}
+
+// testStream is a stream with a consumer group, a consumer and a pending
+// entry, where the entry 1700000000005-0 was deleted.
+func testStream() *resp.Stream {
+	return &resp.Stream{
+		Entries: []resp.StreamEntry{
+			{ID: resp.StreamID{Ms: 1700000000000, Seq: 0}, Fields: []string{"name", "ann", "age", "30"}},
+			{ID: resp.StreamID{Ms: 1700000000000, Seq: 1}, Fields: []string{"name", "bob", "age", "40"}},
+			{ID: resp.StreamID{Ms: 1700000000009, Seq: 3}, Fields: []string{"name", "cy", "age", "50"}},
+		},
+		LastID:       resp.StreamID{Ms: 1700000000009, Seq: 3},
+		FirstID:      resp.StreamID{Ms: 1700000000000, Seq: 0},
+		MaxDeletedID: resp.StreamID{Ms: 1700000000005, Seq: 0},
+		EntriesAdded: 4,
+		Groups: []resp.StreamGroup{{
+			Name:        "group",
+			LastID:      resp.StreamID{Ms: 1700000000000, Seq: 1},
+			EntriesRead: 2,
+			Pending: []resp.StreamPendingEntry{
+				{ID: resp.StreamID{Ms: 1700000000000, Seq: 1}, DeliveryTime: 1700000001000, DeliveryCount: 2},
+			},
+			Consumers: []resp.StreamConsumer{{
+				Name:       "alice",
+				SeenTime:   1700000002000,
+				ActiveTime: 1700000001500,
+				Pending:    []resp.StreamID{{Ms: 1700000000000, Seq: 1}},
+			}},
+		}},
+	}
+}
+
+// roundTripDatabases holds a value of every type, in values that exercise
+// the integer and LZF encodings of strings.
+func roundTripDatabases() map[uint8]map[string]resp.StoreValue {
+	return map[uint8]map[string]resp.StoreValue{
+		0: {
+			"string":    str("value"),
+			"binary":    str("\x00\xff\r\n"),
+			"integer":   str("-123456"),
+			"int64":     str("9223372036854775807"),
+			"padded":    str("007"),
+			"long":      str(strings.Repeat("compressible ", 20)),
+			"expiring":  expiring(str("soon"), futureMs),
+			"list":      obj(resp.List{"a", "1", "-70000", strings.Repeat("b", 300)}),
+			"set":       obj(set("x", "y", "42")),
+			"hash":      obj(resp.Hash{"field": "value", "n": "1"}),
+			"zset":      obj(resp.SortedSet{{Member: "low", Score: math.Inf(-1)}, {Member: "a", Score: 0.1}, {Member: "b", Score: 3}}),
+			"stream":    obj(testStream()),
+			"empty-str": str(""),
+		},
+		2: {"other": str("db2")},
+	}
+}
+
+func assertValue(t *testing.T, key string, got resp.StoreValue, want resp.StoreValue) {
+	t.Helper()
+	if !got.ExpireAt.Equal(want.ExpireAt) {
+		t.Errorf("%q: expires at %v, want %v", key, got.ExpireAt, want.ExpireAt)
+	}
+	if want.Object != nil {
+		if !reflect.DeepEqual(got.Object, want.Object) {
+			t.Errorf("%q = %#v, want %#v", key, got.Object, want.Object)
+		}
+		return
+	}
+	if got.Object != nil || !bytes.Equal(got.String.Bytes(), want.String.Bytes()) {
+		t.Errorf("%q = %q (object %v), want %q", key, got.String.Bytes(), got.Object, want.String.Bytes())
+	}
+}
+
+// The files in testdata/redis were written by Redis servers, see the README
+// there. Those in testdata/spec are built by testdata/spec/gen.py from the
+// RDB format, for the encodings none of the Redis dumps use.
+
+var futureS = time.Unix(4102444801, 0)
+
+func TestReadRedisDumps(t *testing.T) {
+	ziplistIntegers := resp.List{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "-2", "13", "25",
+		"-61", "63", "16380", "-16000", "65535", "-65523", "4194304", "9223372036854775807"}
+	tests := []struct {
+		file string
+		want map[uint8]map[string]resp.StoreValue
+	}{
+		{"empty_database.rdb", map[uint8]map[string]resp.StoreValue{}},
+		{"multiple_databases.rdb", map[uint8]map[string]resp.StoreValue{
+			0: {"key_in_zeroth_database": str("zero")},
+			2: {"key_in_second_database": str("second")},
+		}},
+		{"integer_keys.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"125":        str("Positive 8 bit integer"),
+			"43947":      str("Positive 16 bit integer"),
+			"183358245":  str("Positive 32 bit integer"),
+			"-123":       str("Negative 8 bit integer"),
+			"-29477":     str("Negative 16 bit integer"),
+			"-183358245": str("Negative 32 bit integer"),
+		}}},
+		{"easily_compressible_string_key.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			strings.Repeat("a", 200): str("Key that redis should compress easily"),
+		}}},
+		{"rdb_version_5_with_checksum.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"abc":          str("def"),
+			"abcd":         str("efgh"),
+			"foo":          str("bar"),
+			"bar":          str("baz"),
+			"abcdef":       str("abcdef"),
+			"longerstring": str("thisisalongerstring.idontknowwhatitmeans"),
+		}}},
+		{"keys_with_mixed_expiry.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"key01": expiring(str("this does expire"), time.UnixMilli(2080245030932)),
+			"key02": str("this does not expire"),
+			"key03": str("this does not expire"),
+			"key04": expiring(str("this does expire"), time.UnixMilli(2080245034115)),
+		}}},
+		{"ziplist_that_compresses_easily.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"ziplist_compresses_easily": obj(resp.List{strings.Repeat("a", 6), strings.Repeat("a", 12), strings.Repeat("a", 18),
+				strings.Repeat("a", 24), strings.Repeat("a", 30), strings.Repeat("a", 36)}),
+		}}},
+		{"ziplist_that_doesnt_compress.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"ziplist_doesnt_compress": obj(resp.List{"aj2410", "cc953a17a8e096e76a44169ad3f9ac87c5f8248a403274416179aa9fbd852344"}),
+		}}},
+		{"ziplist_with_integers.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"ziplist_with_integers": obj(ziplistIntegers),
+		}}},
+		{"rdb_v7_list_quicklist.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"foo": obj(resp.List{"bar", "baz", "boo"}),
+		}}},
+		{"intset_16.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"intset_16": obj(set("32764", "32765", "32766")),
+		}}},
+		{"intset_32.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"intset_32": obj(set("2147418108", "2147418109", "2147418110")),
+		}}},
+		{"intset_64.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"intset_64": obj(set("9223090557583032316", "9223090557583032317", "9223090557583032318")),
+		}}},
+		{"regular_set.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"regular_set": obj(set("alpha", "beta", "gamma", "delta", "phi", "kappa")),
+		}}},
+		{"zipmap_that_compresses_easily.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"zipmap_compresses_easily": obj(resp.Hash{"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa"}),
+		}}},
+		{"zipmap_that_doesnt_compress.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"zimap_doesnt_compress": obj(resp.Hash{"MKD1G6": "2", "YNNXK": "F7TI"}),
+		}}},
+		{"hash_as_ziplist.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"zipmap_compresses_easily": obj(resp.Hash{"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa"}),
+		}}},
+		{"sorted_set_as_ziplist.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"sorted_set_as_ziplist": obj(resp.SortedSet{
+				{Member: "8b6ba6718a786daefa69438148361901", Score: 1},
+				{Member: "cb7a24bb7528f934b841b34c3a73e0c7", Score: 2.37},
+				{Member: "523af537946b79c4f8369ed39ba78605", Score: 3.423},
+			}),
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, databases, err := Open("testdata/redis", tt.file)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			assertDatabases(t, databases, tt.want)
+		})
+	}
+}
+
+// TestReadLargeRedisDumps checks the dumps whose values were too large for
+// Redis to use a compact encoding.
+func TestReadLargeRedisDumps(t *testing.T) {
+	open := func(file string) resp.Database {
+		t.Helper()
+		_, databases, err := Open("testdata/redis", file)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", file, err)
+		}
+		return databases[0]
+	}
+
+	hash, _ := open("dictionary.rdb").Store["force_dictionary"].Object.(resp.Hash)
+	if len(hash) != 1000 ||
+		hash["ZMU5WEJDG7KU89AOG5LJT6K7HMNB3DEI43M6EYTJ83VRJ6XNXQ"] != "T63SOS8DQJF0Q0VJEZ0D1IQFCYTIPSBOUIAI9SB0OV57MQR1FI" ||
+		hash["UHS5ESW4HLK8XOGTM39IK1SJEUGVV9WOPK6JYA5QBZSJU84491"] != "6VULTCV52FXJ8MGVSFTZVAGK2JXZMGQ5F8OVJI0X6GEDDR27RZ" {
+		t.Errorf("dictionary.rdb: hash of %d fields does not hold the dumped values", len(hash))
+	}
+
+	list, _ := open("linkedlist.rdb").Store["force_linkedlist"].Object.(resp.List)
+	if len(list) != 1000 || list[0] != "41PJSO2KRV6SK1WJ6936L06YQDPV68R5J2TAZO3YAR5IL5GUI8" ||
+		list[999] != "2C5URE2L24D9GJUZJ59IWCAH8SGYF5T7QZ0EXQ0IE4I2JSB1QD" {
+		t.Errorf("linkedlist.rdb: list of %d elements does not hold the dumped values", len(list))
+	}
+
+	zset, _ := open("regular_sorted_set.rdb").Store["force_sorted_set"].Object.(resp.SortedSet)
+	if len(zset) != 500 || zset[0] != (resp.SortedSetMember{Member: "41PJSO2KRV6SK1WJ6936L06YQDPV68R5J2TAZO3YAR5IL5GUI8", Score: 0}) ||
+		zset[499] != (resp.SortedSetMember{Member: "E1RVJE0CPK9109Q3LO6X4D1GNUG5NGTQNCYTJHHW4XEM7VSO6V", Score: 4.99}) {
+		t.Errorf("regular_sorted_set.rdb: sorted set of %d members does not hold the dumped values", len(zset))
+	}
+
+	lengths := make(map[int]string)
+	for key, value := range open("uncompressible_string_keys.rdb").Store {
+		lengths[len(key)] = string(value.String.Bytes())
+	}
+	wantLengths := map[int]string{
+		60:    "Key length within 6 bits",
+		16382: "Key length more than 6 bits but less than 14 bits",
+		16386: "Key length more than 14 bits but less than 32",
+	}
+	if !reflect.DeepEqual(lengths, wantLengths) {
+		t.Errorf("uncompressible_string_keys.rdb: keys by length = %v, want %v", lengths, wantLengths)
+	}
+
+	zipmap, _ := open("zipmap_with_big_values.rdb").Store["zipmap_with_big_values"].Object.(resp.Hash)
+	for field, size := range map[string]int{"253bytes": 253, "254bytes": 254, "255bytes": 255, "300bytes": 300, "20kbytes": 20000} {
+		if len(zipmap[field]) != size {
+			t.Errorf("zipmap_with_big_values.rdb: %s holds %d bytes, want %d", field, len(zipmap[field]), size)
+		}
+	}
+}
+
+func TestReadRedisMetadata(t *testing.T) {
+	metadata, _, err := Open("testdata/redis", "rdb_v7_list_quicklist.rdb")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	want := map[string]string{"redis-ver": "3.2.0", "redis-bits": "64", "ctime": "1465243651", "used-mem": "314648"}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("metadata = %v, want %v", metadata, want)
+	}
+}
+
+// specStream is the stream of the testdata/spec stream files.
+func specStream(version int) *resp.Stream {
+	stream := testStream()
+	if version < 3 {
+		stream.Groups[0].Consumers[0].ActiveTime = stream.Groups[0].Consumers[0].SeenTime
+	}
+	if version < 2 {
+		stream.MaxDeletedID = resp.StreamID{}
+		stream.EntriesAdded = 3
+		stream.Groups[0].EntriesRead = -1
+	}
+	return stream
+}
+
+func TestReadSpecFiles(t *testing.T) {
+	tests := []struct {
+		file string
+		want map[uint8]map[string]resp.StoreValue
+	}{
+		{"strings.rdb", map[uint8]map[string]resp.StoreValue{
+			0: {
+				"plain":     str("hello"),
+				"empty":     str(""),
+				"int8":      str("-100"),
+				"int16":     str("30000"),
+				"int32":     str("-2000000000"),
+				"lzf-long":  str(strings.Repeat("abc", 8)),
+				"lzf-short": str("xyzxyzxyzq"),
+				"expire-ms": expiring(str("ms"), futureMs),
+				"expire-s":  expiring(str("s"), futureS),
+				"idle":      str("i"),
+				"freq":      str("f"),
+			},
+			3: {"db3": str("three")},
+		}},
+		{"listpacks.rdb", map[uint8]map[string]resp.StoreValue{0: {
+			"quicklist2": obj(resp.List{"a", "100", "-5000", "plain", "1099511627776", strings.Repeat("z", 200)}),
+			"set":        obj(set("m", "42", "n")),
+			"hash":       obj(resp.Hash{"c": "3", "d": "four"}),
+			"zset":       obj(resp.SortedSet{{Member: "s", Score: -7}, {Member: "r", Score: 3.5}}),
+			"zset2":      obj(resp.SortedSet{{Member: "y", Score: -1}, {Member: "x", Score: 2.25}}),
+		}}},
+		{"stream_v1.rdb", map[uint8]map[string]resp.StoreValue{0: {"stream": obj(specStream(1))}}},
+		{"stream_v2.rdb", map[uint8]map[string]resp.StoreValue{0: {"stream": obj(specStream(2))}}},
+		{"stream_v3.rdb", map[uint8]map[string]resp.StoreValue{0: {"stream": obj(specStream(3))}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, databases, err := Open("testdata/spec", tt.file)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			assertDatabases(t, databases, tt.want)
+		})
+	}
+}
+
+func TestReadBadChecksum(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "redis", "rdb_version_5_with_checksum.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if _, _, err := Decode(data); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Decode with a corrupt checksum: err = %v, want a checksum error", err)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "redis", "ziplist_with_integers.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{5, 20, len(data) / 2, len(data) - 9} {
+		if _, _, err := Decode(data[:n]); err == nil {
+			t.Errorf("Decode of the first %d bytes succeeded", n)
+		}
+	}
+}
+
+func toDatabases(values map[uint8]map[string]resp.StoreValue) map[uint8]resp.Database {
+	databases := make(map[uint8]resp.Database)
+	for id, keys := range values {
+		db := resp.NewDatabase(id)
+		for key, value := range keys {
+			db.Store[key] = value
+			if !value.ExpireAt.IsZero() {
+				db.ExpiryMap[value.ExpireAt] = key
+			}
+		}
+		databases[id] = db
+	}
+	return databases
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, compression := range []string{"yes", "no"} {
+		t.Run("rdbcompression "+compression, func(t *testing.T) {
+			want := roundTripDatabases()
+			metadata := map[string]string{"rdbcompression": compression, "dir": "/tmp", "repl-id": "abc", "ctime": "1"}
+			data, err := Encode(metadata, toDatabases(want))
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			gotMetadata, databases, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			assertDatabases(t, databases, want)
+
+			// Only the standard auxiliary fields are written.
+			wantMetadata := map[string]string{"redis-ver": "7.2.0", "redis-bits": "64", "ctime": "1", "repl-id": "abc"}
+			if !reflect.DeepEqual(gotMetadata, wantMetadata) {
+				t.Errorf("metadata = %v, want %v", gotMetadata, wantMetadata)
+			}
+		})
+	}
+}
+
+func TestWriteCompresses(t *testing.T) {
+	value := strings.Repeat("compressible ", 100)
+	databases := toDatabases(map[uint8]map[string]resp.StoreValue{0: {"k": str(value)}})
+	compressed, err := Encode(nil, databases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Encode(map[string]string{"rdbcompression": "no"}, databases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(plain) || !bytes.Contains(plain, []byte(value)) {
+		t.Errorf("compressed size %d, plain size %d", len(compressed), len(plain))
+	}
+}
+
+// badObject is a value type the RDB format cannot encode.
+type badObject struct{}
+
+func (badObject) TypeName() string { return "bad" }
+
+func TestSaveReplacesFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	want := map[uint8]map[string]resp.StoreValue{0: {"k": str("saved")}}
+	if err := Save(dir, "dump.rdb", nil, toDatabases(want)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// A failed save leaves the previous file in place, and no temp file.
+	bad := toDatabases(map[uint8]map[string]resp.StoreValue{0: {"k": obj(badObject{})}})
+	if err := Save(dir, "dump.rdb", nil, bad); err == nil {
+		t.Fatalf("Save of an unencodable value succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "dump.rdb" {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name()
+		}
+		t.Errorf("directory holds %v, want only dump.rdb", names)
+	}
+	_, databases, err := Open(dir, "dump.rdb")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	assertDatabases(t, databases, want)
+}
+
+func assertDatabases(t *testing.T, got map[uint8]resp.Database, want map[uint8]map[string]resp.StoreValue) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d databases, want %d", len(got), len(want))
+	}
+	for id, keys := range want {
+		db, ok := got[id]
+		if !ok {
+			t.Errorf("database %d missing", id)
+			continue
+		}
+		for key := range db.Store {
+			if _, ok := keys[key]; !ok {
+				t.Errorf("db %d: unexpected key %q", id, key)
+			}
+		}
+		for key, value := range keys {
+			gotValue, ok := db.Store[key]
+			if !ok {
+				t.Errorf("db %d: key %q missing", id, key)
+				continue
+			}
+			assertValue(t, key, gotValue, value)
+			if !value.ExpireAt.IsZero() && db.ExpiryMap[value.ExpireAt] != key {
+				t.Errorf("db %d: key %q missing from the expiry map", id, key)
+			}
+		}
+	}
+}
+
+func TestParseVisitor(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "spec", "strings.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var selected []uint8
+	keys := make(map[string]uint8)
+	aux := make(map[string]string)
+	err = Parse(file, Visitor{
+		Aux: func(key string, value string) error {
+			aux[key] = value
+			return nil
+		},
+		SelectDB: func(id uint8) error {
+			selected = append(selected, id)
+			return nil
+		},
+		Key: func(db uint8, key string, value resp.StoreValue) error {
+			keys[key] = db
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if want := map[string]string{"redis-ver": "7.2.4", "redis-bits": "64"}; !reflect.DeepEqual(aux, want) {
+		t.Errorf("auxiliary fields = %v, want %v", aux, want)
+	}
+	if !reflect.DeepEqual(selected, []uint8{0, 3}) {
+		t.Errorf("selected databases = %v, want [0 3]", selected)
+	}
+	// Parse reports every key, expired ones included.
+	if db, ok := keys["expired"]; !ok || db != 0 {
+		t.Errorf("expired key not reported in database 0")
+	}
+	if db := keys["db3"]; db != 3 {
+		t.Errorf("db3 reported in database %d, want 3", db)
+	}
+}
+
+func TestParseStopsOnError(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "redis", "integer_keys.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	visited := 0
+	stop := errors.New("stop")
+	err = Parse(file, Visitor{Key: func(uint8, string, resp.StoreValue) error {
+		visited++
+		return stop
+	}})
+	if !errors.Is(err, stop) || visited != 1 {
+		t.Errorf("Parse = %v after %d keys, want the visitor's error after 1", err, visited)
+	}
+}
+
+func TestReadSkipsExpiredKeys(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	databases := toDatabases(map[uint8]map[string]resp.StoreValue{0: {
+		"expired": expiring(str("old"), past),
+		"kept":    str("new"),
+	}})
+	data, err := Encode(nil, databases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loaded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertDatabases(t, loaded, map[uint8]map[string]resp.StoreValue{0: {"kept": str("new")}})
+	if len(loaded[0].ExpiryMap) != 0 {
+		t.Errorf("ExpiryMap = %v, want empty", loaded[0].ExpiryMap)
+	}
+}
+
+func TestReadSkipsExpiredRedisKeys(t *testing.T) {
+	// The key of this dump expired in 2022.
+	_, databases, err := Open("testdata/redis", "keys_with_expiry.rdb")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if n := len(databases[0].Store); n != 0 {
+		t.Errorf("loaded %d keys, want the expired key skipped", n)
+	}
+}
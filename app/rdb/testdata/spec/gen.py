@@ -0,0 +1,214 @@
+#!/usr/bin/env python3
+"""Generates the RDB files of this directory.
+
+They cover the encodings of Redis 5 and later, listpacks, binary sorted set
+scores and streams, which none of the dumps in ../redis use. They are
+assembled from the RDB format as Redis implements it (rdb.c, listpack.c and
+t_stream.c), independently of the Go code under test, but were not written
+by a Redis server. Run from this directory to regenerate them.
+"""
+
+import struct
+
+# Expiry times: 2100-01-01 (and a second later) in the future, 2000-01-01
+# in the past.
+FUTURE_MS = 4102444800000
+FUTURE_S = 4102444801
+PAST_MS = 946684800000
+
+# CRC-64/Jones, reflected, as used by Redis for RDB checksums.
+POLY = 0x95AC9329AC4BC9B5
+TABLE = []
+for i in range(256):
+    crc = i
+    for _ in range(8):
+        crc = (crc >> 1) ^ POLY if crc & 1 else crc >> 1
+    TABLE.append(crc)
+
+
+def crc64(data):
+    crc = 0
+    for b in data:
+        crc = TABLE[(crc ^ b) & 0xFF] ^ (crc >> 8)
+    return crc
+
+
+def length(n):
+    if n < 1 << 6:
+        return bytes([n])
+    if n < 1 << 14:
+        return bytes([0x40 | n >> 8, n & 0xFF])
+    if n < 1 << 32:
+        return b"\x80" + struct.pack(">I", n)
+    return b"\x81" + struct.pack(">Q", n)
+
+
+def string(s):
+    if isinstance(s, str):
+        s = s.encode()
+    return length(len(s)) + s
+
+
+def lzf_string(compressed, original):
+    return b"\xc3" + length(len(compressed)) + length(len(original)) + compressed
+
+
+def listpack(items):
+    body = b""
+    for item in items:
+        if isinstance(item, int):
+            if 0 <= item <= 127:
+                enc = bytes([item])
+            elif -4096 <= item < 4096:
+                v = item & 0x1FFF
+                enc = bytes([0xC0 | v >> 8, v & 0xFF])
+            elif -(1 << 15) <= item < 1 << 15:
+                enc = b"\xf1" + struct.pack("<h", item)
+            elif -(1 << 23) <= item < 1 << 23:
+                enc = b"\xf2" + struct.pack("<i", item)[:3]
+            elif -(1 << 31) <= item < 1 << 31:
+                enc = b"\xf3" + struct.pack("<i", item)
+            else:
+                enc = b"\xf4" + struct.pack("<q", item)
+        else:
+            data = item.encode()
+            if len(data) < 64:
+                enc = bytes([0x80 | len(data)]) + data
+            elif len(data) < 4096:
+                enc = bytes([0xE0 | len(data) >> 8, len(data) & 0xFF]) + data
+            else:
+                enc = b"\xf0" + struct.pack("<I", len(data)) + data
+        size = len(enc)
+        if size <= 127:
+            backlen = bytes([size])
+        else:
+            backlen = bytes([size >> 7, (size & 127) | 128])
+        body += enc + backlen
+    total = 6 + len(body) + 1
+    return struct.pack("<IH", total, len(items)) + body + b"\xff"
+
+
+def stream_id(ms, seq):
+    return struct.pack(">QQ", ms, seq)
+
+
+def stream_node(master, entries, deleted=()):
+    """A stream node: the master entry, then each entry relative to master.
+    Entries are (ms, seq, fields); those in deleted are flagged deleted."""
+    master_fields = [entries[0][2][i] for i in range(0, len(entries[0][2]), 2)]
+    items = [len(entries) - len(deleted), len(deleted), len(master_fields)] + master_fields + [0]
+    for ms, seq, fields in entries:
+        names = [fields[i] for i in range(0, len(fields), 2)]
+        flags = 0
+        if (ms, seq) in deleted:
+            flags |= 1
+        if names == master_fields:
+            flags |= 2
+            items += [flags, ms - master[0], seq - master[1]] + [fields[i] for i in range(1, len(fields), 2)]
+            items.append(len(master_fields) + 3)
+        else:
+            items += [flags, ms - master[0], seq - master[1], len(names)] + list(fields)
+            items.append(len(fields) + 4)
+    return items
+
+
+def rdb(version, body):
+    data = b"REDIS%04d" % version + body + b"\xff"
+    return data + struct.pack("<Q", crc64(data))
+
+
+def aux(key, value):
+    """An auxiliary field; bytes values are already encoded."""
+    if isinstance(value, str):
+        value = string(value)
+    return b"\xfa" + string(key) + value
+
+
+def key(value_type, name, value, expire_ms=None, expire_s=None):
+    out = b""
+    if expire_ms is not None:
+        out += b"\xfc" + struct.pack("<Q", expire_ms)
+    if expire_s is not None:
+        out += b"\xfd" + struct.pack("<I", expire_s)
+    return out + bytes([value_type]) + string(name) + value
+
+
+def strings():
+    body = aux("redis-ver", "7.2.4") + aux("redis-bits", b"\xc0\x40")
+    body += b"\xfe\x00\xfb" + length(10) + length(3)
+    body += key(0, "plain", string("hello"))
+    body += key(0, "empty", string(""))
+    body += key(0, "int8", b"\xc0" + struct.pack("<b", -100))
+    body += key(0, "int16", b"\xc1" + struct.pack("<h", 30000))
+    body += key(0, "int32", b"\xc2" + struct.pack("<i", -2000000000))
+    # "abc" then a back reference of 21 bytes at offset 3.
+    body += key(0, "lzf-long", lzf_string(b"\x02abc\xe0\x0c\x02", "abc" * 8))
+    # "xyz", a back reference of 6 bytes at offset 3, then "q".
+    body += key(0, "lzf-short", lzf_string(b"\x02xyz\x80\x02\x00q", "xyzxyzxyzq"))
+    body += key(0, "expire-ms", string("ms"), expire_ms=FUTURE_MS)
+    body += key(0, "expire-s", string("s"), expire_s=FUTURE_S)
+    body += key(0, "expired", string("gone"), expire_ms=PAST_MS)
+    # LRU idle time and LFU frequency of the next keys.
+    body += b"\xf8" + length(1000) + key(0, "idle", string("i"))
+    body += b"\xf9\x05" + key(0, "freq", string("f"))
+    body += b"\xfe\x03" + key(0, "db3", string("three"))
+    return rdb(11, body)
+
+
+def listpacks():
+    body = b"\xfe\x00"
+    body += key(18, "quicklist2", length(3) + length(2) + string(listpack(["a", 100, -5000]))
+                + length(1) + string("plain") + length(2) + string(listpack([1 << 40, "z" * 200])))
+    body += key(20, "set", string(listpack(["m", 42, "n"])))
+    body += key(16, "hash", string(listpack(["c", 3, "d", "four"])))
+    body += key(17, "zset", string(listpack(["r", "3.5", "s", -7])))
+    body += key(5, "zset2", length(2) + string("x") + struct.pack("<d", 2.25) + string("y")
+                + struct.pack("<d", -1))
+    return rdb(11, body)
+
+
+def stream(value_type):
+    entries = [
+        (1700000000000, 0, ["name", "ann", "age", "30"]),
+        (1700000000000, 1, ["name", "bob", "age", "40"]),
+        (1700000000005, 0, ["other", "x"]),
+        (1700000000009, 3, ["name", "cy", "age", "50"]),
+    ]
+    deleted = {(1700000000005, 0)}
+    value = length(1) + string(stream_id(1700000000000, 0))
+    value += string(listpack(stream_node((1700000000000, 0), entries, deleted)))
+    # Length, last ID.
+    value += length(3) + length(1700000000009) + length(3)
+    if value_type >= 19:
+        # First ID, max deleted ID, entries added.
+        value += length(1700000000000) + length(0) + length(1700000000005) + length(0) + length(4)
+    value += length(1)
+    value += string("group") + length(1700000000000) + length(1)
+    if value_type >= 19:
+        value += length(2)
+    value += length(1) + stream_id(1700000000000, 1) + struct.pack("<q", 1700000001000) + length(2)
+    value += length(1) + string("alice") + struct.pack("<q", 1700000002000)
+    if value_type >= 21:
+        value += struct.pack("<q", 1700000001500)
+    value += length(1) + stream_id(1700000000000, 1)
+    return key(value_type, "stream", value)
+
+
+def streams():
+    body = b"\xfe\x00" + stream(15)
+    body2 = b"\xfe\x00" + stream(19)
+    body3 = b"\xfe\x00" + stream(21)
+    return rdb(11, body), rdb(11, body2), rdb(11, body3)
+
+
+def write(name, data):
+    with open(name, "wb") as f:
+        f.write(data)
+
+
+write("strings.rdb", strings())
+write("listpacks.rdb", listpacks())
+v1, v2, v3 = streams()
+write("stream_v1.rdb", v1)
+write("stream_v2.rdb", v2)
+write("stream_v3.rdb", v3)
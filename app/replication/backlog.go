@@ -0,0 +1,84 @@
+package replication
+
+// Backlog is a circular buffer holding the most recent bytes of the
+// replication stream, so a replica that briefly lost its link can resume
+// from its offset instead of requiring a full resynchronization.
+type Backlog struct {
+	buf     []byte
+	idx     int   // next position to write to
+	histlen int   // number of valid bytes in buf
+	offset  int64 // replication offset of the first byte in the backlog
+}
+
+func NewBacklog(size int, offset int64) *Backlog {
+	return &Backlog{buf: make([]byte, size), offset: offset}
+}
+
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+func (b *Backlog) Histlen() int {
+	return b.histlen
+}
+
+// FirstByteOffset returns the replication offset of the oldest byte in the
+// backlog.
+func (b *Backlog) FirstByteOffset() int64 {
+	return b.offset
+}
+
+func (b *Backlog) Write(data []byte) {
+	size := len(b.buf)
+	if size == 0 {
+		b.offset += int64(len(data))
+		return
+	}
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		data = data[n:]
+		b.idx = (b.idx + n) % size
+		b.histlen += n
+	}
+	if b.histlen > size {
+		b.offset += int64(b.histlen - size)
+		b.histlen = size
+	}
+}
+
+// ReadFrom returns the bytes from the given replication offset up to the
+// end of the backlog, or false if that offset is no longer (or not yet)
+// available.
+func (b *Backlog) ReadFrom(offset int64) ([]byte, bool) {
+	end := b.offset + int64(b.histlen)
+	if offset < b.offset || offset > end {
+		return nil, false
+	}
+	n := int(end - offset)
+	data := make([]byte, 0, n)
+	start := (b.idx - n + len(b.buf)) % max(len(b.buf), 1)
+	if start+n <= len(b.buf) {
+		data = append(data, b.buf[start:start+n]...)
+	} else {
+		data = append(data, b.buf[start:]...)
+		data = append(data, b.buf[:n-(len(b.buf)-start)]...)
+	}
+	return data, true
+}
+
+// Resize changes the capacity of the backlog, keeping as much of the most
+// recent history as fits.
+func (b *Backlog) Resize(size int) {
+	if size == len(b.buf) {
+		return
+	}
+	data, _ := b.ReadFrom(b.offset)
+	end := b.offset + int64(b.histlen)
+	if len(data) > size {
+		data = data[len(data)-size:]
+	}
+	b.buf = make([]byte, size)
+	b.idx = copy(b.buf, data) % max(size, 1)
+	b.histlen = len(data)
+	b.offset = end - int64(len(data))
+}
@@ -0,0 +1,45 @@
+package replication
+
+import "testing"
+
+func TestBacklogWrapsAround(t *testing.T) {
+	b := NewBacklog(8, 1)
+	b.Write([]byte("abcdef"))
+	b.Write([]byte("ghij"))
+
+	if b.FirstByteOffset() != 3 || b.Histlen() != 8 {
+		t.Errorf("first byte offset %d, histlen %d, want 3 and 8", b.FirstByteOffset(), b.Histlen())
+	}
+	if data, ok := b.ReadFrom(3); !ok || string(data) != "cdefghij" {
+		t.Errorf("ReadFrom(3) = %q, %v, want cdefghij", data, ok)
+	}
+	if data, ok := b.ReadFrom(9); !ok || string(data) != "ij" {
+		t.Errorf("ReadFrom(9) = %q, %v, want ij", data, ok)
+	}
+	// The offset right after the last byte is available, with nothing to
+	// send.
+	if data, ok := b.ReadFrom(11); !ok || len(data) != 0 {
+		t.Errorf("ReadFrom(11) = %q, %v, want nothing", data, ok)
+	}
+	for _, offset := range []int64{2, 12} {
+		if _, ok := b.ReadFrom(offset); ok {
+			t.Errorf("ReadFrom(%d) succeeded outside the backlog", offset)
+		}
+	}
+}
+
+func TestBacklogResize(t *testing.T) {
+	b := NewBacklog(8, 1)
+	b.Write([]byte("abcdefgh"))
+
+	b.Resize(4)
+	if data, ok := b.ReadFrom(b.FirstByteOffset()); !ok || string(data) != "efgh" || b.FirstByteOffset() != 5 {
+		t.Errorf("after shrinking: %q from offset %d, want efgh from 5", data, b.FirstByteOffset())
+	}
+
+	b.Resize(16)
+	b.Write([]byte("ijkl"))
+	if data, ok := b.ReadFrom(5); !ok || string(data) != "efghijkl" {
+		t.Errorf("after growing: ReadFrom(5) = %q, %v, want efghijkl", data, ok)
+	}
+}
@@ -0,0 +1,198 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Failover starts a coordinated failover (FAILOVER) to the replica listening
+// on host:port, or to the first replica catching up when host is empty.
+// Writes are paused until the replica processed our whole replication stream
+// and we became its replica. If that takes longer than timeout (0 waits
+// forever) the failover is aborted, unless force is set in which case it
+// proceeds anyway.
+func (s *State) Failover(host string, port string, timeout time.Duration, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role != "master" {
+		return errors.New("FAILOVER is not valid when server is a replica.")
+	}
+	if s.failoverState != "no-failover" {
+		return errors.New("FAILOVER already in progress.")
+	}
+	online := 0
+	for _, replica := range s.replicas {
+		if replica.State == "online" {
+			online++
+		}
+	}
+	if online == 0 {
+		return errors.New("FAILOVER requires connected replicas.")
+	}
+	if host != "" {
+		replica := s.findReplica(host, port)
+		if replica == nil {
+			return errors.New("FAILOVER target HOST and PORT is not a replica.")
+		}
+		if replica.State != "online" {
+			return errors.New("FAILOVER target replica is not online.")
+		}
+	}
+
+	s.failoverState = "waiting-for-sync"
+	s.failoverAbort = make(chan struct{})
+	go s.failover(host, port, timeout, force, s.failoverAbort)
+	return nil
+}
+
+// AbortFailover stops the failover in progress (FAILOVER ABORT) and resumes
+// serving writes as a master.
+func (s *State) AbortFailover() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failoverState == "no-failover" {
+		return errors.New("No failover in progress.")
+	}
+	select {
+	case <-s.failoverAbort:
+	default:
+		close(s.failoverAbort)
+	}
+	return nil
+}
+
+// TakeOver handles a PSYNC FAILOVER sent by our master: we are promoted so
+// that it can continue as our replica.
+func (s *State) TakeOver(replID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role != "slave" || replID != s.replID {
+		return errors.New("PSYNC FAILOVER replid must match my replid.")
+	}
+	s.promote()
+	return nil
+}
+
+// failover runs a failover started by Failover until it completes or is
+// aborted.
+func (s *State) failover(host string, port string, timeout time.Duration, force bool, abort chan struct{}) {
+	s.mu.Lock()
+	lock := s.handler.Lock
+	s.mu.Unlock()
+	// Pause writes so that the offset to catch up with stays put.
+	lock.Lock()
+	defer lock.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	s.mu.Lock()
+	offset := s.offset
+	s.feed(resp.ToArray([]any{"REPLCONF", "GETACK", "*"}))
+wait:
+	for {
+		if replica := s.caughtUpReplica(host, port, offset); replica != nil {
+			host, _, _ = net.SplitHostPort(replica.Client.Conn.RemoteAddr().String())
+			port = replica.ListeningPort
+			break wait
+		}
+		acked := s.acked
+		s.mu.Unlock()
+		select {
+		case <-acked:
+		case <-abort:
+			s.endFailover("aborted")
+			return
+		case <-expired:
+			if !force || host == "" {
+				s.endFailover("timed out waiting for the replica to catch up")
+				return
+			}
+			s.mu.Lock()
+			fmt.Println("FAILOVER timed out, forcing failover to", net.JoinHostPort(host, port))
+			break wait
+		}
+		s.mu.Lock()
+	}
+
+	s.failoverState = "failover-in-progress"
+	result := make(chan error, 1)
+	s.failoverResult = result
+	s.replicaOf(host, port)
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-abort:
+		err = errors.New("aborted")
+	}
+	if err != nil {
+		// Go back to being a master; our replicas reconnect to us.
+		s.mu.Lock()
+		s.failoverResult = nil
+		s.promote()
+		s.mu.Unlock()
+		s.endFailover(err.Error())
+		return
+	}
+	s.endFailover("")
+}
+
+// endFailover resets the failover state, logging why it failed if reason is
+// not empty.
+func (s *State) endFailover(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reason != "" {
+		fmt.Println("FAILOVER failed:", reason)
+	}
+	s.failoverState = "no-failover"
+	s.failoverAbort = nil
+}
+
+// failoverDone reports the outcome of the PSYNC FAILOVER sent to our new
+// master, if a failover is in progress. It must be called with s.mu held.
+func (s *State) failoverDone(err error) {
+	if s.failoverResult != nil {
+		s.failoverResult <- err
+		s.failoverResult = nil
+	}
+}
+
+// caughtUpReplica returns the failover target if it acknowledged offset. It
+// must be called with s.mu held.
+func (s *State) caughtUpReplica(host string, port string, offset int64) *Replica {
+	for _, replica := range s.sortedReplicas() {
+		if replica.State != "online" || replica.AckOffset < offset {
+			continue
+		}
+		if host == "" || replica == s.findReplica(host, port) {
+			return replica
+		}
+	}
+	return nil
+}
+
+// findReplica returns the replica listening on host:port. It must be called
+// with s.mu held.
+func (s *State) findReplica(host string, port string) *Replica {
+	for _, replica := range s.sortedReplicas() {
+		replicaHost, _, _ := net.SplitHostPort(replica.Client.Conn.RemoteAddr().String())
+		if replicaHost == host && replica.ListeningPort == port {
+			return replica
+		}
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// ErrNoMasterLink is returned when a replica is asked for a full
+// resynchronization while it is not in sync with its master.
+var ErrNoMasterLink = errors.New("Can't SYNC while not connected with my master")
+
+// replicaOutputLimit is the number of bytes that may be queued for a replica
+// before it is disconnected, like Redis' default client-output-buffer-limit
+// for replicas.
+const replicaOutputLimit = 256 * 1024 * 1024
+
+// Replica is a connected replica as seen from its master.
+type Replica struct {
+	Client        *client.Client
+	ListeningPort string
+	Capa          []string
+	// State is "handshake" until PSYNC, "wait_bgsave" while the snapshot is
+	// being transferred and "online" once the command stream flows.
+	State        string
+	AckOffset    int64
+	LastInteract time.Time
+
+	output *output
+}
+
+// output queues the replication stream of a replica, so that propagating a
+// command never waits for a slow replica. The queue is written to the
+// connection by its own goroutine once the replica is online.
+type output struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	size   int
+	closed bool
+}
+
+func newOutput() *output {
+	o := &output{}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// push queues data and reports whether the queue is still within
+// replicaOutputLimit.
+func (o *output) push(data []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return true
+	}
+	o.queue = append(o.queue, data)
+	o.size += len(data)
+	o.cond.Signal()
+	return o.size <= replicaOutputLimit
+}
+
+// drain writes the queue to c until the output is closed or a write fails.
+func (o *output) drain(c *client.Client) {
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return
+		}
+		queue := o.queue
+		o.queue = nil
+		o.mu.Unlock()
+
+		size := 0
+		for _, data := range queue {
+			if _, err := c.Write(data); err != nil {
+				c.Conn.Close()
+				return
+			}
+			size += len(data)
+		}
+		o.mu.Lock()
+		o.size -= size
+		o.mu.Unlock()
+	}
+}
+
+func (o *output) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.queue = nil
+	o.cond.Signal()
+	o.mu.Unlock()
+}
+
+// ReplConf handles the REPLCONF options a replica sends during the handshake
+// and the acknowledgements it sends afterwards.
+func (s *State) ReplConf(c *client.Client, option string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replica, exists := s.replicas[c.ID]
+	if !exists {
+		replica = &Replica{Client: c, State: "handshake"}
+		s.replicas[c.ID] = replica
+	}
+	replica.LastInteract = time.Now()
+
+	switch strings.ToLower(option) {
+	case "listening-port":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("value is not an integer or out of range")
+		}
+		replica.ListeningPort = value
+	case "capa":
+		replica.Capa = append(replica.Capa, value)
+	case "ack":
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("value is not an integer or out of range")
+		}
+		if offset > replica.AckOffset {
+			replica.AckOffset = offset
+		}
+		close(s.acked)
+		s.acked = make(chan struct{})
+	default:
+		return fmt.Errorf("Unrecognized REPLCONF option: %s", option)
+	}
+	return nil
+}
+
+// ContinuePartial tries to resume the replication stream of a replica that
+// asked for the history identified by replID starting at offset. On success
+// the replica is brought online with the missing bytes from the backlog and
+// true is returned; otherwise a full resynchronization is needed.
+func (s *State) ContinuePartial(c *client.Client, replID string, offset int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backlog == nil {
+		return false
+	}
+	if replID != s.replID && (replID != s.replID2 || offset > s.secondOffset) {
+		return false
+	}
+	data, ok := s.backlog.ReadFrom(offset)
+	if !ok {
+		return false
+	}
+
+	replica, exists := s.replicas[c.ID]
+	if !exists {
+		replica = &Replica{Client: c}
+		s.replicas[c.ID] = replica
+	}
+	reply := "CONTINUE"
+	for _, capa := range replica.Capa {
+		if capa == "psync2" {
+			reply += " " + s.replID
+		}
+	}
+	if replica.output != nil {
+		replica.output.close()
+	}
+	replica.output = newOutput()
+	replica.output.push(append(resp.ToSimpleString(reply), data...))
+	go replica.output.drain(c)
+	replica.State = "online"
+	replica.LastInteract = time.Now()
+	return true
+}
+
+// StartFullResync registers c as a replica that is about to receive a
+// snapshot and returns the FULLRESYNC reply. Commands propagated from now on
+// are buffered until FinishFullResync sent the snapshot, so the caller must
+// make sure no write can happen between taking the snapshot and this call.
+// A replica can only serve a full resynchronization once it is in sync with
+// its own master.
+func (s *State) StartFullResync(c *client.Client) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role == "slave" && s.linkState != "connected" {
+		return nil, ErrNoMasterLink
+	}
+
+	replica, exists := s.replicas[c.ID]
+	if !exists {
+		replica = &Replica{Client: c}
+		s.replicas[c.ID] = replica
+	}
+	replica.State = "wait_bgsave"
+	replica.LastInteract = time.Now()
+	if replica.output != nil {
+		replica.output.close()
+	}
+	replica.output = newOutput()
+	s.createBacklog()
+	return resp.ToSimpleString("FULLRESYNC " + s.replID + " " + strconv.FormatInt(s.offset, 10)), nil
+}
+
+// SupportsEOF reports whether the replica announced it can receive a
+// snapshot of unknown length (REPLCONF capa eof), as needed for diskless
+// replication.
+func (s *State) SupportsEOF(c *client.Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replica, exists := s.replicas[c.ID]; exists {
+		for _, capa := range replica.Capa {
+			if capa == "eof" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SendSnapshot transfers a snapshot of known size, e.g. an RDB file saved to
+// disk, framed like a bulk string without the trailing CRLF.
+func (s *State) SendSnapshot(c *client.Client, payload io.Reader, size int64) error {
+	if _, err := c.Write([]byte("$" + strconv.FormatInt(size, 10) + "\r\n")); err != nil {
+		return err
+	}
+	_, err := io.Copy(c, io.LimitReader(payload, size))
+	return err
+}
+
+// StreamSnapshot transfers a snapshot produced on the fly by write, framed
+// by a random 40 bytes EOF marker since its size is not known upfront.
+func (s *State) StreamSnapshot(c *client.Client, write func(w io.Writer) error) error {
+	mark := NewReplID()
+	if _, err := c.Write([]byte("$EOF:" + mark + "\r\n")); err != nil {
+		return err
+	}
+	if err := write(c); err != nil {
+		return err
+	}
+	_, err := c.Write([]byte(mark))
+	return err
+}
+
+// FinishFullResync brings the replica online: the commands propagated while
+// the snapshot was transferred, and the ones after, are written to it from
+// now on.
+func (s *State) FinishFullResync(c *client.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replica, exists := s.replicas[c.ID]
+	if !exists {
+		return fmt.Errorf("replica disconnected")
+	}
+	go replica.output.drain(c)
+	replica.State = "online"
+	return nil
+}
+
+// disconnectReplicas drops the links to our replicas, e.g. so they learn about
+// a change of replication ID when reconnecting. Replicas still in the
+// handshake have not received anything from us yet and are kept. It must be
+// called with s.mu held.
+func (s *State) disconnectReplicas() {
+	for id, replica := range s.replicas {
+		if replica.State == "handshake" {
+			continue
+		}
+		s.dropReplica(id, replica)
+	}
+}
+
+// dropReplica closes the link to a replica. It must be called with s.mu held.
+func (s *State) dropReplica(id int64, replica *Replica) {
+	if replica.output != nil {
+		replica.output.close()
+	}
+	replica.Client.Conn.Close()
+	delete(s.replicas, id)
+}
+
+func (s *State) RemoveReplica(c *client.Client) {
+	s.mu.Lock()
+	if replica, exists := s.replicas[c.ID]; exists && replica.output != nil {
+		replica.output.close()
+	}
+	delete(s.replicas, c.ID)
+	s.mu.Unlock()
+}
+
+// Propagate sends an already encoded write command to every replica and
+// returns the replication offset after it.
+func (s *State) Propagate(data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role != "master" {
+		return s.offset
+	}
+	s.feed(data)
+	return s.offset
+}
+
+// feed appends data to the replication stream, queueing it for the replicas
+// past the handshake. It must be called with s.mu held.
+func (s *State) feed(data []byte) {
+	s.offset += int64(len(data))
+	if s.backlog != nil {
+		s.backlog.Write(data)
+	}
+	for id, replica := range s.replicas {
+		if replica.State == "handshake" {
+			continue
+		}
+		if !replica.output.push(data) {
+			fmt.Println("Replica", replica.Client.Conn.RemoteAddr().String(), "closed for overcoming of output buffer limits")
+			s.dropReplica(id, replica)
+		}
+	}
+}
+
+// Wait blocks until at least numReplicas replicas acknowledged offset or
+// the timeout expires (0 waits forever), and returns the number of replicas
+// that acknowledged it.
+func (s *State) Wait(numReplicas int, timeout time.Duration, offset int64) int {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	s.mu.Lock()
+	count := s.ackedReplicas(offset)
+	if count >= numReplicas {
+		s.mu.Unlock()
+		return count
+	}
+	s.feed(resp.ToArray([]any{"REPLCONF", "GETACK", "*"}))
+
+	for {
+		acked := s.acked
+		s.mu.Unlock()
+		select {
+		case <-acked:
+		case <-expired:
+			s.mu.Lock()
+			count = s.ackedReplicas(offset)
+			s.mu.Unlock()
+			return count
+		}
+		s.mu.Lock()
+		if count = s.ackedReplicas(offset); count >= numReplicas {
+			s.mu.Unlock()
+			return count
+		}
+	}
+}
+
+// ackedReplicas must be called with s.mu held.
+func (s *State) ackedReplicas(offset int64) int {
+	count := 0
+	for _, replica := range s.replicas {
+		if replica.State == "online" && replica.AckOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,180 @@
+package replication
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+)
+
+// newReplica connects a replica through a pipe and returns the other end.
+func newReplica(t *testing.T, s *State) (*client.Client, net.Conn) {
+	t.Helper()
+	server, peer := net.Pipe()
+	c := client.New(server)
+	t.Cleanup(func() {
+		s.RemoveReplica(c)
+		client.Remove(c.ID)
+		server.Close()
+		peer.Close()
+	})
+	if err := s.ReplConf(c, "capa", "psync2"); err != nil {
+		t.Fatal(err)
+	}
+	return c, peer
+}
+
+func expectStream(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != want {
+		t.Errorf("replica received %q (%v), want %q", buf, err, want)
+	}
+}
+
+func TestFullResync(t *testing.T) {
+	s := New()
+	c, conn := newReplica(t, s)
+
+	reply, err := s.StartFullResync(c)
+	if err != nil {
+		t.Fatalf("StartFullResync: %v", err)
+	}
+	fields := strings.Fields(strings.TrimSpace(string(reply)))
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" || fields[2] != "0" {
+		t.Fatalf("StartFullResync = %q", reply)
+	}
+
+	// Commands propagated while the snapshot is transferred are queued,
+	// without waiting for the replica, and sent once it is online.
+	if offset := s.Propagate([]byte("first")); offset != 5 {
+		t.Errorf("offset after propagating = %d, want 5", offset)
+	}
+	if err := s.FinishFullResync(c); err != nil {
+		t.Fatalf("FinishFullResync: %v", err)
+	}
+	s.Propagate([]byte("second"))
+	expectStream(t, conn, "firstsecond")
+}
+
+// fullResync brings a new replica online and returns its replication ID
+// along with the replica end of its connection.
+func fullResync(t *testing.T, s *State) (string, net.Conn) {
+	t.Helper()
+	c, conn := newReplica(t, s)
+	reply, err := s.StartFullResync(c)
+	if err != nil {
+		t.Fatalf("StartFullResync: %v", err)
+	}
+	fields := strings.Fields(strings.TrimSpace(string(reply)))
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("StartFullResync = %q", reply)
+	}
+	if err := s.FinishFullResync(c); err != nil {
+		t.Fatalf("FinishFullResync: %v", err)
+	}
+	return fields[1], conn
+}
+
+func TestPartialResync(t *testing.T) {
+	s := New()
+	replID, conn := fullResync(t, s)
+	s.Propagate([]byte("first"))
+	s.Propagate([]byte("second"))
+	expectStream(t, conn, "firstsecond")
+
+	// Another replica that already has the first command resumes from the
+	// backlog.
+	c, conn2 := newReplica(t, s)
+	if !s.ContinuePartial(c, replID, 6) {
+		t.Fatalf("ContinuePartial refused an offset in the backlog")
+	}
+	expectStream(t, conn2, "+CONTINUE "+replID+"\r\nsecond")
+
+	if s.ContinuePartial(c, replID, 100) {
+		t.Errorf("ContinuePartial accepted an offset past the backlog")
+	}
+	if s.ContinuePartial(c, NewReplID(), 6) {
+		t.Errorf("ContinuePartial accepted another replication ID")
+	}
+}
+
+func TestWait(t *testing.T) {
+	s := New()
+	c, conn := newReplica(t, s)
+	if _, err := s.StartFullResync(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FinishFullResync(c); err != nil {
+		t.Fatal(err)
+	}
+	offset := s.Propagate([]byte("SET key value"))
+	expectStream(t, conn, "SET key value")
+
+	if n := s.Wait(1, 50*time.Millisecond, offset); n != 0 {
+		t.Errorf("Wait without acknowledgements = %d, want 0", n)
+	}
+	// WAIT asks the replica for an acknowledgement.
+	expectStream(t, conn, "*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ReplConf(c, "ack", "5")
+		s.ReplConf(c, "ack", strconv.FormatInt(offset, 10))
+	}()
+	if n := s.Wait(1, 0, offset); n != 1 {
+		t.Errorf("Wait after an acknowledgement = %d, want 1", n)
+	}
+	// An older acknowledgement does not move the offset back.
+	s.ReplConf(c, "ack", "1")
+	if n := s.Wait(1, 50*time.Millisecond, offset); n != 1 {
+		t.Errorf("Wait after an older acknowledgement = %d, want 1", n)
+	}
+}
+
+func TestSlowReplicaDoesNotBlock(t *testing.T) {
+	s := New()
+	c, _ := newReplica(t, s)
+	if _, err := s.StartFullResync(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FinishFullResync(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica never reads: propagating must not wait for it.
+	done := make(chan struct{})
+	go func() {
+		for range 100 {
+			s.Propagate([]byte("SET key value"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Propagate blocked on a replica that does not read")
+	}
+}
+
+func TestReplicaOverOutputLimit(t *testing.T) {
+	s := New()
+	c, conn := newReplica(t, s)
+	if _, err := s.StartFullResync(c); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Propagate(make([]byte, replicaOutputLimit+1))
+	if strings.Contains(s.Info(), "connected_slaves:1") {
+		t.Errorf("replica over the output limit still connected")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from a dropped replica: err = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,398 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// Handler is used by a replica to apply what it receives from its master.
+type Handler struct {
+	// Load replaces the whole keyspace with the RDB snapshot sent by the
+	// master, read from payload.
+	Load func(payload io.Reader) error
+	// Apply executes a single command propagated by the master.
+	Apply func(master *client.Client, commands resp.Value)
+	// Lock is held while a command from the master is applied and forwarded
+	// to our own replicas, so a snapshot taken under it matches our offset.
+	Lock sync.Locker
+}
+
+// Configure sets what a replica needs to attach to a master: the port it
+// announces and how to apply the data it receives.
+func (s *State) Configure(listeningPort string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeningPort = listeningPort
+	s.handler = h
+}
+
+// ReplicaOf makes this server a replica of host:port. The link is established
+// in the background and re-established with backoff whenever it breaks.
+func (s *State) ReplicaOf(host string, port string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replicaOf(host, port)
+}
+
+// replicaOf must be called with s.mu held.
+func (s *State) replicaOf(host string, port string) {
+	if s.role == "slave" && s.masterHost == host && s.masterPort == port {
+		return
+	}
+	if s.role == "master" {
+		// Our own history is what we attempt to continue from the new master,
+		// which succeeds if it was one of our replicas.
+		s.createBacklog()
+		s.synced = true
+	}
+	s.disconnectReplicas()
+	if s.master != nil {
+		s.master.Conn.Close()
+	}
+	s.generation++
+	s.role = "slave"
+	s.masterHost = host
+	s.masterPort = port
+	s.linkState = "connect"
+	go s.run(s.generation)
+}
+
+// Promote turns a replica into a master (REPLICAOF NO ONE). The replication
+// ID of the old master is kept as the secondary ID so that other replicas of
+// it can partially resynchronize with us.
+func (s *State) Promote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.promote()
+}
+
+// promote must be called with s.mu held.
+func (s *State) promote() {
+	if s.role == "master" {
+		return
+	}
+	if s.master != nil {
+		s.master.Conn.Close()
+	}
+	s.generation++
+	s.role = "master"
+	s.masterHost = ""
+	s.masterPort = ""
+	s.linkState = ""
+	s.syncInProgress = false
+	s.createBacklog()
+	s.replID2 = s.replID
+	s.secondOffset = s.offset + 1
+	s.replID = NewReplID()
+	// Our replicas reconnect and continue with the new replication ID.
+	s.disconnectReplicas()
+}
+
+// run keeps the link to the master configured by the given generation of
+// ReplicaOf alive until the configuration changes.
+func (s *State) run(generation int) {
+	delay := minReconnectDelay
+	for {
+		s.mu.Lock()
+		if s.generation != generation {
+			s.mu.Unlock()
+			return
+		}
+		addr := net.JoinHostPort(s.masterHost, s.masterPort)
+		s.linkState = "connecting"
+		s.mu.Unlock()
+
+		conn, err := net.DialTimeout("tcp", addr, maxReconnectDelay)
+		if err == nil {
+			master := client.New(conn)
+			master.Flags |= client.FlagMaster
+
+			s.mu.Lock()
+			current := s.generation == generation
+			if current {
+				s.master = master
+			}
+			s.mu.Unlock()
+			if !current {
+				conn.Close()
+				client.Remove(master.ID)
+				return
+			}
+
+			synced, err := s.sync(master)
+			conn.Close()
+			client.Remove(master.ID)
+			fmt.Println("Replication link to", addr, "closed: ", err)
+			s.mu.Lock()
+			s.failoverDone(err)
+			s.mu.Unlock()
+			if synced {
+				delay = minReconnectDelay
+			}
+		} else {
+			fmt.Println("Failed to connect to master: ", err.Error())
+			s.mu.Lock()
+			s.failoverDone(err)
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		if s.generation == generation {
+			s.linkState = "connect"
+		}
+		s.mu.Unlock()
+		time.Sleep(delay)
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// SendAck reports the offset processed so far to our master.
+func (s *State) SendAck() {
+	s.mu.Lock()
+	master, offset := s.master, s.offset
+	if s.linkState != "connected" {
+		master = nil
+	}
+	s.mu.Unlock()
+	if master != nil {
+		master.ForceWrite(resp.ToArray([]any{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}))
+	}
+}
+
+// sync runs the replica side of replication over the link to the master: it
+// performs the handshake, receives and loads the RDB snapshot of a full
+// resynchronization (or continues a partial one) and then applies the
+// command stream until the link breaks. It reports whether the
+// synchronization succeeded before the link broke.
+func (s *State) sync(master *client.Client) (bool, error) {
+	conn := master.Conn
+	r := resp.NewReader(conn)
+	defer func() {
+		s.mu.Lock()
+		if s.master == master {
+			s.master = nil
+			s.syncInProgress = false
+		}
+		s.mu.Unlock()
+	}()
+
+	s.mu.Lock()
+	s.linkState = "handshake"
+	listeningPort, h := s.listeningPort, s.handler
+	s.mu.Unlock()
+
+	if err := command(conn, r, "PING"); err != nil {
+		return false, fmt.Errorf("error sending PING to master: %v", err)
+	}
+	if err := command(conn, r, "REPLCONF", "listening-port", listeningPort); err != nil {
+		return false, fmt.Errorf("error sending REPLCONF listening-port to master: %v", err)
+	}
+	if err := command(conn, r, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return false, fmt.Errorf("error sending REPLCONF capa to master: %v", err)
+	}
+
+	s.mu.Lock()
+	psync := []any{"PSYNC", "?", "-1"}
+	if s.synced {
+		psync = []any{"PSYNC", s.replID, strconv.FormatInt(s.offset+1, 10)}
+	}
+	if s.failoverState == "failover-in-progress" {
+		// Asks our replica to take over as the master.
+		psync = append(psync, "FAILOVER")
+	}
+	s.linkState = "sync"
+	s.mu.Unlock()
+	if _, err := conn.Write(resp.ToArray(psync)); err != nil {
+		return false, fmt.Errorf("error sending PSYNC to master: %v", err)
+	}
+	reply, _, err := r.ReadValue()
+	if err != nil {
+		return false, fmt.Errorf("error reading PSYNC reply: %v", err)
+	}
+	fields := strings.Fields(reply.String)
+	if reply.Type != resp.RESPTypeError {
+		s.mu.Lock()
+		s.failoverDone(nil)
+		s.mu.Unlock()
+	}
+	if reply.Type == resp.RESPTypeSimpleString && len(fields) > 0 && fields[0] == "CONTINUE" {
+		s.mu.Lock()
+		if len(fields) == 2 && fields[1] != s.replID {
+			// The master changed its replication ID, e.g. after a failover.
+			s.replID2 = s.replID
+			s.secondOffset = s.offset + 1
+			s.replID = fields[1]
+			s.disconnectReplicas()
+		}
+		s.mu.Unlock()
+	} else {
+		if reply.Type != resp.RESPTypeSimpleString || len(fields) != 3 || fields[0] != "FULLRESYNC" {
+			return false, fmt.Errorf("unexpected PSYNC reply: %q", reply.String)
+		}
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid FULLRESYNC offset: %v", err)
+		}
+
+		s.mu.Lock()
+		s.syncInProgress = true
+		s.mu.Unlock()
+
+		payload, err := readRDB(r)
+		if err != nil {
+			return false, fmt.Errorf("error receiving RDB from master: %v", err)
+		}
+		if err := h.Load(payload); err != nil {
+			return false, fmt.Errorf("error loading RDB from master: %v", err)
+		}
+		// Make sure the stream is positioned right after the snapshot.
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return false, fmt.Errorf("error receiving RDB from master: %v", err)
+		}
+
+		s.mu.Lock()
+		s.replID = fields[1]
+		s.replID2 = strings.Repeat("0", 40)
+		s.secondOffset = -1
+		s.offset = offset
+		s.backlog = nil
+		s.createBacklog()
+		s.synced = true
+		s.syncInProgress = false
+		s.disconnectReplicas()
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.linkState = "connected"
+	s.mu.Unlock()
+	s.SendAck()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.SendAck()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		commands, data, err := r.ReadRawValue()
+		if err != nil {
+			return true, err
+		}
+		h.Lock.Lock()
+		if commands.Type == resp.RESPTypeArray && len(commands.Array) > 0 {
+			h.Apply(master, commands)
+		}
+		// Our replicas get the exact stream we received, so that offsets
+		// match along the whole chain.
+		s.mu.Lock()
+		s.feed(data)
+		s.mu.Unlock()
+		h.Lock.Unlock()
+	}
+}
+
+// command sends a handshake command to the master and waits for its reply.
+func command(conn net.Conn, r *resp.Reader, args ...any) error {
+	if _, err := conn.Write(resp.ToArray(args)); err != nil {
+		return err
+	}
+	reply, _, err := r.ReadValue()
+	if err != nil {
+		return err
+	}
+	if reply.Type == resp.RESPTypeError {
+		return fmt.Errorf("master replied with error: %s", reply.String)
+	}
+	return nil
+}
+
+// readRDB returns a reader over the snapshot of a full resynchronization,
+// which is either sent like a bulk string without the trailing CRLF, or for
+// diskless replication as "$EOF:<mark>" followed by the payload and the mark.
+func readRDB(r *resp.Reader) (io.Reader, error) {
+	var line string
+	for line == "" {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		// The master may send newlines to keep the link alive while it
+		// prepares the snapshot.
+		line = strings.TrimSpace(l)
+	}
+	if line[0] != byte(resp.RESPTypeBulkString) {
+		return nil, fmt.Errorf("invalid RDB header: %q", line)
+	}
+	if mark, found := strings.CutPrefix(line, "$EOF:"); found {
+		if len(mark) != eofMarkLength {
+			return nil, fmt.Errorf("invalid EOF mark: %q", mark)
+		}
+		return &eofReader{r: r.Reader, mark: []byte(mark)}, nil
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDB size: %v", err)
+	}
+	return io.LimitReader(r, size), nil
+}
+
+const eofMarkLength = 40
+
+// eofReader reads a diskless snapshot up to its EOF mark, leaving the
+// command stream that follows it in the underlying reader.
+type eofReader struct {
+	r    *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	if _, err := e.r.Peek(len(e.mark)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	window, _ := e.r.Peek(e.r.Buffered())
+	if i := bytes.Index(window, e.mark); i >= 0 {
+		n := copy(p, window[:i])
+		e.r.Discard(n)
+		if n == i {
+			e.r.Discard(len(e.mark))
+			e.done = true
+		}
+		return n, nil
+	}
+	// The mark may start in the last bytes of the window.
+	n := copy(p, window[:len(window)-len(e.mark)+1])
+	e.r.Discard(n)
+	return n, nil
+}
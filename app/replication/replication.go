@@ -1,11 +1,204 @@
 package replication
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
 )
 
-func SendHandshake(conn net.Conn, Config *map[string]string) {
-	conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
-	conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n" + (*Config)["master_port"] + "\r\n"))
-	conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"))
+// State holds the replication role of this server and, for replicas, the
+// state of the link to the master.
+type State struct {
+	mu         sync.Mutex
+	role       string
+	masterHost string
+	masterPort string
+	// linkState is the state of the link to our master: "connect",
+	// "connecting", "handshake", "sync" or "connected".
+	linkState      string
+	syncInProgress bool
+	replID         string
+	offset         int64
+	replicas       map[int64]*Replica
+
+	// replID2 is the ID of our previous master (or of ourselves before a
+	// promotion) and secondOffset the offset up to which it is valid, so
+	// replicas of that history can still partially resynchronize.
+	replID2      string
+	secondOffset int64
+	backlog      *Backlog
+	backlogSize  int
+	// synced is set once the replica has data from its master's history and
+	// can attempt a partial resynchronization when reconnecting.
+	synced bool
+	// master is the link to our master while connected.
+	master        *client.Client
+	listeningPort string
+	handler       Handler
+	// generation is bumped whenever the master changes, so that the
+	// goroutine serving a previous link stops reconnecting.
+	generation int
+	// acked is closed and replaced whenever a replica acknowledges an offset,
+	// waking up WAIT callers.
+	acked chan struct{}
+
+	// failoverState is "no-failover", "waiting-for-sync" or
+	// "failover-in-progress" while a FAILOVER is coordinated.
+	failoverState  string
+	failoverAbort  chan struct{}
+	failoverResult chan error
+}
+
+func New() *State {
+	return &State{
+		role:          "master",
+		replID:        NewReplID(),
+		replicas:      make(map[int64]*Replica),
+		replID2:       strings.Repeat("0", 40),
+		secondOffset:  -1,
+		backlogSize:   1024 * 1024,
+		acked:         make(chan struct{}),
+		failoverState: "no-failover",
+	}
+}
+
+func (s *State) SetBacklogSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backlogSize = size
+	if s.backlog != nil {
+		s.backlog.Resize(size)
+	}
+}
+
+// createBacklog must be called with s.mu held.
+func (s *State) createBacklog() {
+	if s.backlog == nil {
+		s.backlog = NewBacklog(s.backlogSize, s.offset+1)
+	}
+}
+
+// NewReplID returns a random 40 characters replication ID.
+func NewReplID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (s *State) Role() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.role
+}
+
+// ReplID returns the current replication ID and offset, which a snapshot
+// taken now matches.
+func (s *State) ReplID() (string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replID, s.offset
+}
+
+func (s *State) Info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := "# Replication\n" +
+		"role:" + s.role + "\n"
+	if s.role == "slave" {
+		syncInProgress := "0"
+		if s.syncInProgress {
+			syncInProgress = "1"
+		}
+		linkStatus := "down"
+		if s.linkState == "connected" {
+			linkStatus = "up"
+		}
+		info += "master_host:" + s.masterHost + "\n" +
+			"master_port:" + s.masterPort + "\n" +
+			"master_link_status:" + linkStatus + "\n" +
+			"master_sync_in_progress:" + syncInProgress + "\n" +
+			"slave_repl_offset:" + strconv.FormatInt(s.offset, 10) + "\n"
+	}
+	info += "connected_slaves:" + strconv.Itoa(s.connectedReplicas()) + "\n"
+	i := 0
+	for _, replica := range s.sortedReplicas() {
+		if replica.State == "handshake" {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(replica.Client.Conn.RemoteAddr().String())
+		lag := int(time.Since(replica.LastInteract).Seconds())
+		info += "slave" + strconv.Itoa(i) + ":ip=" + host + ",port=" + replica.ListeningPort +
+			",state=" + replica.State + ",offset=" + strconv.FormatInt(replica.AckOffset, 10) +
+			",lag=" + strconv.Itoa(lag) + "\n"
+		i++
+	}
+	info += "master_failover_state:" + s.failoverState + "\n" +
+		"master_replid:" + s.replID + "\n" +
+		"master_replid2:" + s.replID2 + "\n" +
+		"master_repl_offset:" + strconv.FormatInt(s.offset, 10) + "\n" +
+		"second_repl_offset:" + strconv.FormatInt(s.secondOffset, 10) + "\n"
+	if s.backlog != nil {
+		info += "repl_backlog_active:1\n" +
+			"repl_backlog_size:" + strconv.Itoa(s.backlog.Size()) + "\n" +
+			"repl_backlog_first_byte_offset:" + strconv.FormatInt(s.backlog.FirstByteOffset(), 10) + "\n" +
+			"repl_backlog_histlen:" + strconv.Itoa(s.backlog.Histlen()) + "\n"
+	} else {
+		info += "repl_backlog_active:0\n" +
+			"repl_backlog_size:" + strconv.Itoa(s.backlogSize) + "\n" +
+			"repl_backlog_first_byte_offset:0\n" +
+			"repl_backlog_histlen:0\n"
+	}
+	return info
+}
+
+// RoleInfo returns the reply of the ROLE command.
+func (s *State) RoleInfo() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role == "slave" {
+		offset := int(s.offset)
+		if !s.synced {
+			offset = -1
+		}
+		port, _ := strconv.Atoi(s.masterPort)
+		return []any{"slave", s.masterHost, port, s.linkState, offset}
+	}
+
+	replicas := []any{}
+	for _, replica := range s.sortedReplicas() {
+		if replica.State != "online" {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(replica.Client.Conn.RemoteAddr().String())
+		replicas = append(replicas, []any{host, replica.ListeningPort, strconv.FormatInt(replica.AckOffset, 10)})
+	}
+	return []any{"master", int(s.offset), replicas}
+}
+
+func (s *State) connectedReplicas() int {
+	count := 0
+	for _, replica := range s.replicas {
+		if replica.State != "handshake" {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *State) sortedReplicas() []*Replica {
+	replicas := make([]*Replica, 0, len(s.replicas))
+	for _, replica := range s.replicas {
+		replicas = append(replicas, replica)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].Client.ID < replicas[j].Client.ID })
+	return replicas
 }
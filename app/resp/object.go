@@ -0,0 +1,98 @@
+package resp
+
+import "fmt"
+
+// Object is the value of a key holding another type than a string: a list,
+// set, hash, sorted set or stream. They are created by loading RDB files and
+// DUMP payloads, and kept as they are by saves, DUMP and MIGRATE.
+type Object interface {
+	// TypeName returns the type of the value, as reported by TYPE.
+	TypeName() string
+}
+
+// List holds the elements of a list, from head to tail.
+type List []string
+
+// Set holds the members of a set.
+type Set map[string]struct{}
+
+// Hash maps the fields of a hash to their values.
+type Hash map[string]string
+
+// SortedSet holds the members of a sorted set, ordered by score then member.
+type SortedSet []SortedSetMember
+
+type SortedSetMember struct {
+	Member string
+	Score  float64
+}
+
+// StreamID identifies a stream entry: a Unix time in milliseconds and a
+// sequence number among the entries added in that millisecond.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id comes before other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+type Stream struct {
+	// Entries holds the entries in ID order, deleted ones excluded.
+	Entries []StreamEntry
+	LastID  StreamID
+	// FirstID, MaxDeletedID and EntriesAdded track the history of the
+	// stream, to tell consumer groups how far behind they are.
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+type StreamEntry struct {
+	ID StreamID
+	// Fields holds the field names and values, alternating.
+	Fields []string
+}
+
+type StreamGroup struct {
+	Name   string
+	LastID StreamID
+	// EntriesRead is the number of entries the group read, or -1 when it is
+	// unknown.
+	EntriesRead int64
+	// Pending holds the entries delivered to the consumers of the group but
+	// not acknowledged yet.
+	Pending   []StreamPendingEntry
+	Consumers []StreamConsumer
+}
+
+type StreamPendingEntry struct {
+	ID StreamID
+	// DeliveryTime is the Unix time in milliseconds of the last delivery.
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+type StreamConsumer struct {
+	Name string
+	// SeenTime and ActiveTime are the Unix times in milliseconds of the
+	// last interaction of the consumer and of its last successful read.
+	SeenTime   int64
+	ActiveTime int64
+	// Pending holds the IDs of the group's pending entries owned by the
+	// consumer.
+	Pending []StreamID
+}
+
+func (List) TypeName() string      { return "list" }
+func (Set) TypeName() string       { return "set" }
+func (Hash) TypeName() string      { return "hash" }
+func (SortedSet) TypeName() string { return "zset" }
+func (*Stream) TypeName() string   { return "stream" }
@@ -1,9 +1,13 @@
 package resp
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +23,8 @@ const (
 	RESPTypeBoolean      RESP = '#'
 	RESPTypeDouble       RESP = ','
 	RESPTypeBigNumber    RESP = '('
+	RESPTypeMap          RESP = '%'
+	RESPTypePush         RESP = '>'
 )
 
 type Value struct {
@@ -33,10 +39,21 @@ type Value struct {
 }
 
 type StoreValue struct {
-	Value    Value
+	// String holds the value of string keys, and Object the value of the
+	// other types.
+	String   String
+	Object   Object
 	ExpireAt time.Time // Zero time means no expiration
 }
 
+// TypeName returns the type of the value, as reported by TYPE.
+func (v StoreValue) TypeName() string {
+	if v.Object != nil {
+		return v.Object.TypeName()
+	}
+	return "string"
+}
+
 type Database struct {
 	ID        uint8
 	Store     map[string]StoreValue
@@ -51,6 +68,19 @@ func NewDatabase(id uint8) Database {
 	}
 }
 
+// Copy returns a point-in-time copy of the database that is not affected by
+// later writes, e.g. to serialize it without holding locks.
+func (db Database) Copy() Database {
+	snapshot := NewDatabase(db.ID)
+	for key, value := range db.Store {
+		snapshot.Store[key] = value
+	}
+	for timestamp, key := range db.ExpiryMap {
+		snapshot.ExpiryMap[timestamp] = key
+	}
+	return snapshot
+}
+
 func NewBulkString(value string) Value {
 	return Value{Type: RESPTypeBulkString, String: value}
 }
@@ -59,8 +89,12 @@ func NewSimpleString(value string) Value {
 	return Value{Type: RESPTypeSimpleString, String: value}
 }
 
-func NewStoreValue(value Value, expireAt time.Time) StoreValue {
-	return StoreValue{Value: value, ExpireAt: expireAt}
+func NewStoreValue(value String, expireAt time.Time) StoreValue {
+	return StoreValue{String: value, ExpireAt: expireAt}
+}
+
+func NewStoreObject(object Object, expireAt time.Time) StoreValue {
+	return StoreValue{Object: object, ExpireAt: expireAt}
 }
 
 func NewInteger(value int) Value {
@@ -297,6 +331,17 @@ func ToBulkString(value string) []byte {
 	return buf
 }
 
+// ToBulkBytes encodes a binary-safe bulk string. Unlike ToBulkString, an
+// empty value is not sent as null.
+func ToBulkBytes(value []byte) []byte {
+	buf := make([]byte, 0, len(value)+16)
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(value)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, value...)
+	return append(buf, '\r', '\n')
+}
+
 func ToSimpleString(value string) []byte {
 	if value == "" {
 		return []byte("+\r\n")
@@ -334,6 +379,19 @@ func ToError(value string) []byte {
 	return buf
 }
 
+// ToErrorWithCode encodes an error reply starting with a specific error code
+// instead of ERR, e.g. READONLY or MOVED.
+func ToErrorWithCode(code string, value string) []byte {
+	var buf []byte
+	buf = append(buf, '-')
+	buf = append(buf, []byte(code)...)
+	buf = append(buf, ' ')
+	buf = append(buf, []byte(value)...)
+	buf = append(buf, '\r')
+	buf = append(buf, '\n')
+	return buf
+}
+
 func ToBoolean(value bool) []byte {
 	if value {
 		return []byte("#t\r\n")
@@ -382,6 +440,11 @@ func ToArray(value []any) []byte {
 		case int64:
 			bigNumber := ToBigNumber(v)
 			buf = append(buf, bigNumber...)
+		case []any:
+			array := ToArray(v)
+			buf = append(buf, array...)
+		case nil:
+			buf = append(buf, []byte("$-1\r\n")...)
 		default:
 			str := ToBulkString(v.(string))
 			buf = append(buf, str...)
@@ -389,3 +452,128 @@ func ToArray(value []any) []byte {
 	}
 	return buf
 }
+
+// ToMap encodes a RESP3 map from a flat list of key, value pairs.
+func ToMap(pairs []any) []byte {
+	buf := ToArray(pairs)
+	header := bytes.IndexByte(buf, '\n')
+	var out []byte
+	out = append(out, byte(RESPTypeMap))
+	out = append(out, []byte(strconv.Itoa(len(pairs)/2))...)
+	out = append(out, '\r')
+	out = append(out, '\n')
+	return append(out, buf[header+1:]...)
+}
+
+// ToPush encodes a RESP3 out-of-band push message.
+func ToPush(value []any) []byte {
+	buf := ToArray(value)
+	buf[0] = byte(RESPTypePush)
+	return buf
+}
+
+// MaxMultibulkLen and MaxBulkLen bound the element count of an array and
+// the size of a bulk string read from a stream, as Redis does, so a peer
+// cannot make us allocate an arbitrary amount of memory.
+const (
+	MaxMultibulkLen = math.MaxInt32
+	MaxBulkLen      = 512 * 1024 * 1024
+)
+
+// Reader reads RESP values from a stream, e.g. a client or replication
+// connection, where a single read may contain several pipelined commands or
+// only part of one.
+type Reader struct {
+	*bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{Reader: bufio.NewReader(r)}
+}
+
+// ReadValue reads the next value from the stream and returns it along with
+// the number of bytes it occupied.
+func (r *Reader) ReadValue() (Value, int, error) {
+	return r.read(nil)
+}
+
+// ReadRawValue reads the next value from the stream and also returns the
+// exact bytes it was encoded with, e.g. to forward a replication stream.
+func (r *Reader) ReadRawValue() (Value, []byte, error) {
+	var raw []byte
+	value, _, err := r.read(&raw)
+	return value, raw, err
+}
+
+func (r *Reader) read(raw *[]byte) (Value, int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Value{}, len(line), err
+	}
+	n := len(line)
+	if raw != nil {
+		*raw = append(*raw, line...)
+	}
+
+	switch RESP(line[0]) {
+	case RESPTypeArray, RESPTypePush:
+		count, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil || count < -1 || count > MaxMultibulkLen {
+			return Value{}, n, fmt.Errorf("invalid multibulk length")
+		}
+		if count == -1 {
+			return Value{Type: RESPTypeArray, IsNull: true}, n, nil
+		}
+		// The array grows as its elements arrive rather than trusting the
+		// declared count.
+		array := make([]Value, 0, min(count, 1024))
+		for range count {
+			value, m, err := r.read(raw)
+			n += m
+			if err != nil {
+				return Value{}, n, err
+			}
+			array = append(array, value)
+		}
+		return Value{Type: RESPTypeArray, Array: array}, n, nil
+	case RESPTypeBulkString:
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil || size < -1 || size > MaxBulkLen {
+			return Value{}, n, fmt.Errorf("invalid bulk length")
+		}
+		if size == -1 {
+			return Value{Type: RESPTypeBulkString, IsNull: true}, n, nil
+		}
+		// Like arrays, the buffer grows as data arrives, so a large
+		// declared size costs nothing until it is actually sent.
+		var data bytes.Buffer
+		data.Grow(min(size+2, 64*1024))
+		m, err := io.CopyN(&data, r.Reader, int64(size+2))
+		n += int(m)
+		buf := data.Bytes()
+		if raw != nil {
+			*raw = append(*raw, buf...)
+		}
+		if err == io.EOF && m > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return Value{}, n, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return Value{}, n, fmt.Errorf("invalid bulk string terminator")
+		}
+		return Value{Type: RESPTypeBulkString, String: string(buf[:size])}, n, nil
+	case RESPTypeSimpleString, RESPTypeError, RESPTypeInteger, RESPTypeNull, RESPTypeBoolean, RESPTypeDouble, RESPTypeBigNumber:
+		value, _, err := Parse([]byte(line))
+		return value, n, err
+	default:
+		// Inline commands, as sent by telnet-like clients.
+		args := strings.Fields(line)
+		array := make([]Value, len(args))
+		for i, arg := range args {
+			array[i] = NewBulkString(arg)
+		}
+		return Value{Type: RESPTypeArray, Array: array}, n, nil
+	}
+}
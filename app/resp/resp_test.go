@@ -0,0 +1,52 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReaderLimits(t *testing.T) {
+	for _, input := range []string{
+		"*99999999999999\r\n",
+		"*-2\r\n",
+		"$99999999999999\r\n",
+		"$536870913\r\n",
+		"$-5\r\n",
+		"*1\r\n$-2\r\n",
+	} {
+		r := NewReader(strings.NewReader(input))
+		if _, _, err := r.ReadValue(); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("ReadValue(%q): err = %v, want a protocol error", input, err)
+		}
+	}
+}
+
+func TestReaderDeclaredSizes(t *testing.T) {
+	// A large declared count or size is not allocated up front: the read
+	// fails once the stream ends.
+	for _, input := range []string{"*2147483647\r\n$1\r\na\r\n", "$536870912\r\nabc"} {
+		r := NewReader(strings.NewReader(input))
+		if _, _, err := r.ReadValue(); err == nil {
+			t.Errorf("ReadValue(%q) succeeded", input)
+		}
+	}
+
+	r := NewReader(strings.NewReader("*-1\r\n$-1\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	for _, want := range []string{"null", "null", "GET k"} {
+		value, _, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue: %v", err)
+		}
+		got := "null"
+		if !value.IsNull {
+			var args []string
+			for _, v := range value.Array {
+				args = append(args, v.String)
+			}
+			got = strings.Join(args, " ")
+		}
+		if got != want {
+			t.Errorf("ReadValue = %q, want %q", got, want)
+		}
+	}
+}
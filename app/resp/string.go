@@ -0,0 +1,43 @@
+package resp
+
+import "strconv"
+
+// String is the value of a string key. It is binary safe: it always reads
+// back as the exact bytes it was set to. Like Redis' int encoding, a string
+// holding the canonical decimal representation of a 64-bit integer keeps the
+// integer instead, which is smaller and what RDB files store.
+type String struct {
+	bytes     []byte
+	integer   int64
+	isInteger bool
+}
+
+// NewString returns a string holding value. The slice is kept as is and
+// shared by copies of the database, so it must not be modified afterwards.
+func NewString(value []byte) String {
+	// The longest int64 is 20 bytes, sign included.
+	if len(value) > 0 && len(value) <= 20 {
+		if n, err := strconv.ParseInt(string(value), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(value) {
+			return String{integer: n, isInteger: true}
+		}
+	}
+	return String{bytes: value}
+}
+
+func NewIntegerString(value int64) String {
+	return String{integer: value, isInteger: true}
+}
+
+// Bytes returns the content of the string.
+func (s String) Bytes() []byte {
+	if s.isInteger {
+		return strconv.AppendInt(nil, s.integer, 10)
+	}
+	return s.bytes
+}
+
+// Integer returns the integer the string holds, when it is the canonical
+// representation of one: "7" is, "007" and "+7" are not.
+func (s String) Integer() (int64, bool) {
+	return s.integer, s.isInteger
+}
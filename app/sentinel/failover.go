@@ -0,0 +1,271 @@
+package sentinel
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	tickPeriod = 100 * time.Millisecond
+	askPeriod  = time.Second
+	// electionTimeout bounds the time spent collecting votes.
+	electionTimeout = 10 * time.Second
+	// maxDesync is the largest random delay added to the start of a
+	// failover, so that sentinels seeing the master down at the same time
+	// do not keep splitting the vote.
+	maxDesync = time.Second
+)
+
+// monitor detects when the master is down and drives its failover.
+func (s *Sentinel) monitor(m *Master) {
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+
+	var lastAsk time.Time
+	for range ticker.C {
+		s.mu.Lock()
+		s.checkDown(m)
+		if m.sdown && time.Since(lastAsk) >= askPeriod {
+			s.askSentinels(m)
+			lastAsk = time.Now()
+		}
+		s.checkFailover(m)
+		s.mu.Unlock()
+	}
+}
+
+// checkDown updates the subjectively down (no valid reply for DownAfter) and
+// objectively down (quorum sentinels agree) states of the master. It must be
+// called with s.mu held.
+func (s *Sentinel) checkDown(m *Master) {
+	if down := time.Since(m.master().lastPong) > m.DownAfter; down != m.sdown {
+		m.sdown = down
+		if down {
+			fmt.Println("+sdown master", m.Name, m.host, m.port)
+		} else {
+			fmt.Println("-sdown master", m.Name, m.host, m.port)
+		}
+	}
+
+	votes := 0
+	if m.sdown {
+		votes++
+		for _, p := range m.sentinels {
+			if p.masterDown && time.Since(p.lastReply) < 5*askPeriod {
+				votes++
+			}
+		}
+	}
+	if odown := votes >= m.Quorum; odown != m.odown {
+		m.odown = odown
+		if odown {
+			fmt.Println("+odown master", m.Name, m.host, m.port, "#quorum", strconv.Itoa(votes)+"/"+strconv.Itoa(m.Quorum))
+		} else {
+			fmt.Println("-odown master", m.Name, m.host, m.port)
+		}
+	}
+}
+
+// askSentinels asks the other sentinels whether they also see the master
+// down and, while we are trying to fail it over, for their vote. It must be
+// called with s.mu held.
+func (s *Sentinel) askSentinels(m *Master) {
+	runID := "*"
+	if m.failoverState == "wait-start" {
+		runID = s.id
+	}
+	for _, p := range m.sentinels {
+		if p.asking {
+			continue
+		}
+		p.asking = true
+		go s.ask(p, m.host, m.port, s.currentEpoch, runID)
+	}
+}
+
+func (s *Sentinel) ask(p *peer, host string, port string, epoch int64, runID string) {
+	s.mu.Lock()
+	l, peerHost, peerPort := p.link, p.host, p.port
+	s.mu.Unlock()
+
+	var reply resp.Value
+	var err error
+	if l == nil {
+		l, err = dial(peerHost, peerPort)
+	}
+	if err == nil {
+		reply, err = l.do("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatInt(epoch, 10), runID)
+	}
+	if err == nil && (reply.Type != resp.RESPTypeArray || len(reply.Array) != 3) {
+		err = fmt.Errorf("unexpected reply to IS-MASTER-DOWN-BY-ADDR")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.asking = false
+	if err != nil {
+		if l != nil {
+			l.close()
+		}
+		p.link = nil
+		p.masterDown = false
+		return
+	}
+	p.link = l
+	p.masterDown = reply.Array[0].Integer == 1
+	p.lastReply = time.Now()
+	if leader := reply.Array[1].String; leader != "*" {
+		p.leader = leader
+		p.leaderEpoch = int64(reply.Array[2].Integer)
+	}
+}
+
+// vote grants our vote to fail over the master in epoch to the sentinel
+// runID, unless we already voted in that epoch, and returns the sentinel we
+// voted for. It must be called with s.mu held.
+func (s *Sentinel) vote(m *Master, epoch int64, runID string) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Println("+new-epoch", epoch)
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = runID
+		m.leaderEpoch = s.currentEpoch
+		fmt.Println("+vote-for-leader", runID, m.leaderEpoch)
+		if runID != s.id {
+			// Leave the failover to the sentinel we voted for.
+			m.failoverStart = desyncedNow()
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// checkFailover drives the failover of the master once it is objectively
+// down: we try to get elected as the leader for a new epoch, then promote the
+// best replica and point the other replicas to it. It must be called with
+// s.mu held.
+func (s *Sentinel) checkFailover(m *Master) {
+	switch m.failoverState {
+	case "":
+		if !m.odown || time.Since(m.failoverStart) < 2*m.FailoverTimeout {
+			return
+		}
+		s.currentEpoch++
+		m.failoverEpoch = s.currentEpoch
+		m.failoverState = "wait-start"
+		m.failoverStart = desyncedNow()
+		fmt.Println("+new-epoch", s.currentEpoch)
+		fmt.Println("+try-failover master", m.Name, m.host, m.port)
+		s.vote(m, m.failoverEpoch, s.id)
+		s.askSentinels(m)
+	case "wait-start":
+		if s.elected(m) {
+			fmt.Println("+elected-leader master", m.Name, m.host, m.port)
+			m.failoverState = "select-slave"
+		} else if time.Since(m.failoverStart) > min(m.FailoverTimeout, electionTimeout) {
+			fmt.Println("-failover-abort-not-elected master", m.Name, m.host, m.port)
+			m.failoverState = ""
+		}
+	case "select-slave":
+		replica := s.selectReplica(m)
+		if replica == nil {
+			fmt.Println("-failover-abort-no-good-slave master", m.Name, m.host, m.port)
+			m.failoverState = ""
+			return
+		}
+		fmt.Println("+selected-slave slave", replica.addr(), "@", m.Name, m.host, m.port)
+		m.promoted = replica
+		m.failoverState = "wait-promotion"
+		fmt.Println("+failover-state-send-slaveof-noone slave", replica.addr(), "@", m.Name, m.host, m.port)
+		go s.replicaOf(replica, "NO", "ONE")
+	case "wait-promotion":
+		promoted := m.promoted
+		if promoted.role == "master" && promoted.roleSince.After(m.failoverStart) {
+			fmt.Println("+promoted-slave slave", promoted.addr(), "@", m.Name, m.host, m.port)
+			m.configEpoch = m.failoverEpoch
+			for _, replica := range m.replicas() {
+				if replica != promoted && replica != m.master() {
+					fmt.Println("+slave-reconf-sent slave", replica.addr(), "@", m.Name, m.host, m.port)
+					go s.replicaOf(replica, promoted.host, promoted.port)
+				}
+			}
+			s.switchMaster(m, promoted.host, promoted.port)
+		} else if time.Since(m.failoverStart) > m.FailoverTimeout {
+			fmt.Println("-failover-abort-slave-timeout master", m.Name, m.host, m.port)
+			m.failoverState = ""
+			m.promoted = nil
+		}
+	}
+}
+
+// desyncedNow returns the current time plus a random delay of up to
+// maxDesync.
+func desyncedNow() time.Time {
+	return time.Now().Add(rand.N(maxDesync))
+}
+
+// elected reports whether we got the votes of a majority of the sentinels,
+// and at least quorum votes, for the current failover epoch. It must be
+// called with s.mu held.
+func (s *Sentinel) elected(m *Master) bool {
+	votes := 0
+	if m.leader == s.id && m.leaderEpoch == m.failoverEpoch {
+		votes++
+	}
+	for _, p := range m.sentinels {
+		if p.leader == s.id && p.leaderEpoch == m.failoverEpoch {
+			votes++
+		}
+	}
+	return votes >= m.Quorum && votes >= (len(m.sentinels)+1)/2+1
+}
+
+// selectReplica returns the replica to promote: among the replicas that
+// replied recently, the one with the greatest replication offset. It must be
+// called with s.mu held.
+func (s *Sentinel) selectReplica(m *Master) *instance {
+	var candidates []*instance
+	for _, replica := range m.replicas() {
+		if replica.role != "slave" || time.Since(replica.lastPong) > 5*pingPeriod || time.Since(replica.lastInfo) > 5*pingPeriod {
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].offset > candidates[j].offset })
+	return candidates[0]
+}
+
+// replicaOf sends REPLICAOF to the instance.
+func (s *Sentinel) replicaOf(inst *instance, host string, port string) {
+	l, err := dial(inst.host, inst.port)
+	if err == nil {
+		_, err = l.do("REPLICAOF", host, port)
+		l.close()
+	}
+	if err != nil {
+		fmt.Println("Failed to send REPLICAOF to", inst.addr(), ":", err.Error())
+	}
+}
+
+// switchMaster makes host:port the master of m, e.g. after a failover by us
+// or announced by another sentinel. The old master is kept as a replica to
+// reconfigure when it comes back. It must be called with s.mu held.
+func (s *Sentinel) switchMaster(m *Master, host string, port string) {
+	fmt.Println("+switch-master", m.Name, m.host, m.port, host, port)
+	m.host, m.port = host, port
+	s.addInstance(m, host, port)
+	m.sdown, m.odown = false, false
+	m.failoverState = ""
+	m.promoted = nil
+	for _, p := range m.sentinels {
+		p.masterDown = false
+	}
+}
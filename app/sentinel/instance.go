@@ -0,0 +1,323 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// HelloChannel is the channel of the monitored instances through which
+// sentinels announce themselves and their view of the master.
+const HelloChannel = "__sentinel__:hello"
+
+const (
+	pingPeriod  = time.Second
+	helloPeriod = 2 * time.Second
+	linkTimeout = time.Second
+)
+
+// instance is a master or replica monitored by the sentinel.
+type instance struct {
+	host string
+	port string
+	// lastPong is the time of the last valid reply to PING.
+	lastPong time.Time
+	lastInfo time.Time
+	// role is the role reported by INFO, and roleSince when it last changed.
+	role         string
+	roleSince    time.Time
+	masterHost   string
+	masterPort   string
+	masterLinkUp bool
+	offset       int64
+}
+
+func (inst *instance) addr() string {
+	return net.JoinHostPort(inst.host, inst.port)
+}
+
+func (inst *instance) masterLinkStatus() string {
+	if inst.masterLinkUp {
+		return "ok"
+	}
+	return "err"
+}
+
+// peer is another sentinel monitoring the same master.
+type peer struct {
+	id        string
+	host      string
+	port      string
+	lastHello time.Time
+	link      *link
+	asking    bool
+	// masterDown, leader and leaderEpoch are its last reply to
+	// SENTINEL IS-MASTER-DOWN-BY-ADDR, received at lastReply.
+	masterDown  bool
+	lastReply   time.Time
+	leader      string
+	leaderEpoch int64
+}
+
+func (p *peer) votedLeader() string {
+	if p.leader == "" {
+		return "?"
+	}
+	return p.leader
+}
+
+// link is a connection to a monitored instance or another sentinel.
+type link struct {
+	conn net.Conn
+	r    *resp.Reader
+}
+
+func dial(host string, port string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), linkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &link{conn: conn, r: resp.NewReader(conn)}, nil
+}
+
+// do sends a command and waits for its reply.
+func (l *link) do(args ...any) (resp.Value, error) {
+	l.conn.SetDeadline(time.Now().Add(linkTimeout))
+	if _, err := l.conn.Write(resp.ToArray(args)); err != nil {
+		return resp.Value{}, err
+	}
+	reply, _, err := l.r.ReadValue()
+	return reply, err
+}
+
+func (l *link) close() {
+	l.conn.Close()
+}
+
+// addInstance starts monitoring the instance at host:port as part of m, if
+// it is not known yet. It must be called with s.mu held.
+func (s *Sentinel) addInstance(m *Master, host string, port string) *instance {
+	addr := net.JoinHostPort(host, port)
+	if inst, exists := m.instances[addr]; exists {
+		return inst
+	}
+	now := time.Now()
+	inst := &instance{host: host, port: port, lastPong: now, roleSince: now}
+	m.instances[addr] = inst
+	go s.watch(m, inst)
+	go s.listenHello(m, inst)
+	return inst
+}
+
+// watch pings the instance, refreshes its INFO and publishes our hello
+// message to it for as long as the sentinel runs.
+func (s *Sentinel) watch(m *Master, inst *instance) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	var l *link
+	var lastHello time.Time
+	for {
+		if l == nil {
+			l, _ = dial(inst.host, inst.port)
+		}
+		if l != nil {
+			if err := s.refresh(m, inst, l); err != nil {
+				l.close()
+				l = nil
+			} else if time.Since(lastHello) >= helloPeriod {
+				s.publishHello(m, l)
+				lastHello = time.Now()
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// refresh pings the instance and processes its INFO replication.
+func (s *Sentinel) refresh(m *Master, inst *instance, l *link) error {
+	reply, err := l.do("PING")
+	if err != nil {
+		return err
+	}
+	if reply.Type != resp.RESPTypeError || strings.HasPrefix(reply.String, "LOADING") || strings.HasPrefix(reply.String, "MASTERDOWN") {
+		s.mu.Lock()
+		inst.lastPong = time.Now()
+		s.mu.Unlock()
+	}
+
+	reply, err = l.do("INFO", "replication")
+	if err != nil {
+		return err
+	}
+	if host, port, ok := s.processInfo(m, inst, reply.String); ok {
+		fmt.Println("+convert-to-slave slave", inst.addr(), "@", m.Name, host, port)
+		if _, err := l.do("REPLICAOF", host, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processInfo updates the instance from its INFO replication and discovers
+// the replicas of the master. It returns the master the instance must be
+// made a replica of when it does not follow the current configuration.
+func (s *Sentinel) processInfo(m *Master, inst *instance, info string) (string, string, bool) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), ":"); found {
+			fields[key] = value
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	inst.lastInfo = now
+	if role := fields["role"]; role != inst.role {
+		inst.role = role
+		inst.roleSince = now
+	}
+	switch inst.role {
+	case "master":
+		inst.offset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+		inst.masterHost, inst.masterPort, inst.masterLinkUp = "", "", false
+		if inst != m.master() {
+			break
+		}
+		for i := 0; ; i++ {
+			replica, exists := fields["slave"+strconv.Itoa(i)]
+			if !exists {
+				break
+			}
+			values := make(map[string]string)
+			for _, pair := range strings.Split(replica, ",") {
+				if key, value, found := strings.Cut(pair, "="); found {
+					values[key] = value
+				}
+			}
+			if values["ip"] == "" || values["port"] == "" {
+				continue
+			}
+			if _, known := m.instances[net.JoinHostPort(values["ip"], values["port"])]; !known {
+				s.addInstance(m, values["ip"], values["port"])
+				fmt.Println("+slave slave", net.JoinHostPort(values["ip"], values["port"]), "@", m.Name, m.host, m.port)
+			}
+		}
+	case "slave":
+		inst.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+		inst.masterHost, inst.masterPort = fields["master_host"], fields["master_port"]
+		inst.masterLinkUp = fields["master_link_status"] == "up"
+	}
+
+	// An instance that should be a replica of the master but reports another
+	// role or master is reconfigured, e.g. an old master coming back after a
+	// failover. We give the sentinel doing a failover time to announce the
+	// new configuration through hello messages first.
+	if inst == m.master() || m.failoverState != "" || m.sdown || now.Sub(inst.roleSince) < 4*helloPeriod {
+		return "", "", false
+	}
+	if inst.role == "master" || (inst.role == "slave" && (inst.masterHost != m.host || inst.masterPort != m.port)) {
+		return m.host, m.port, true
+	}
+	return "", "", false
+}
+
+// publishHello announces ourselves and our configuration of the master to
+// the other sentinels through the instance.
+func (s *Sentinel) publishHello(m *Master, l *link) {
+	host, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+	s.mu.Lock()
+	hello := strings.Join([]string{
+		host, s.port, s.id, strconv.FormatInt(s.currentEpoch, 10),
+		m.Name, m.host, m.port, strconv.FormatInt(m.configEpoch, 10),
+	}, ",")
+	s.mu.Unlock()
+	l.do("PUBLISH", HelloChannel, hello)
+}
+
+// listenHello subscribes to the hello channel of the instance to discover
+// the other sentinels and configuration updates.
+func (s *Sentinel) listenHello(m *Master, inst *instance) {
+	for {
+		if l, err := dial(inst.host, inst.port); err == nil {
+			s.readHellos(m, l)
+			l.close()
+		}
+		time.Sleep(pingPeriod)
+	}
+}
+
+func (s *Sentinel) readHellos(m *Master, l *link) error {
+	if _, err := l.do("SUBSCRIBE", HelloChannel); err != nil {
+		return err
+	}
+	for {
+		// Hello messages, at least ours, are published every helloPeriod.
+		l.conn.SetDeadline(time.Now().Add(5 * helloPeriod))
+		message, _, err := l.r.ReadValue()
+		if err != nil {
+			return err
+		}
+		if len(message.Array) == 3 && message.Array[0].String == "message" {
+			s.processHello(m, message.Array[2].String)
+		}
+	}
+}
+
+// processHello handles a hello message: "ip,port,runid,current_epoch,
+// master_name,master_ip,master_port,master_config_epoch".
+func (s *Sentinel) processHello(m *Master, hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	host, port, id := fields[0], fields[1], fields[2]
+	epoch, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return
+	}
+	configEpoch, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.id || fields[4] != m.Name {
+		return
+	}
+	p, exists := m.sentinels[id]
+	if !exists {
+		// A sentinel restarted with a new ID replaces its previous entry.
+		for otherID, other := range m.sentinels {
+			if other.host == host && other.port == port {
+				if other.link != nil {
+					other.link.close()
+				}
+				delete(m.sentinels, otherID)
+			}
+		}
+		p = &peer{id: id}
+		m.sentinels[id] = p
+		fmt.Println("+sentinel sentinel", id, host, port, "@", m.Name, m.host, m.port)
+	}
+	p.host, p.port, p.lastHello = host, port, time.Now()
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Println("+new-epoch", epoch)
+	}
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if fields[5] != m.host || fields[6] != m.port {
+			s.switchMaster(m, fields[5], fields[6])
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package sentinel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Sentinel monitors masters and their replicas, and agrees with the other
+// sentinels monitoring them on failing over to a replica when a master is
+// down.
+type Sentinel struct {
+	mu           sync.Mutex
+	id           string
+	port         string
+	currentEpoch int64
+	masters      map[string]*Master
+}
+
+// Master is a master monitored by the sentinel, along with the replicas and
+// other sentinels discovered for it.
+type Master struct {
+	Name            string
+	Quorum          int
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+
+	host        string
+	port        string
+	configEpoch int64
+	// instances holds the master and its replicas by address, so that an
+	// instance keeps its state when it changes role after a failover.
+	instances map[string]*instance
+	sentinels map[string]*peer
+	sdown     bool
+	odown     bool
+
+	// leader is the sentinel we voted for to fail over this master in
+	// leaderEpoch.
+	leader      string
+	leaderEpoch int64
+
+	// failoverState is empty or one of "wait-start", "select-slave" and
+	// "wait-promotion" while we are failing over this master.
+	failoverState string
+	failoverEpoch int64
+	failoverStart time.Time
+	promoted      *instance
+}
+
+func New(port string) *Sentinel {
+	return &Sentinel{
+		id:      replication.NewReplID(),
+		port:    port,
+		masters: make(map[string]*Master),
+	}
+}
+
+// Monitor starts monitoring the master at host:port under name (SENTINEL
+// MONITOR). quorum sentinels must agree that it is down to fail it over.
+func (s *Sentinel) Monitor(name string, host string, port string, quorum int, downAfter time.Duration, failoverTimeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.masters[name]; exists {
+		return fmt.Errorf("Duplicated master name")
+	}
+	if quorum <= 0 {
+		return fmt.Errorf("Quorum must be 1 or greater.")
+	}
+	m := &Master{
+		Name:            name,
+		Quorum:          quorum,
+		DownAfter:       downAfter,
+		FailoverTimeout: failoverTimeout,
+		host:            host,
+		port:            port,
+		instances:       make(map[string]*instance),
+		sentinels:       make(map[string]*peer),
+	}
+	s.masters[name] = m
+	s.addInstance(m, host, port)
+	go s.monitor(m)
+	fmt.Println("+monitor master", name, host, port, "quorum", quorum)
+	return nil
+}
+
+// Handle serves the commands of a client connected to the sentinel.
+func (s *Sentinel) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := resp.NewReader(conn)
+	for {
+		commands, _, err := reader.ReadValue()
+		if err != nil {
+			if err != io.EOF {
+				conn.Write(resp.ToError("Protocol error: " + err.Error()))
+			}
+			return
+		}
+		conn.Write(s.Execute(commands))
+	}
+}
+
+// Execute runs a single sentinel command and returns its reply.
+func (s *Sentinel) Execute(commands resp.Value) []byte {
+	if commands.Type != resp.RESPTypeArray || len(commands.Array) == 0 {
+		return resp.ToError("wrong command structure")
+	}
+
+	switch strings.ToUpper(commands.Array[0].String) {
+	case "PING":
+		return resp.ToSimpleString("PONG")
+	case "INFO":
+		return resp.ToBulkString(s.Info())
+	case "ROLE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		names := []any{}
+		for _, m := range s.sortedMasters() {
+			names = append(names, m.Name)
+		}
+		return resp.ToArray([]any{"sentinel", names})
+	case "SENTINEL":
+		if len(commands.Array) < 2 {
+			return resp.ToError("wrong number of arguments for 'sentinel' command")
+		}
+		return s.command(strings.ToUpper(commands.Array[1].String), commands.Array[2:])
+	default:
+		return resp.ToError("unknown command")
+	}
+}
+
+// command runs a SENTINEL subcommand.
+func (s *Sentinel) command(subcommand string, args []resp.Value) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch subcommand {
+	case "MYID":
+		return resp.ToBulkString(s.id)
+	case "MASTERS":
+		masters := []any{}
+		for _, m := range s.sortedMasters() {
+			masters = append(masters, s.masterFields(m))
+		}
+		return resp.ToArray(masters)
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(args) != 1 {
+			return resp.ToError("wrong number of arguments for 'sentinel get-master-addr-by-name' command")
+		}
+		m, exists := s.masters[args[0].String]
+		if !exists {
+			return []byte("*-1\r\n")
+		}
+		return resp.ToArray([]any{m.host, m.port})
+	case "MASTER", "REPLICAS", "SLAVES", "SENTINELS":
+		if len(args) != 1 {
+			return resp.ToError("wrong number of arguments for 'sentinel " + strings.ToLower(subcommand) + "' command")
+		}
+		m, exists := s.masters[args[0].String]
+		if !exists {
+			return resp.ToError("No such master with that name")
+		}
+		switch subcommand {
+		case "MASTER":
+			return resp.ToArray(s.masterFields(m))
+		case "SENTINELS":
+			sentinels := []any{}
+			for _, p := range m.sortedSentinels() {
+				sentinels = append(sentinels, []any{
+					"name", p.id, "ip", p.host, "port", p.port, "runid", p.id, "flags", "sentinel",
+					"last-hello-message", strconv.FormatInt(time.Since(p.lastHello).Milliseconds(), 10),
+					"voted-leader", p.votedLeader(), "voted-leader-epoch", strconv.FormatInt(p.leaderEpoch, 10),
+				})
+			}
+			return resp.ToArray(sentinels)
+		default:
+			replicas := []any{}
+			for _, inst := range m.replicas() {
+				replicas = append(replicas, []any{
+					"name", inst.addr(), "ip", inst.host, "port", inst.port, "flags", s.instanceFlags(m, inst),
+					"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastPong).Milliseconds(), 10),
+					"master-link-status", inst.masterLinkStatus(),
+					"master-host", inst.masterHost, "master-port", inst.masterPort,
+					"slave-repl-offset", strconv.FormatInt(inst.offset, 10),
+				})
+			}
+			return resp.ToArray(replicas)
+		}
+	case "IS-MASTER-DOWN-BY-ADDR":
+		if len(args) != 4 {
+			return resp.ToError("wrong number of arguments for 'sentinel is-master-down-by-addr' command")
+		}
+		epoch, err := strconv.ParseInt(args[2].String, 10, 64)
+		if err != nil {
+			return resp.ToError("value is not an integer or out of range")
+		}
+		down, leader, leaderEpoch := 0, "*", int64(0)
+		for _, m := range s.masters {
+			if m.host != args[0].String || m.port != args[1].String {
+				continue
+			}
+			if m.sdown {
+				down = 1
+			}
+			if args[3].String != "*" {
+				leader, leaderEpoch = s.vote(m, epoch, args[3].String)
+			}
+		}
+		return resp.ToArray([]any{down, leader, int(leaderEpoch)})
+	default:
+		return resp.ToError("Unknown sentinel subcommand '" + strings.ToLower(subcommand) + "'")
+	}
+}
+
+// Info returns the Sentinel section of INFO.
+func (s *Sentinel) Info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := "# Sentinel\n" +
+		"sentinel_masters:" + strconv.Itoa(len(s.masters)) + "\n" +
+		"sentinel_current_epoch:" + strconv.FormatInt(s.currentEpoch, 10) + "\n"
+	for i, m := range s.sortedMasters() {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.sdown {
+			status = "sdown"
+		}
+		info += "master" + strconv.Itoa(i) + ":name=" + m.Name + ",status=" + status +
+			",address=" + net.JoinHostPort(m.host, m.port) +
+			",slaves=" + strconv.Itoa(len(m.replicas())) +
+			",sentinels=" + strconv.Itoa(len(m.sentinels)+1) + "\n"
+	}
+	return info
+}
+
+// masterFields returns the reply of SENTINEL MASTER. It must be called with
+// s.mu held.
+func (s *Sentinel) masterFields(m *Master) []any {
+	failoverState := m.failoverState
+	if failoverState == "" {
+		failoverState = "none"
+	}
+	return []any{
+		"name", m.Name, "ip", m.host, "port", m.port,
+		"flags", s.instanceFlags(m, m.master()),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(m.master().lastPong).Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(m.replicas())),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.Quorum),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"down-after-milliseconds", strconv.FormatInt(m.DownAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.FailoverTimeout.Milliseconds(), 10),
+		"failover-state", failoverState,
+	}
+}
+
+// instanceFlags must be called with s.mu held.
+func (s *Sentinel) instanceFlags(m *Master, inst *instance) string {
+	flags := []string{"slave"}
+	if inst == m.master() {
+		flags = []string{"master"}
+		if m.odown {
+			flags = append(flags, "o_down")
+		}
+		if m.failoverState != "" {
+			flags = append(flags, "failover_in_progress")
+		}
+	}
+	if time.Since(inst.lastPong) > m.DownAfter {
+		flags = append(flags, "s_down")
+	}
+	if inst == m.promoted {
+		flags = append(flags, "promoted")
+	}
+	return strings.Join(flags, ",")
+}
+
+// sortedMasters must be called with s.mu held.
+func (s *Sentinel) sortedMasters() []*Master {
+	masters := make([]*Master, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Name < masters[j].Name })
+	return masters
+}
+
+func (m *Master) addr() string {
+	return net.JoinHostPort(m.host, m.port)
+}
+
+func (m *Master) master() *instance {
+	return m.instances[m.addr()]
+}
+
+// replicas returns the known instances other than the current master, sorted
+// by address.
+func (m *Master) replicas() []*instance {
+	replicas := make([]*instance, 0, len(m.instances))
+	for addr, inst := range m.instances {
+		if addr != m.addr() {
+			replicas = append(replicas, inst)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].addr() < replicas[j].addr() })
+	return replicas
+}
+
+func (m *Master) sortedSentinels() []*peer {
+	sentinels := make([]*peer, 0, len(m.sentinels))
+	for _, p := range m.sentinels {
+		sentinels = append(sentinels, p)
+	}
+	sort.Slice(sentinels, func(i, j int) bool { return sentinels[i].id < sentinels[j].id })
+	return sentinels
+}
@@ -0,0 +1,379 @@
+package sentinel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// newTestMaster returns a master monitored by s without starting to watch
+// its instances, with the master instance last seen at lastPong.
+func newTestMaster(s *Sentinel, quorum int, lastPong time.Time) *Master {
+	m := &Master{
+		Name:            "mymaster",
+		Quorum:          quorum,
+		DownAfter:       time.Second,
+		FailoverTimeout: time.Minute,
+		host:            "127.0.0.1",
+		port:            "6379",
+		instances:       make(map[string]*instance),
+		sentinels:       make(map[string]*peer),
+	}
+	m.instances[m.addr()] = &instance{host: m.host, port: m.port, role: "master", lastPong: lastPong}
+	s.masters[m.Name] = m
+	return m
+}
+
+func TestObjectivelyDown(t *testing.T) {
+	s := New("26379")
+	m := newTestMaster(s, 2, time.Now())
+	m.sentinels["other"] = &peer{id: "other", masterDown: true, lastReply: time.Now()}
+
+	s.checkDown(m)
+	if m.sdown || m.odown {
+		t.Fatalf("master replying to pings is down: sdown %v, odown %v", m.sdown, m.odown)
+	}
+
+	m.master().lastPong = time.Now().Add(-2 * time.Second)
+	m.sentinels["other"].masterDown = false
+	s.checkDown(m)
+	if !m.sdown || m.odown {
+		t.Errorf("master down for us only: sdown %v, odown %v, want only sdown", m.sdown, m.odown)
+	}
+
+	// Another sentinel agreeing reaches the quorum of 2, unless its reply
+	// is too old.
+	m.sentinels["other"].masterDown = true
+	m.sentinels["other"].lastReply = time.Now().Add(-10 * askPeriod)
+	s.checkDown(m)
+	if m.odown {
+		t.Errorf("odown reached with a stale reply")
+	}
+	m.sentinels["other"].lastReply = time.Now()
+	s.checkDown(m)
+	if !m.odown {
+		t.Errorf("odown not reached with the quorum")
+	}
+
+	m.master().lastPong = time.Now()
+	s.checkDown(m)
+	if m.sdown || m.odown {
+		t.Errorf("master back up still down: sdown %v, odown %v", m.sdown, m.odown)
+	}
+}
+
+func TestVoteOncePerEpoch(t *testing.T) {
+	s := New("26379")
+	m := newTestMaster(s, 2, time.Now())
+
+	if leader, epoch := s.vote(m, 1, "a"); leader != "a" || epoch != 1 {
+		t.Errorf("vote in epoch 1 = %s, %d, want a, 1", leader, epoch)
+	}
+	if leader, _ := s.vote(m, 1, "b"); leader != "a" {
+		t.Errorf("second vote in epoch 1 went to %s, want it kept for a", leader)
+	}
+	if leader, epoch := s.vote(m, 2, "b"); leader != "b" || epoch != 2 {
+		t.Errorf("vote in epoch 2 = %s, %d, want b, 2", leader, epoch)
+	}
+	if s.currentEpoch != 2 {
+		t.Errorf("current epoch = %d, want 2", s.currentEpoch)
+	}
+	// Votes for older epochs are not granted.
+	if leader, epoch := s.vote(m, 1, "c"); leader != "b" || epoch != 2 {
+		t.Errorf("vote in epoch 1 after epoch 2 = %s, %d, want b, 2", leader, epoch)
+	}
+}
+
+func TestElected(t *testing.T) {
+	s := New("26379")
+	m := newTestMaster(s, 2, time.Now())
+	for _, id := range []string{"a", "b", "c", "d"} {
+		m.sentinels[id] = &peer{id: id}
+	}
+	m.failoverEpoch = 3
+	s.vote(m, 3, s.id)
+
+	// Five sentinels: our vote and another reach the quorum of 2 but not
+	// the majority of 3.
+	m.sentinels["a"].leader, m.sentinels["a"].leaderEpoch = s.id, 3
+	if s.elected(m) {
+		t.Errorf("elected with 2 votes out of 5 sentinels")
+	}
+	// Votes for another epoch do not count.
+	m.sentinels["b"].leader, m.sentinels["b"].leaderEpoch = s.id, 2
+	if s.elected(m) {
+		t.Errorf("elected with a vote of a previous epoch")
+	}
+	m.sentinels["b"].leaderEpoch = 3
+	if !s.elected(m) {
+		t.Errorf("not elected with 3 votes out of 5 sentinels")
+	}
+}
+
+func TestSelectReplica(t *testing.T) {
+	s := New("26379")
+	m := newTestMaster(s, 1, time.Now())
+	now := time.Now()
+	replica := func(port string, offset int64, lastPong time.Time) *instance {
+		inst := &instance{host: "127.0.0.1", port: port, role: "slave", offset: offset, lastPong: lastPong, lastInfo: now}
+		m.instances[inst.addr()] = inst
+		return inst
+	}
+	replica("7001", 100, now)
+	best := replica("7002", 300, now)
+	// Ahead, but not replying.
+	replica("7003", 500, now.Add(-time.Minute))
+
+	if got := s.selectReplica(m); got != best {
+		t.Errorf("selected %v, want the replica at 7002", got)
+	}
+	best.role = "master"
+	if got := s.selectReplica(m); got == nil || got.port != "7001" {
+		t.Errorf("selected %v, want the replica at 7001", got)
+	}
+}
+
+// fakeServer is an in-process master or replica answering what sentinels
+// send to the instances they monitor: PING, INFO replication, REPLICAOF and
+// the hello channel.
+type fakeServer struct {
+	t        *testing.T
+	topology *fakeTopology
+	l        net.Listener
+	port     string
+
+	// Guarded by topology.mu.
+	role        string
+	master      *fakeServer
+	conns       []net.Conn
+	subscribers []net.Conn
+	replicaOf   []string
+}
+
+// fakeTopology holds the fake servers, so that masters list the replicas
+// following them.
+type fakeTopology struct {
+	mu      sync.Mutex
+	servers []*fakeServer
+}
+
+func (topo *fakeTopology) start(t *testing.T, master *fakeServer) *fakeServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	f := &fakeServer{t: t, topology: topo, l: l, port: port, role: "master", master: master}
+	if master != nil {
+		f.role = "slave"
+	}
+	topo.mu.Lock()
+	topo.servers = append(topo.servers, f)
+	topo.mu.Unlock()
+	t.Cleanup(f.stop)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			topo.mu.Lock()
+			f.conns = append(f.conns, conn)
+			topo.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// stop makes the server unreachable, as if it crashed.
+func (f *fakeServer) stop() {
+	f.l.Close()
+	f.topology.mu.Lock()
+	defer f.topology.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	r := resp.NewReader(conn)
+	for {
+		command, _, err := r.ReadValue()
+		if err != nil || len(command.Array) == 0 {
+			return
+		}
+		args := make([]string, len(command.Array))
+		for i, arg := range command.Array {
+			args[i] = arg.String
+		}
+		if _, err := conn.Write(f.execute(conn, args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeServer) execute(conn net.Conn, args []string) []byte {
+	topo := f.topology
+	topo.mu.Lock()
+	defer topo.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return resp.ToSimpleString("PONG")
+	case "INFO":
+		info := "# Replication\r\nrole:" + f.role + "\r\n"
+		if f.role == "master" {
+			i := 0
+			for _, replica := range topo.servers {
+				if replica.role == "slave" && replica.master == f {
+					info += "slave" + strconv.Itoa(i) + ":ip=127.0.0.1,port=" + replica.port + ",state=online,offset=10,lag=0\r\n"
+					i++
+				}
+			}
+			info += "master_repl_offset:10\r\n"
+		} else {
+			info += "master_host:127.0.0.1\r\nmaster_port:" + f.master.port + "\r\n" +
+				"master_link_status:up\r\nslave_repl_offset:10\r\n"
+		}
+		return resp.ToBulkString(info)
+	case "REPLICAOF":
+		f.replicaOf = append(f.replicaOf, args[1]+" "+args[2])
+		if strings.ToUpper(args[1]) == "NO" {
+			f.role, f.master = "master", nil
+		} else {
+			for _, server := range topo.servers {
+				if server.port == args[2] {
+					f.role, f.master = "slave", server
+				}
+			}
+		}
+		return resp.ToSimpleString("OK")
+	case "SUBSCRIBE":
+		f.subscribers = append(f.subscribers, conn)
+		return resp.ToArray([]any{"subscribe", args[1], 1})
+	case "PUBLISH":
+		message := resp.ToArray([]any{"message", args[1], args[2]})
+		for _, subscriber := range f.subscribers {
+			subscriber.Write(message)
+		}
+		return resp.ToInteger(len(f.subscribers))
+	default:
+		return resp.ToError("unknown command")
+	}
+}
+
+func (f *fakeServer) replicaOfCalls() []string {
+	f.topology.mu.Lock()
+	defer f.topology.mu.Unlock()
+	return append([]string(nil), f.replicaOf...)
+}
+
+// startSentinel runs a sentinel serving its clients on a local port.
+func startSentinel(t *testing.T) *Sentinel {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	s := New(port)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.Handle(conn)
+		}
+	}()
+	return s
+}
+
+// masterPort returns the port of the master s monitors as mymaster.
+func masterPort(s *Sentinel) string {
+	reply, _, err := resp.Parse(s.Execute(resp.Value{Type: resp.RESPTypeArray, Array: []resp.Value{
+		resp.NewBulkString("SENTINEL"), resp.NewBulkString("GET-MASTER-ADDR-BY-NAME"), resp.NewBulkString("mymaster"),
+	}}))
+	if err != nil || len(reply.Array) != 2 {
+		return ""
+	}
+	return reply.Array[1].String
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("failover takes several seconds")
+	}
+	topo := &fakeTopology{}
+	master := topo.start(t, nil)
+	replicas := []*fakeServer{topo.start(t, master), topo.start(t, master)}
+
+	sentinels := []*Sentinel{startSentinel(t), startSentinel(t), startSentinel(t)}
+	for _, s := range sentinels {
+		if err := s.Monitor("mymaster", "127.0.0.1", master.port, 2, time.Second, 2*time.Second); err != nil {
+			t.Fatalf("Monitor: %v", err)
+		}
+	}
+
+	// The sentinels discover each other through the hello channel, and the
+	// replicas through the INFO of the master.
+	waitFor(t, 10*time.Second, "sentinels and replicas to be discovered", func() bool {
+		for _, s := range sentinels {
+			s.mu.Lock()
+			m := s.masters["mymaster"]
+			found := len(m.sentinels) == 2 && len(m.replicas()) == 2
+			s.mu.Unlock()
+			if !found {
+				return false
+			}
+		}
+		return true
+	})
+
+	master.stop()
+	waitFor(t, 30*time.Second, "every sentinel to switch to a new master", func() bool {
+		for _, s := range sentinels {
+			if masterPort(s) == master.port {
+				return false
+			}
+		}
+		return true
+	})
+
+	promoted, other := replicas[0], replicas[1]
+	if masterPort(sentinels[0]) != promoted.port {
+		promoted, other = other, promoted
+	}
+	for _, s := range sentinels {
+		if port := masterPort(s); port != promoted.port {
+			t.Errorf("sentinels disagree on the new master: %s and %s", port, promoted.port)
+		}
+	}
+	if calls := promoted.replicaOfCalls(); len(calls) == 0 || calls[0] != "NO ONE" {
+		t.Errorf("promoted replica received REPLICAOF %v, want NO ONE", calls)
+	}
+	waitFor(t, 5*time.Second, "the other replica to follow the new master", func() bool {
+		calls := other.replicaOfCalls()
+		return len(calls) > 0 && calls[len(calls)-1] == "127.0.0.1 "+promoted.port
+	})
+}
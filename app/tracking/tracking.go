@@ -0,0 +1,287 @@
+package tracking
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Channel used to deliver invalidation messages to RESP2 connections.
+const InvalidateChannel = "__redis__:invalidate"
+
+type Options struct {
+	Redirect int64
+	Bcast    bool
+	Prefixes []string
+	OptIn    bool
+	OptOut   bool
+	NoLoop   bool
+}
+
+type state struct {
+	Options
+	// CLIENT CACHING yes|no only applies to the command that follows it.
+	caching      bool
+	cachingSet   bool
+	cachingFresh bool
+}
+
+// Table remembers which keys every tracking client has read (default mode)
+// or which prefixes it is interested in (BCAST mode) and sends invalidation
+// messages when those keys are modified.
+type Table struct {
+	mu       sync.Mutex
+	clients  map[int64]*state
+	keys     map[string]map[int64]struct{}
+	prefixes map[string]map[int64]struct{}
+}
+
+func NewTable() *Table {
+	return &Table{
+		clients:  make(map[int64]*state),
+		keys:     make(map[string]map[int64]struct{}),
+		prefixes: make(map[string]map[int64]struct{}),
+	}
+}
+
+func (t *Table) Enable(id int64, opts Options) error {
+	if len(opts.Prefixes) > 0 && !opts.Bcast {
+		return fmt.Errorf("PREFIX option requires BCAST mode to be enabled")
+	}
+	if opts.OptIn && opts.OptOut {
+		return fmt.Errorf("You can't use both OPTIN and OPTOUT")
+	}
+	if opts.Bcast && (opts.OptIn || opts.OptOut) {
+		return fmt.Errorf("OPTIN and OPTOUT are not compatible with BCAST")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if exists {
+		if st.Bcast != opts.Bcast {
+			return fmt.Errorf("You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+		if st.OptIn != opts.OptIn || st.OptOut != opts.OptOut {
+			return fmt.Errorf("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+	}
+
+	if opts.Bcast {
+		if len(opts.Prefixes) == 0 {
+			opts.Prefixes = []string{""}
+		}
+		existing := []string{}
+		if exists {
+			existing = st.Prefixes
+		}
+		for _, prefix := range opts.Prefixes {
+			for _, other := range existing {
+				if prefix != other && (strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix)) {
+					return fmt.Errorf("Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+				}
+			}
+		}
+		for _, prefix := range opts.Prefixes {
+			if t.prefixes[prefix] == nil {
+				t.prefixes[prefix] = make(map[int64]struct{})
+			}
+			t.prefixes[prefix][id] = struct{}{}
+			if !contains(existing, prefix) {
+				existing = append(existing, prefix)
+			}
+		}
+		opts.Prefixes = existing
+	}
+
+	t.clients[id] = &state{Options: opts}
+	return nil
+}
+
+func (t *Table) Disable(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if !exists {
+		return
+	}
+	for _, prefix := range st.Prefixes {
+		delete(t.prefixes[prefix], id)
+		if len(t.prefixes[prefix]) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+	// Entries in the keys table are removed lazily on invalidation.
+	delete(t.clients, id)
+}
+
+func (t *Table) Info(id int64) (opts Options, caching string, enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if !exists {
+		return Options{}, "", false
+	}
+	if st.cachingSet {
+		if st.caching {
+			caching = "yes"
+		} else {
+			caching = "no"
+		}
+	}
+	return st.Options, caching, true
+}
+
+// Caching implements CLIENT CACHING yes|no for the next command of the client.
+func (t *Table) Caching(id int64, yes bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if !exists || (!st.OptIn && !st.OptOut) {
+		return fmt.Errorf("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	if st.OptIn && !yes {
+		return fmt.Errorf("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	if st.OptOut && yes {
+		return fmt.Errorf("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	st.caching, st.cachingSet, st.cachingFresh = yes, true, true
+	return nil
+}
+
+// AfterCommand must be called after every command so that a CLIENT CACHING
+// request only affects the command that immediately follows it.
+func (t *Table) AfterCommand(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if !exists || !st.cachingSet {
+		return
+	}
+	if st.cachingFresh {
+		st.cachingFresh = false
+		return
+	}
+	st.caching, st.cachingSet = false, false
+}
+
+// Remember records that the client read the given keys.
+func (t *Table) Remember(id int64, keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.clients[id]
+	if !exists || st.Bcast {
+		return
+	}
+	if st.OptIn && !(st.cachingSet && st.caching) {
+		return
+	}
+	if st.OptOut && st.cachingSet && !st.caching {
+		return
+	}
+	for _, key := range keys {
+		if t.keys[key] == nil {
+			t.keys[key] = make(map[int64]struct{})
+		}
+		t.keys[key][id] = struct{}{}
+	}
+}
+
+// Invalidate notifies every client interested in the given keys that they
+// were modified by the client with id `from` (0 for the server itself).
+func (t *Table) Invalidate(from int64, keys ...string) {
+	t.mu.Lock()
+	pending := make(map[int64][]string)
+	for _, key := range keys {
+		for id := range t.keys[key] {
+			if st, exists := t.clients[id]; exists && !(st.NoLoop && id == from) {
+				pending[id] = append(pending[id], key)
+			}
+		}
+		delete(t.keys, key)
+
+		for prefix, ids := range t.prefixes {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for id := range ids {
+				if st := t.clients[id]; !(st.NoLoop && id == from) && !contains(pending[id], key) {
+					pending[id] = append(pending[id], key)
+				}
+			}
+		}
+	}
+	redirects := make(map[int64]int64, len(pending))
+	for id := range pending {
+		redirects[id] = t.clients[id].Redirect
+	}
+	t.mu.Unlock()
+
+	for id, keys := range pending {
+		send(id, redirects[id], keys)
+	}
+}
+
+// Flush tells every tracking client that the whole keyspace was replaced,
+// e.g. after a replica loaded the snapshot sent by its master.
+func (t *Table) Flush() {
+	t.mu.Lock()
+	t.keys = make(map[string]map[int64]struct{})
+	redirects := make(map[int64]int64, len(t.clients))
+	for id, st := range t.clients {
+		redirects[id] = st.Redirect
+	}
+	t.mu.Unlock()
+
+	for id, redirect := range redirects {
+		send(id, redirect, nil)
+	}
+}
+
+func send(id int64, redirect int64, keys []string) {
+	target := id
+	if redirect != 0 {
+		target = redirect
+	}
+
+	c, exists := client.Get(target)
+	if !exists {
+		if owner, ok := client.Get(id); ok && redirect != 0 && owner.Protocol() >= 3 {
+			owner.Write(resp.ToPush([]any{"tracking-redir-broken", int(redirect)}))
+		}
+		return
+	}
+
+	var message any
+	if keys != nil {
+		array := make([]any, len(keys))
+		for i, key := range keys {
+			array[i] = key
+		}
+		message = array
+	}
+	if c.Protocol() >= 3 {
+		c.Write(resp.ToPush([]any{"invalidate", message}))
+	} else if c.Subscribed(InvalidateChannel) {
+		c.Write(resp.ToArray([]any{"message", InvalidateChannel, message}))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package tracking
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/client"
+)
+
+// newClient connects a RESP3 client through a pipe and returns the channel
+// receiving what the server writes to it.
+func newClient(t *testing.T) (*client.Client, <-chan string) {
+	t.Helper()
+	server, peer := net.Pipe()
+	c := client.New(server)
+	c.SetProtocol(3)
+	messages := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := peer.Read(buf)
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	t.Cleanup(func() {
+		client.Remove(c.ID)
+		server.Close()
+		peer.Close()
+	})
+	return c, messages
+}
+
+func expectMessage(t *testing.T, messages <-chan string, contains string) {
+	t.Helper()
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, "invalidate") || !strings.Contains(message, contains) {
+			t.Errorf("message = %q, want an invalidation of %q", message, contains)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no invalidation of %q", contains)
+	}
+}
+
+func expectNoMessage(t *testing.T, messages <-chan string) {
+	t.Helper()
+	select {
+	case message := <-messages:
+		t.Errorf("unexpected message %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInvalidateRememberedKeys(t *testing.T) {
+	table := NewTable()
+	c, messages := newClient(t)
+	if err := table.Enable(c.ID, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	table.Remember(c.ID, "key")
+
+	table.Invalidate(0, "other")
+	expectNoMessage(t, messages)
+	table.Invalidate(0, "key")
+	expectMessage(t, messages, "key")
+	// A key is forgotten once invalidated, until read again.
+	table.Invalidate(0, "key")
+	expectNoMessage(t, messages)
+}
+
+func TestNoLoop(t *testing.T) {
+	table := NewTable()
+	c, messages := newClient(t)
+	if err := table.Enable(c.ID, Options{NoLoop: true}); err != nil {
+		t.Fatal(err)
+	}
+	table.Remember(c.ID, "key")
+	table.Invalidate(c.ID, "key")
+	expectNoMessage(t, messages)
+}
+
+func TestBcastPrefixes(t *testing.T) {
+	table := NewTable()
+	c, messages := newClient(t)
+	if err := table.Enable(c.ID, Options{Bcast: true, Prefixes: []string{"user:"}}); err != nil {
+		t.Fatal(err)
+	}
+	table.Invalidate(0, "order:1")
+	expectNoMessage(t, messages)
+	table.Invalidate(0, "user:1")
+	expectMessage(t, messages, "user:1")
+
+	if err := table.Enable(c.ID, Options{Bcast: true, Prefixes: []string{"user:admin:"}}); err == nil {
+		t.Errorf("Enable accepted a prefix overlapping an existing one")
+	}
+}
+
+func TestOptIn(t *testing.T) {
+	table := NewTable()
+	c, messages := newClient(t)
+	if err := table.Enable(c.ID, Options{OptIn: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Keys are only tracked for the command right after CLIENT CACHING yes.
+	table.Remember(c.ID, "ignored")
+	if err := table.Caching(c.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	table.AfterCommand(c.ID)
+	table.Remember(c.ID, "cached")
+	table.AfterCommand(c.ID)
+	table.Remember(c.ID, "later")
+
+	table.Invalidate(0, "ignored", "later")
+	expectNoMessage(t, messages)
+	table.Invalidate(0, "cached")
+	expectMessage(t, messages, "cached")
+
+	if err := table.Caching(c.ID, false); err == nil {
+		t.Errorf("CLIENT CACHING no accepted in OPTIN mode")
+	}
+}
+
+func TestEnableErrors(t *testing.T) {
+	table := NewTable()
+	for _, opts := range []Options{
+		{Prefixes: []string{"a"}},
+		{OptIn: true, OptOut: true},
+		{Bcast: true, OptIn: true},
+	} {
+		if err := table.Enable(1, opts); err == nil {
+			t.Errorf("Enable(%+v) succeeded", opts)
+		}
+	}
+}